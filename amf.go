@@ -7,173 +7,330 @@ import (
 	"io"
 	"math"
 	"reflect"
+	"sort"
+	"time"
 	"unsafe"
 )
 
 const (
-	amfNumber     = 0
-	amfBoolean    = 1
-	amfString     = 2
-	amfObject     = 3
-	amfNull       = 5
-	amfEcmaArray  = 8
-	amfObjectEnd  = 9
-	amfLongString = 12
+	amfNumber      = 0
+	amfBoolean     = 1
+	amfString      = 2
+	amfObject      = 3
+	amfMovieClip   = 4
+	amfNull        = 5
+	amfUndefined   = 6
+	amfReference   = 7
+	amfEcmaArray   = 8
+	amfObjectEnd   = 9
+	amfStrictArray = 10
+	amfDate        = 11
+	amfLongString  = 12
+	amfUnsupported = 13
+	amfRecordSet   = 14
+	amfXMLDocument = 15
+	amfTypedObject = 16
+	amfAVMPlus     = 17
 )
 
 var (
-	errEmptyKey = errors.New("amf object empty key name")
+	errEmptyKey     = errors.New("amf object empty key name")
+	errAMFReference = errors.New("amf invalid reference")
+	errAMFLength    = errors.New("amf length out of range")
 )
 
+// amf0的unsupported
+type Unsupported struct{}
+
+// amf0的typed object
+type TypedObject struct {
+	ClassName string
+	Object    map[string]interface{}
+}
+
+// amf的object和ecma array的一个属性
+type AMFProperty struct {
+	Name  string
+	Value interface{}
+}
+
+// 保持属性顺序的object
+type OrderedObject []AMFProperty
+
+// 返回name的值
+func (o OrderedObject) Get(name string) (interface{}, bool) {
+	for i := range o {
+		if o[i].Name == name {
+			return o[i].Value, true
+		}
+	}
+	return nil, false
+}
+
+// 存在则替换，否则添加到最后
+func (o *OrderedObject) Set(name string, value interface{}) {
+	for i := range *o {
+		if (*o)[i].Name == name {
+			(*o)[i].Value = value
+			return
+		}
+	}
+	*o = append(*o, AMFProperty{Name: name, Value: value})
+}
+
+// 转换成map
+func (o OrderedObject) Map() map[string]interface{} {
+	m := make(map[string]interface{}, len(o))
+	for i := range o {
+		m[o[i].Name] = o[i].Value
+	}
+	return m
+}
+
+// 保持属性顺序的ecma array
+type ECMAArray []AMFProperty
+
+func (a ECMAArray) Get(name string) (interface{}, bool) {
+	return OrderedObject(a).Get(name)
+}
+
+func (a *ECMAArray) Set(name string, value interface{}) {
+	(*OrderedObject)(a).Set(name, value)
+}
+
+func (a ECMAArray) Map() map[string]interface{} {
+	return OrderedObject(a).Map()
+}
+
 // 从r中读取amf对象，返回对象数据或者错误
 func ReadAMF(r io.Reader) (interface{}, error) {
-	var buff [8]byte
-	_, err := r.Read(buff[:1])
+	var ar amfReader
+	ar.r = r
+	return ar.read()
+}
+
+// 和ReadAMF一样，不过object返回OrderedObject，ecma array返回ECMAArray
+func ReadOrderedAMF(r io.Reader) (interface{}, error) {
+	var ar amfReader
+	ar.r = r
+	ar.ordered = true
+	return ar.read()
+}
+
+// 读取amf0，保存object的引用表
+type amfReader struct {
+	r       io.Reader
+	ordered bool // object和ecma array是否保持顺序
+	refs    []interface{}
+	buff    [8]byte
+}
+
+func (r *amfReader) read() (interface{}, error) {
+	_, err := io.ReadFull(r.r, r.buff[:1])
 	if err != nil {
 		return nil, err
 	}
-	switch buff[0] {
+	switch r.buff[0] {
 	case amfNumber:
-		_, err = io.ReadFull(r, buff[:])
-		if err != nil {
-			return nil, err
-		}
-		return math.Float64frombits(binary.BigEndian.Uint64(buff[:])), nil
+		return r.readNumber()
 	case amfBoolean:
-		_, err := r.Read(buff[:1])
+		_, err := io.ReadFull(r.r, r.buff[:1])
 		if err != nil {
 			return nil, err
 		}
-		return buff[0] != 0, nil
+		return r.buff[0] != 0, nil
 	case amfString:
-		return readAMFString(r, buff[:])
+		return readAMFString(r.r, r.buff[:])
 	case amfObject:
-		return readAMFObject(r, buff[:])
+		if r.ordered {
+			object, err := r.readOrderedProperties()
+			return OrderedObject(object), err
+		}
+		return r.readObject()
 	case amfNull:
 		return nil, nil
+	case amfUndefined:
+		return Undefined{}, nil
+	case amfReference:
+		_, err := io.ReadFull(r.r, r.buff[:2])
+		if err != nil {
+			return nil, err
+		}
+		i := int(binary.BigEndian.Uint16(r.buff[:]))
+		if i >= len(r.refs) {
+			return nil, errAMFReference
+		}
+		return r.refs[i], nil
 	case amfEcmaArray:
-		return readAMFEcmaArray(r, buff[:])
+		// count只是参考，以object end为结束
+		_, err := io.ReadFull(r.r, r.buff[:4])
+		if err != nil {
+			return nil, err
+		}
+		if r.ordered {
+			array, err := r.readOrderedProperties()
+			return ECMAArray(array), err
+		}
+		return r.readObject()
+	case amfStrictArray:
+		return r.readStrictArray()
+	case amfDate:
+		ms, err := r.readNumber()
+		if err != nil {
+			return nil, err
+		}
+		// time zone，应该是0，忽略
+		_, err = io.ReadFull(r.r, r.buff[:2])
+		if err != nil {
+			return nil, err
+		}
+		return amfTime(ms), nil
 	case amfLongString:
-		return readAMFLongString(r, buff[:])
+		return readAMFLongString(r.r, r.buff[:])
+	case amfUnsupported:
+		return Unsupported{}, nil
+	case amfXMLDocument:
+		s, err := readAMFLongString(r.r, r.buff[:])
+		if err != nil {
+			return nil, err
+		}
+		return XMLDocument(s), nil
+	case amfTypedObject:
+		name, err := readAMFString(r.r, r.buff[:])
+		if err != nil {
+			return nil, err
+		}
+		object := &TypedObject{ClassName: name, Object: make(map[string]interface{})}
+		r.refs = append(r.refs, object)
+		return object, r.readProperties(func(key string, value interface{}) {
+			object.Object[key] = value
+		})
+	case amfAVMPlus:
+		return ReadAMF3(r.r)
 	default:
-		return nil, fmt.Errorf("unsupported amf type <%d>", buff[0])
+		// movie clip和record set是保留的
+		return nil, fmt.Errorf("unsupported amf type <%d>", r.buff[0])
 	}
 }
 
-func readAMFString(r io.Reader, b []byte) (string, error) {
-	_, err := io.ReadFull(r, b[:2])
+func (r *amfReader) readNumber() (float64, error) {
+	_, err := io.ReadFull(r.r, r.buff[:])
 	if err != nil {
-		return "", err
-	}
-	n := binary.BigEndian.Uint16(b[:2])
-	if n == 0 {
-		return "", nil
+		return 0, err
 	}
-	str := make([]byte, n)
-	_, err = io.ReadFull(r, str)
-	if err != nil {
-		return "", err
-	}
-	return *(*string)(unsafe.Pointer(&str)), nil
+	return math.Float64frombits(binary.BigEndian.Uint64(r.buff[:])), nil
 }
 
-func readAMFLongString(r io.Reader, b []byte) (string, error) {
-	_, err := io.ReadFull(r, b[:4])
+func (r *amfReader) readStrictArray() (interface{}, error) {
+	_, err := io.ReadFull(r.r, r.buff[:4])
 	if err != nil {
-		return "", err
+		return nil, err
 	}
-	n := binary.BigEndian.Uint16(b[:4])
-	if n == 0 {
-		return "", nil
+	n := binary.BigEndian.Uint32(r.buff[:])
+	if n > MaxChunkSize {
+		return nil, errAMFLength
 	}
-	str := make([]byte, n)
-	_, err = io.ReadFull(r, str)
-	if err != nil {
-		return "", err
+	array := make([]interface{}, n)
+	r.refs = append(r.refs, array)
+	for i := range array {
+		array[i], err = r.read()
+		if err != nil {
+			return nil, err
+		}
 	}
-	return *(*string)(unsafe.Pointer(&str)), nil
+	return array, nil
+}
+
+func (r *amfReader) readObject() (map[string]interface{}, error) {
+	object := make(map[string]interface{})
+	r.refs = append(r.refs, object)
+	return object, r.readProperties(func(key string, value interface{}) {
+		object[key] = value
+	})
+}
+
+// slice在读完之前不能确定，所以先占位，读完再设置引用
+func (r *amfReader) readOrderedProperties() ([]AMFProperty, error) {
+	i := len(r.refs)
+	r.refs = append(r.refs, nil)
+	var object []AMFProperty
+	err := r.readProperties(func(key string, value interface{}) {
+		object = append(object, AMFProperty{Name: key, Value: value})
+	})
+	r.refs[i] = object
+	return object, err
 }
 
-func readAMFObject(r io.Reader, b []byte) (map[string]interface{}, error) {
-	objects := make(map[string]interface{})
-	var key string
-	var value interface{}
-	var err error
-	var n uint16
+// 读取object的属性，直到object end
+func (r *amfReader) readProperties(set func(key string, value interface{})) error {
 	for {
-		_, err = io.ReadFull(r, b[:3])
+		_, err := io.ReadFull(r.r, r.buff[:2])
 		if err != nil {
-			return nil, err
-		}
-		// object end
-		if b[0] == 0 && b[1] == 0 && b[2] == 9 {
-			return objects, nil
+			return err
 		}
 		// key
-		n = binary.BigEndian.Uint16(b[:])
+		n := binary.BigEndian.Uint16(r.buff[:])
 		if n == 0 {
-			return nil, errEmptyKey
+			// object end
+			_, err = io.ReadFull(r.r, r.buff[:1])
+			if err != nil {
+				return err
+			}
+			if r.buff[0] != amfObjectEnd {
+				return errEmptyKey
+			}
+			return nil
 		}
 		str := make([]byte, n)
-		str[0] = b[2]
-		_, err = io.ReadFull(r, str[1:])
+		_, err = io.ReadFull(r.r, str)
 		if err != nil {
-			return nil, err
+			return err
 		}
-		key = *(*string)(unsafe.Pointer(&str))
+		key := *(*string)(unsafe.Pointer(&str))
 		// value
-		value, err = ReadAMF(r)
+		value, err := r.read()
 		if err != nil {
-			return nil, err
+			return err
 		}
-		objects[key] = value
+		set(key, value)
 	}
 }
 
-func readAMFEcmaArray(r io.Reader, b []byte) (map[string]interface{}, error) {
-	_, err := io.ReadFull(r, b[:4])
+func readAMFString(r io.Reader, b []byte) (string, error) {
+	_, err := io.ReadFull(r, b[:2])
 	if err != nil {
-		return nil, err
+		return "", err
 	}
-	objects := make(map[string]interface{})
-	count := int(binary.BigEndian.Uint32(b[:]))
-	if count == 0 {
-		return objects, nil
+	n := binary.BigEndian.Uint16(b[:2])
+	if n == 0 {
+		return "", nil
 	}
-	var n int
-	var key string
-	var value interface{}
-	for i := 0; i < count; i++ {
-		_, err = io.ReadFull(r, b[:2])
-		if err != nil {
-			return nil, err
-		}
-		// key
-		n = int(binary.BigEndian.Uint16(b[:]))
-		if n == 0 {
-			return nil, errEmptyKey
-		}
-		str := make([]byte, n)
-		_, err = io.ReadFull(r, str)
-		if err != nil {
-			return nil, err
-		}
-		key = *(*string)(unsafe.Pointer(&str))
-		value, err = ReadAMF(r)
-		if err != nil {
-			return nil, err
-		}
-		objects[key] = value
+	str := make([]byte, n)
+	_, err = io.ReadFull(r, str)
+	if err != nil {
+		return "", err
 	}
-	// object end
-	_, err = io.ReadFull(r, b[:3])
+	return *(*string)(unsafe.Pointer(&str)), nil
+}
+
+func readAMFLongString(r io.Reader, b []byte) (string, error) {
+	_, err := io.ReadFull(r, b[:4])
 	if err != nil {
-		return nil, err
+		return "", err
 	}
-	if b[0] != 0 && b[1] != 0 && b[2] != amfObjectEnd {
-		return nil, fmt.Errorf("unsupported amf object end [0]:<%d>, [1]:<%d>, [2]:<%d>", b[0], b[1], b[2])
+	n := binary.BigEndian.Uint32(b[:4])
+	if n == 0 {
+		return "", nil
+	}
+	if n > MaxChunkSize {
+		return "", errAMFLength
 	}
-	return objects, nil
+	str := make([]byte, n)
+	_, err = io.ReadFull(r, str)
+	if err != nil {
+		return "", err
+	}
+	return *(*string)(unsafe.Pointer(&str)), nil
 }
 
 func WriteAMFs(w io.Writer, a ...interface{}) (err error) {
@@ -188,7 +345,7 @@ func WriteAMFs(w io.Writer, a ...interface{}) (err error) {
 
 // 将数据格式成amf对象写入w
 func WriteAMF(w io.Writer, amf interface{}) error {
-	var buff [9]byte
+	var buff [11]byte
 	switch v := amf.(type) {
 	case int:
 		return writeAMFNumber(w, buff[:], float64(v))
@@ -218,14 +375,96 @@ func WriteAMF(w io.Writer, amf interface{}) error {
 		return writeAMFString(w, buff[:], v)
 	case map[string]interface{}:
 		return writeAMFObject(w, buff[:], v)
+	case OrderedObject:
+		buff[0] = amfObject
+		_, err := w.Write(buff[:1])
+		if err != nil {
+			return err
+		}
+		return writeAMFOrderedProperties(w, buff[:], v)
+	case ECMAArray:
+		buff[0] = amfEcmaArray
+		binary.BigEndian.PutUint32(buff[1:], uint32(len(v)))
+		_, err := w.Write(buff[:5])
+		if err != nil {
+			return err
+		}
+		return writeAMFOrderedProperties(w, buff[:], v)
 	case bool:
 		return writeAMFBoolean(w, buff[:], v)
 	case nil:
 		buff[0] = amfNull
 		_, err := w.Write(buff[:1])
 		return err
+	case Undefined:
+		buff[0] = amfUndefined
+		_, err := w.Write(buff[:1])
+		return err
+	case Unsupported:
+		buff[0] = amfUnsupported
+		_, err := w.Write(buff[:1])
+		return err
+	case []interface{}:
+		return writeAMFStrictArray(w, buff[:], v)
+	case time.Time:
+		return writeAMFDate(w, buff[:], v)
+	case XMLDocument:
+		return writeAMFXMLDocument(w, buff[:], v)
+	case *TypedObject:
+		return writeAMFTypedObject(w, buff[:], v)
+	case AVMPlus:
+		return writeAMFAVMPlus(w, buff[:], v.Value)
+	case XML, []byte, []int32, []uint32, *AMF3Array, *AMF3Object, *AMF3VectorObject, *AMF3Dictionary, AMF3Externalizable:
+		// amf0没有的类型，切换到amf3
+		return writeAMFAVMPlus(w, buff[:], v)
+	}
+	return writeAMFValue(w, buff[:], reflect.ValueOf(amf))
+}
+
+// 其他的类型，slice，array，map和指针
+func writeAMFValue(w io.Writer, b []byte, v reflect.Value) error {
+	switch v.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		if v.IsNil() {
+			return WriteAMF(w, nil)
+		}
+		return WriteAMF(w, v.Elem().Interface())
+	case reflect.Slice, reflect.Array:
+		if v.Kind() == reflect.Slice && v.IsNil() {
+			return WriteAMF(w, nil)
+		}
+		a := make([]interface{}, v.Len())
+		for i := range a {
+			a[i] = v.Index(i).Interface()
+		}
+		return writeAMFStrictArray(w, b, a)
+	case reflect.Map:
+		if v.Type().Key().Kind() != reflect.String {
+			break
+		}
+		if v.IsNil() {
+			return WriteAMF(w, nil)
+		}
+		m := make(map[string]interface{}, v.Len())
+		iter := v.MapRange()
+		for iter.Next() {
+			m[iter.Key().String()] = iter.Value().Interface()
+		}
+		return writeAMFObject(w, b, m)
+	case reflect.Bool:
+		return writeAMFBoolean(w, b, v.Bool())
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return writeAMFNumber(w, b, float64(v.Int()))
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return writeAMFNumber(w, b, float64(v.Uint()))
+	case reflect.Float32, reflect.Float64:
+		return writeAMFNumber(w, b, v.Float())
+	case reflect.String:
+		return writeAMFString(w, b, v.String())
+	case reflect.Invalid:
+		return WriteAMF(w, nil)
 	}
-	panic(fmt.Errorf("unsupported data type <%s>", reflect.TypeOf(amf).Kind().String()))
+	return fmt.Errorf("unsupported amf data type <%s>", v.Type().String())
 }
 
 func writeAMFNumber(w io.Writer, b []byte, n float64) error {
@@ -266,6 +505,20 @@ func writeAMFLongString(w io.Writer, b []byte, s string) error {
 	return err
 }
 
+func writeAMFXMLDocument(w io.Writer, b []byte, s XMLDocument) error {
+	b[0] = amfXMLDocument
+	binary.BigEndian.PutUint32(b[1:], uint32(len(s)))
+	_, err := w.Write(b[:5])
+	if err != nil {
+		return err
+	}
+	if len(s) == 0 {
+		return nil
+	}
+	_, err = w.Write(*(*[]byte)(unsafe.Pointer(&s)))
+	return err
+}
+
 func writeAMFBoolean(w io.Writer, b []byte, o bool) error {
 	b[0] = amfBoolean
 	if o {
@@ -277,33 +530,129 @@ func writeAMFBoolean(w io.Writer, b []byte, o bool) error {
 	return err
 }
 
+func writeAMFDate(w io.Writer, b []byte, t time.Time) error {
+	b[0] = amfDate
+	binary.BigEndian.PutUint64(b[1:], math.Float64bits(amfMillisecond(t)))
+	// time zone
+	b[9] = 0
+	b[10] = 0
+	_, err := w.Write(b[:11])
+	return err
+}
+
+func writeAMFStrictArray(w io.Writer, b []byte, a []interface{}) error {
+	b[0] = amfStrictArray
+	binary.BigEndian.PutUint32(b[1:], uint32(len(a)))
+	_, err := w.Write(b[:5])
+	if err != nil {
+		return err
+	}
+	for _, v := range a {
+		err = WriteAMF(w, v)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func writeAMFObject(w io.Writer, b []byte, o map[string]interface{}) (err error) {
 	b[0] = amfObject
 	_, err = w.Write(b[:1])
 	if err != nil {
 		return
 	}
-	for k, v := range o {
+	return writeAMFProperties(w, b, o)
+}
+
+func writeAMFTypedObject(w io.Writer, b []byte, o *TypedObject) (err error) {
+	b[0] = amfTypedObject
+	binary.BigEndian.PutUint16(b[1:], uint16(len(o.ClassName)))
+	_, err = w.Write(b[:3])
+	if err != nil {
+		return
+	}
+	_, err = w.Write([]byte(o.ClassName))
+	if err != nil {
+		return
+	}
+	return writeAMFProperties(w, b, o.Object)
+}
+
+// 按key的顺序写入属性和object end
+func writeAMFProperties(w io.Writer, b []byte, o map[string]interface{}) (err error) {
+	keys := make([]string, 0, len(o))
+	for k := range o {
 		if k == "" {
 			continue
 		}
-		binary.BigEndian.PutUint16(b[:], uint16(len(k)))
-		_, err = w.Write(b[:2])
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		err = writeAMFKey(w, b, k)
 		if err != nil {
-			return err
+			return
 		}
-		_, err = w.Write(*(*[]byte)(unsafe.Pointer(&k)))
+		err = WriteAMF(w, o[k])
 		if err != nil {
-			return err
+			return
 		}
-		err = WriteAMF(w, v)
+	}
+	return writeAMFObjectEnd(w, b)
+}
+
+// 按顺序写入属性和object end
+func writeAMFOrderedProperties(w io.Writer, b []byte, o []AMFProperty) (err error) {
+	for i := range o {
+		if o[i].Name == "" {
+			continue
+		}
+		err = writeAMFKey(w, b, o[i].Name)
+		if err != nil {
+			return
+		}
+		err = WriteAMF(w, o[i].Value)
 		if err != nil {
 			return
 		}
 	}
+	return writeAMFObjectEnd(w, b)
+}
+
+func writeAMFObjectEnd(w io.Writer, b []byte) error {
 	b[0] = 0
 	b[1] = 0
 	b[2] = amfObjectEnd
-	_, err = w.Write(b[:3])
-	return
+	_, err := w.Write(b[:3])
+	return err
+}
+
+func writeAMFKey(w io.Writer, b []byte, k string) (err error) {
+	binary.BigEndian.PutUint16(b[:], uint16(len(k)))
+	_, err = w.Write(b[:2])
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(*(*[]byte)(unsafe.Pointer(&k)))
+	return err
+}
+
+func writeAMFAVMPlus(w io.Writer, b []byte, v interface{}) error {
+	b[0] = amfAVMPlus
+	_, err := w.Write(b[:1])
+	if err != nil {
+		return err
+	}
+	return WriteAMF3(w, v)
+}
+
+// amf的date是从1970开始的毫秒数
+func amfTime(ms float64) time.Time {
+	n := int64(ms)
+	return time.Unix(n/1000, (n%1000)*int64(time.Millisecond))
+}
+
+func amfMillisecond(t time.Time) float64 {
+	return float64(t.Unix()*1000 + int64(t.Nanosecond())/int64(time.Millisecond))
 }
@@ -0,0 +1,1134 @@
+package rtmp
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unsafe"
+)
+
+const (
+	amf3Undefined    = 0x00
+	amf3Null         = 0x01
+	amf3False        = 0x02
+	amf3True         = 0x03
+	amf3Integer      = 0x04
+	amf3Double       = 0x05
+	amf3String       = 0x06
+	amf3XMLDocument  = 0x07
+	amf3Date         = 0x08
+	amf3Array        = 0x09
+	amf3Object       = 0x0a
+	amf3XML          = 0x0b
+	amf3ByteArray    = 0x0c
+	amf3VectorInt    = 0x0d
+	amf3VectorUint   = 0x0e
+	amf3VectorDouble = 0x0f
+	amf3VectorObject = 0x10
+	amf3Dictionary   = 0x11
+)
+
+const (
+	amf3MinInteger = -1 << 28
+	amf3MaxInteger = 1<<28 - 1
+	amf3MaxU29     = 1<<29 - 1
+	// 一个消息的最大长度，任何长度字段都不会超过它
+	amf3MaxLength = MaxChunkSize
+)
+
+var (
+	errAMF3U29         = errors.New("amf3 u29 out of range")
+	errAMF3Length      = errors.New("amf3 length out of range")
+	errAMF3Reference   = errors.New("amf3 invalid reference")
+	amf3Externalizable sync.Map
+)
+
+func init() {
+	RegisterAMF3Externalizable("flex.messaging.io.ArrayCollection", func() AMF3Externalizable {
+		return new(AMF3ArrayCollection)
+	})
+	RegisterAMF3Externalizable("flex.messaging.io.ObjectProxy", func() AMF3Externalizable {
+		return new(AMF3ObjectProxy)
+	})
+}
+
+// amf的undefined
+type Undefined struct{}
+
+// amf0的xml document，amf3的xml document
+type XMLDocument string
+
+// amf3的xml（e4x）
+type XML string
+
+// amf0中使用avmplus-object标记切换到amf3编码
+type AVMPlus struct {
+	Value interface{}
+}
+
+// amf3的array，有关联部分时才会解析成这个类型，否则是[]interface{}
+type AMF3Array struct {
+	Dense       []interface{}
+	Associative map[string]interface{}
+}
+
+// amf3的object的traits
+type AMF3Traits struct {
+	ClassName      string
+	Dynamic        bool
+	Externalizable bool
+	Sealed         []string // 密封成员的名称，按顺序
+}
+
+func (t *AMF3Traits) key() string {
+	var s strings.Builder
+	s.WriteString(t.ClassName)
+	if t.Dynamic {
+		s.WriteByte(1)
+	} else {
+		s.WriteByte(0)
+	}
+	for _, m := range t.Sealed {
+		s.WriteByte(0)
+		s.WriteString(m)
+	}
+	return s.String()
+}
+
+// amf3的有类型的object，匿名的object解析成map[string]interface{}
+type AMF3Object struct {
+	ClassName string
+	Dynamic   bool
+	Sealed    []string               // 密封成员的名称，按顺序
+	Members   map[string]interface{} // 所有的成员，密封和动态的
+}
+
+// amf3的vector.<Object>
+type AMF3VectorObject struct {
+	TypeName string
+	Fixed    bool
+	Items    []interface{}
+}
+
+// amf3的dictionary的一项
+type AMF3DictionaryEntry struct {
+	Key   interface{}
+	Value interface{}
+}
+
+// amf3的dictionary，key可以是任意类型，所以用数组保存
+type AMF3Dictionary struct {
+	WeakKeys bool
+	Entries  []AMF3DictionaryEntry
+}
+
+// amf3的externalizable对象，数据格式由类自己决定
+type AMF3Externalizable interface {
+	AMF3ClassName() string
+	ReadAMF3External(r *AMF3Reader) error
+	WriteAMF3External(w *AMF3Writer) error
+}
+
+// 注册externalizable类，解析时使用newFunc创建对象
+func RegisterAMF3Externalizable(className string, newFunc func() AMF3Externalizable) {
+	amf3Externalizable.Store(className, newFunc)
+}
+
+// flex.messaging.io.ArrayCollection
+type AMF3ArrayCollection struct {
+	Source interface{}
+}
+
+func (a *AMF3ArrayCollection) AMF3ClassName() string {
+	return "flex.messaging.io.ArrayCollection"
+}
+
+func (a *AMF3ArrayCollection) ReadAMF3External(r *AMF3Reader) (err error) {
+	a.Source, err = r.ReadValue()
+	return
+}
+
+func (a *AMF3ArrayCollection) WriteAMF3External(w *AMF3Writer) error {
+	return w.WriteValue(a.Source)
+}
+
+// flex.messaging.io.ObjectProxy
+type AMF3ObjectProxy struct {
+	Source interface{}
+}
+
+func (a *AMF3ObjectProxy) AMF3ClassName() string {
+	return "flex.messaging.io.ObjectProxy"
+}
+
+func (a *AMF3ObjectProxy) ReadAMF3External(r *AMF3Reader) (err error) {
+	a.Source, err = r.ReadValue()
+	return
+}
+
+func (a *AMF3ObjectProxy) WriteAMF3External(w *AMF3Writer) error {
+	return w.WriteValue(a.Source)
+}
+
+// 从r中读取一个amf3对象，引用表只在这次调用中有效
+func ReadAMF3(r io.Reader) (interface{}, error) {
+	return NewAMF3Reader(r).ReadValue()
+}
+
+// 将数据格式成amf3对象写入w，引用表只在这次调用中有效
+func WriteAMF3(w io.Writer, amf interface{}) error {
+	return NewAMF3Writer(w).WriteValue(amf)
+}
+
+// 读取amf3，保存string，object和traits的引用表
+type AMF3Reader struct {
+	r       io.Reader
+	strings []string
+	objects []interface{}
+	traits  []*AMF3Traits
+	buff    [8]byte
+}
+
+func NewAMF3Reader(r io.Reader) *AMF3Reader {
+	return &AMF3Reader{r: r}
+}
+
+// 清空引用表
+func (r *AMF3Reader) Reset(reader io.Reader) {
+	r.r = reader
+	r.strings = r.strings[:0]
+	r.objects = r.objects[:0]
+	r.traits = r.traits[:0]
+}
+
+// externalizable对象读取自定义数据时使用
+func (r *AMF3Reader) Read(b []byte) (int, error) {
+	return r.r.Read(b)
+}
+
+func (r *AMF3Reader) readByte() (byte, error) {
+	_, err := io.ReadFull(r.r, r.buff[:1])
+	return r.buff[0], err
+}
+
+// 读取变长的29位整数
+func (r *AMF3Reader) ReadU29() (uint32, error) {
+	var n uint32
+	for i := 0; i < 3; i++ {
+		b, err := r.readByte()
+		if err != nil {
+			return 0, err
+		}
+		if b&0x80 == 0 {
+			return n<<7 | uint32(b), nil
+		}
+		n = n<<7 | uint32(b&0x7f)
+	}
+	b, err := r.readByte()
+	if err != nil {
+		return 0, err
+	}
+	return n<<8 | uint32(b), nil
+}
+
+// 读取U29，返回值和是否是内联（不是引用）
+func (r *AMF3Reader) readRef() (uint32, bool, error) {
+	n, err := r.ReadU29()
+	if err != nil {
+		return 0, false, err
+	}
+	return n >> 1, n&1 == 1, nil
+}
+
+func (r *AMF3Reader) readLength(n uint32) ([]byte, error) {
+	if n > amf3MaxLength {
+		return nil, errAMF3Length
+	}
+	b := make([]byte, n)
+	_, err := io.ReadFull(r.r, b)
+	return b, err
+}
+
+func (r *AMF3Reader) object(i uint32) (interface{}, error) {
+	if int(i) >= len(r.objects) {
+		return nil, errAMF3Reference
+	}
+	return r.objects[i], nil
+}
+
+// 读取不带类型标记的string
+func (r *AMF3Reader) ReadString() (string, error) {
+	n, inline, err := r.readRef()
+	if err != nil {
+		return "", err
+	}
+	if !inline {
+		if int(n) >= len(r.strings) {
+			return "", errAMF3Reference
+		}
+		return r.strings[n], nil
+	}
+	if n == 0 {
+		return "", nil
+	}
+	b, err := r.readLength(n)
+	if err != nil {
+		return "", err
+	}
+	s := *(*string)(unsafe.Pointer(&b))
+	r.strings = append(r.strings, s)
+	return s, nil
+}
+
+// 读取一个amf3对象
+func (r *AMF3Reader) ReadValue() (interface{}, error) {
+	marker, err := r.readByte()
+	if err != nil {
+		return nil, err
+	}
+	switch marker {
+	case amf3Undefined:
+		return Undefined{}, nil
+	case amf3Null:
+		return nil, nil
+	case amf3False:
+		return false, nil
+	case amf3True:
+		return true, nil
+	case amf3Integer:
+		n, err := r.ReadU29()
+		if err != nil {
+			return nil, err
+		}
+		if n&0x10000000 != 0 {
+			return int32(n) - 0x20000000, nil
+		}
+		return int32(n), nil
+	case amf3Double:
+		return r.readDouble()
+	case amf3String:
+		return r.ReadString()
+	case amf3XMLDocument, amf3XML:
+		return r.readXML(marker)
+	case amf3Date:
+		return r.readDate()
+	case amf3Array:
+		return r.readArray()
+	case amf3Object:
+		return r.readObject()
+	case amf3ByteArray:
+		return r.readByteArray()
+	case amf3VectorInt, amf3VectorUint, amf3VectorDouble, amf3VectorObject:
+		return r.readVector(marker)
+	case amf3Dictionary:
+		return r.readDictionary()
+	default:
+		return nil, fmt.Errorf("unsupported amf3 type <%d>", marker)
+	}
+}
+
+func (r *AMF3Reader) readDouble() (float64, error) {
+	_, err := io.ReadFull(r.r, r.buff[:8])
+	if err != nil {
+		return 0, err
+	}
+	return math.Float64frombits(binary.BigEndian.Uint64(r.buff[:])), nil
+}
+
+func (r *AMF3Reader) readXML(marker byte) (interface{}, error) {
+	n, inline, err := r.readRef()
+	if err != nil {
+		return nil, err
+	}
+	if !inline {
+		return r.object(n)
+	}
+	b, err := r.readLength(n)
+	if err != nil {
+		return nil, err
+	}
+	var x interface{}
+	if marker == amf3XML {
+		x = XML(b)
+	} else {
+		x = XMLDocument(b)
+	}
+	r.objects = append(r.objects, x)
+	return x, nil
+}
+
+func (r *AMF3Reader) readDate() (interface{}, error) {
+	n, inline, err := r.readRef()
+	if err != nil {
+		return nil, err
+	}
+	if !inline {
+		return r.object(n)
+	}
+	ms, err := r.readDouble()
+	if err != nil {
+		return nil, err
+	}
+	t := amfTime(ms)
+	r.objects = append(r.objects, t)
+	return t, nil
+}
+
+func (r *AMF3Reader) readArray() (interface{}, error) {
+	n, inline, err := r.readRef()
+	if err != nil {
+		return nil, err
+	}
+	if !inline {
+		return r.object(n)
+	}
+	if n > amf3MaxLength {
+		return nil, errAMF3Length
+	}
+	key, err := r.ReadString()
+	if err != nil {
+		return nil, err
+	}
+	dense := make([]interface{}, n)
+	var array interface{} = dense
+	if key != "" {
+		// 有关联部分
+		a := &AMF3Array{Dense: dense, Associative: make(map[string]interface{})}
+		r.objects = append(r.objects, a)
+		for key != "" {
+			a.Associative[key], err = r.ReadValue()
+			if err != nil {
+				return nil, err
+			}
+			key, err = r.ReadString()
+			if err != nil {
+				return nil, err
+			}
+		}
+		array = a
+	} else {
+		r.objects = append(r.objects, dense)
+	}
+	for i := range dense {
+		dense[i], err = r.ReadValue()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return array, nil
+}
+
+// n是去掉object引用标记后的值
+func (r *AMF3Reader) readTraits(n uint32) (*AMF3Traits, error) {
+	if n&1 == 0 {
+		// traits引用
+		n >>= 1
+		if int(n) >= len(r.traits) {
+			return nil, errAMF3Reference
+		}
+		return r.traits[n], nil
+	}
+	n >>= 1
+	traits := new(AMF3Traits)
+	var err error
+	traits.ClassName, err = r.ReadString()
+	if err != nil {
+		return nil, err
+	}
+	if n&1 == 1 {
+		traits.Externalizable = true
+	} else {
+		traits.Dynamic = (n>>1)&1 == 1
+		n >>= 2
+		if n > amf3MaxLength {
+			return nil, errAMF3Length
+		}
+		traits.Sealed = make([]string, n)
+		for i := range traits.Sealed {
+			traits.Sealed[i], err = r.ReadString()
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	r.traits = append(r.traits, traits)
+	return traits, nil
+}
+
+func (r *AMF3Reader) readObject() (interface{}, error) {
+	n, inline, err := r.readRef()
+	if err != nil {
+		return nil, err
+	}
+	if !inline {
+		return r.object(n)
+	}
+	traits, err := r.readTraits(n)
+	if err != nil {
+		return nil, err
+	}
+	if traits.Externalizable {
+		v, ok := amf3Externalizable.Load(traits.ClassName)
+		if !ok {
+			return nil, fmt.Errorf("unsupported amf3 externalizable class <%s>", traits.ClassName)
+		}
+		ext := v.(func() AMF3Externalizable)()
+		r.objects = append(r.objects, ext)
+		err = ext.ReadAMF3External(r)
+		if err != nil {
+			return nil, err
+		}
+		return ext, nil
+	}
+	members := make(map[string]interface{})
+	var object interface{} = members
+	if traits.ClassName != "" {
+		object = &AMF3Object{
+			ClassName: traits.ClassName,
+			Dynamic:   traits.Dynamic,
+			Sealed:    traits.Sealed,
+			Members:   members,
+		}
+	}
+	r.objects = append(r.objects, object)
+	for _, name := range traits.Sealed {
+		members[name], err = r.ReadValue()
+		if err != nil {
+			return nil, err
+		}
+	}
+	if traits.Dynamic {
+		for {
+			name, err := r.ReadString()
+			if err != nil {
+				return nil, err
+			}
+			if name == "" {
+				break
+			}
+			members[name], err = r.ReadValue()
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	return object, nil
+}
+
+func (r *AMF3Reader) readByteArray() (interface{}, error) {
+	n, inline, err := r.readRef()
+	if err != nil {
+		return nil, err
+	}
+	if !inline {
+		return r.object(n)
+	}
+	b, err := r.readLength(n)
+	if err != nil {
+		return nil, err
+	}
+	r.objects = append(r.objects, b)
+	return b, nil
+}
+
+func (r *AMF3Reader) readVector(marker byte) (interface{}, error) {
+	n, inline, err := r.readRef()
+	if err != nil {
+		return nil, err
+	}
+	if !inline {
+		return r.object(n)
+	}
+	if n > amf3MaxLength {
+		return nil, errAMF3Length
+	}
+	fixed, err := r.readByte()
+	if err != nil {
+		return nil, err
+	}
+	switch marker {
+	case amf3VectorInt:
+		v := make([]int32, n)
+		r.objects = append(r.objects, v)
+		for i := range v {
+			_, err = io.ReadFull(r.r, r.buff[:4])
+			if err != nil {
+				return nil, err
+			}
+			v[i] = int32(binary.BigEndian.Uint32(r.buff[:]))
+		}
+		return v, nil
+	case amf3VectorUint:
+		v := make([]uint32, n)
+		r.objects = append(r.objects, v)
+		for i := range v {
+			_, err = io.ReadFull(r.r, r.buff[:4])
+			if err != nil {
+				return nil, err
+			}
+			v[i] = binary.BigEndian.Uint32(r.buff[:])
+		}
+		return v, nil
+	case amf3VectorDouble:
+		v := make([]float64, n)
+		r.objects = append(r.objects, v)
+		for i := range v {
+			v[i], err = r.readDouble()
+			if err != nil {
+				return nil, err
+			}
+		}
+		return v, nil
+	default:
+		v := &AMF3VectorObject{Fixed: fixed != 0, Items: make([]interface{}, n)}
+		r.objects = append(r.objects, v)
+		v.TypeName, err = r.ReadString()
+		if err != nil {
+			return nil, err
+		}
+		for i := range v.Items {
+			v.Items[i], err = r.ReadValue()
+			if err != nil {
+				return nil, err
+			}
+		}
+		return v, nil
+	}
+}
+
+func (r *AMF3Reader) readDictionary() (interface{}, error) {
+	n, inline, err := r.readRef()
+	if err != nil {
+		return nil, err
+	}
+	if !inline {
+		return r.object(n)
+	}
+	if n > amf3MaxLength {
+		return nil, errAMF3Length
+	}
+	weak, err := r.readByte()
+	if err != nil {
+		return nil, err
+	}
+	d := &AMF3Dictionary{WeakKeys: weak != 0, Entries: make([]AMF3DictionaryEntry, n)}
+	r.objects = append(r.objects, d)
+	for i := range d.Entries {
+		d.Entries[i].Key, err = r.ReadValue()
+		if err != nil {
+			return nil, err
+		}
+		d.Entries[i].Value, err = r.ReadValue()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return d, nil
+}
+
+// 写amf3，保存string，object和traits的引用表
+type AMF3Writer struct {
+	w           io.Writer
+	strings     map[string]int
+	objects     map[uintptr]int
+	objectCount int
+	traits      map[string]int
+	buff        [9]byte
+}
+
+func NewAMF3Writer(w io.Writer) *AMF3Writer {
+	return &AMF3Writer{
+		w:       w,
+		strings: make(map[string]int),
+		objects: make(map[uintptr]int),
+		traits:  make(map[string]int),
+	}
+}
+
+// 清空引用表
+func (w *AMF3Writer) Reset(writer io.Writer) {
+	w.w = writer
+	w.strings = make(map[string]int)
+	w.objects = make(map[uintptr]int)
+	w.objectCount = 0
+	w.traits = make(map[string]int)
+}
+
+// externalizable对象写入自定义数据时使用
+func (w *AMF3Writer) Write(b []byte) (int, error) {
+	return w.w.Write(b)
+}
+
+func (w *AMF3Writer) writeMarker(marker byte) error {
+	w.buff[0] = marker
+	_, err := w.w.Write(w.buff[:1])
+	return err
+}
+
+// 写入变长的29位整数
+func (w *AMF3Writer) WriteU29(n uint32) error {
+	b := w.buff[:]
+	switch {
+	case n < 0x80:
+		b[0] = byte(n)
+		b = b[:1]
+	case n < 0x4000:
+		b[0] = byte(n>>7) | 0x80
+		b[1] = byte(n) & 0x7f
+		b = b[:2]
+	case n < 0x200000:
+		b[0] = byte(n>>14) | 0x80
+		b[1] = byte(n>>7) | 0x80
+		b[2] = byte(n) & 0x7f
+		b = b[:3]
+	case n <= amf3MaxU29:
+		b[0] = byte(n>>22) | 0x80
+		b[1] = byte(n>>15) | 0x80
+		b[2] = byte(n>>8) | 0x80
+		b[3] = byte(n)
+		b = b[:4]
+	default:
+		return errAMF3U29
+	}
+	_, err := w.w.Write(b)
+	return err
+}
+
+// 写入内联的长度
+func (w *AMF3Writer) writeLength(n int) error {
+	if n > amf3MaxLength {
+		return errAMF3Length
+	}
+	return w.WriteU29(uint32(n)<<1 | 1)
+}
+
+// 写入不带类型标记的string
+func (w *AMF3Writer) WriteString(s string) error {
+	if s == "" {
+		return w.WriteU29(1)
+	}
+	if i, ok := w.strings[s]; ok {
+		return w.WriteU29(uint32(i) << 1)
+	}
+	err := w.writeLength(len(s))
+	if err != nil {
+		return err
+	}
+	w.strings[s] = len(w.strings)
+	_, err = w.w.Write(*(*[]byte)(unsafe.Pointer(&s)))
+	return err
+}
+
+// map和指针可以引用，已经写过的写入引用并返回true。
+// 其他类型只增加计数，保持和读取端的引用表一致。
+func (w *AMF3Writer) writeReference(v interface{}) (bool, error) {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() == reflect.Map || rv.Kind() == reflect.Ptr {
+		p := rv.Pointer()
+		if i, ok := w.objects[p]; ok {
+			return true, w.WriteU29(uint32(i) << 1)
+		}
+		w.objects[p] = w.objectCount
+	}
+	w.objectCount++
+	return false, nil
+}
+
+func (w *AMF3Writer) writeTraits(t *AMF3Traits) error {
+	key := t.key()
+	if t.Externalizable {
+		key += "\x00ext"
+	}
+	if i, ok := w.traits[key]; ok {
+		return w.WriteU29(uint32(i)<<2 | 1)
+	}
+	w.traits[key] = len(w.traits)
+	var err error
+	if t.Externalizable {
+		err = w.WriteU29(0x07)
+	} else {
+		n := uint32(len(t.Sealed))<<4 | 0x03
+		if t.Dynamic {
+			n |= 0x08
+		}
+		err = w.WriteU29(n)
+	}
+	if err != nil {
+		return err
+	}
+	err = w.WriteString(t.ClassName)
+	if err != nil {
+		return err
+	}
+	for _, name := range t.Sealed {
+		err = w.WriteString(name)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 将数据格式成amf3对象写入
+func (w *AMF3Writer) WriteValue(amf interface{}) error {
+	switch v := amf.(type) {
+	case nil:
+		return w.writeMarker(amf3Null)
+	case Undefined:
+		return w.writeMarker(amf3Undefined)
+	case bool:
+		if v {
+			return w.writeMarker(amf3True)
+		}
+		return w.writeMarker(amf3False)
+	case int:
+		return w.writeInteger(int64(v))
+	case int8:
+		return w.writeInteger(int64(v))
+	case int16:
+		return w.writeInteger(int64(v))
+	case int32:
+		return w.writeInteger(int64(v))
+	case int64:
+		return w.writeInteger(v)
+	case uint:
+		return w.writeUnsigned(uint64(v))
+	case uint8:
+		return w.writeUnsigned(uint64(v))
+	case uint16:
+		return w.writeUnsigned(uint64(v))
+	case uint32:
+		return w.writeUnsigned(uint64(v))
+	case uint64:
+		return w.writeUnsigned(v)
+	case float32:
+		return w.writeDouble(float64(v))
+	case float64:
+		return w.writeDouble(v)
+	case string:
+		err := w.writeMarker(amf3String)
+		if err != nil {
+			return err
+		}
+		return w.WriteString(v)
+	case XMLDocument:
+		return w.writeBytes(amf3XMLDocument, v, *(*[]byte)(unsafe.Pointer(&v)))
+	case XML:
+		return w.writeBytes(amf3XML, v, *(*[]byte)(unsafe.Pointer(&v)))
+	case []byte:
+		return w.writeBytes(amf3ByteArray, v, v)
+	case time.Time:
+		return w.writeDate(v)
+	case []interface{}:
+		return w.writeArray(v, v, nil)
+	case *AMF3Array:
+		return w.writeArray(v, v.Dense, v.Associative)
+	case map[string]interface{}:
+		return w.writeObject(v, &AMF3Traits{Dynamic: true}, v)
+	case OrderedObject:
+		return w.writeOrdered(amf3Object, v)
+	case ECMAArray:
+		return w.writeOrdered(amf3Array, v)
+	case *AMF3Object:
+		return w.writeObject(v, &AMF3Traits{
+			ClassName: v.ClassName,
+			Dynamic:   v.Dynamic,
+			Sealed:    v.Sealed,
+		}, v.Members)
+	case AMF3Externalizable:
+		return w.writeExternalizable(v)
+	case []int32, []uint32, []float64, *AMF3VectorObject:
+		return w.writeVector(v)
+	case *AMF3Dictionary:
+		return w.writeDictionary(v)
+	}
+	return fmt.Errorf("unsupported amf3 data type <%s>", reflect.TypeOf(amf).String())
+}
+
+func (w *AMF3Writer) writeInteger(n int64) error {
+	if n < amf3MinInteger || n > amf3MaxInteger {
+		return w.writeDouble(float64(n))
+	}
+	err := w.writeMarker(amf3Integer)
+	if err != nil {
+		return err
+	}
+	return w.WriteU29(uint32(n) & amf3MaxU29)
+}
+
+func (w *AMF3Writer) writeUnsigned(n uint64) error {
+	if n > amf3MaxInteger {
+		return w.writeDouble(float64(n))
+	}
+	return w.writeInteger(int64(n))
+}
+
+func (w *AMF3Writer) writeDouble(n float64) error {
+	w.buff[0] = amf3Double
+	binary.BigEndian.PutUint64(w.buff[1:], math.Float64bits(n))
+	_, err := w.w.Write(w.buff[:9])
+	return err
+}
+
+// xml document，xml和byte array
+func (w *AMF3Writer) writeBytes(marker byte, v interface{}, b []byte) error {
+	err := w.writeMarker(marker)
+	if err != nil {
+		return err
+	}
+	ok, err := w.writeReference(v)
+	if ok || err != nil {
+		return err
+	}
+	err = w.writeLength(len(b))
+	if err != nil {
+		return err
+	}
+	_, err = w.w.Write(b)
+	return err
+}
+
+func (w *AMF3Writer) writeDate(t time.Time) error {
+	err := w.writeMarker(amf3Date)
+	if err != nil {
+		return err
+	}
+	w.objectCount++
+	err = w.WriteU29(1)
+	if err != nil {
+		return err
+	}
+	binary.BigEndian.PutUint64(w.buff[:], math.Float64bits(amfMillisecond(t)))
+	_, err = w.w.Write(w.buff[:8])
+	return err
+}
+
+func (w *AMF3Writer) writeArray(v interface{}, dense []interface{}, associative map[string]interface{}) error {
+	err := w.writeMarker(amf3Array)
+	if err != nil {
+		return err
+	}
+	ok, err := w.writeReference(v)
+	if ok || err != nil {
+		return err
+	}
+	err = w.writeLength(len(dense))
+	if err != nil {
+		return err
+	}
+	err = w.writeMembers(associative, nil)
+	if err != nil {
+		return err
+	}
+	for _, item := range dense {
+		err = w.WriteValue(item)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 按key的顺序写入members中不在sealed中的成员，然后写入结束标记
+func (w *AMF3Writer) writeMembers(members map[string]interface{}, sealed []string) error {
+	keys := make([]string, 0, len(members))
+	for k := range members {
+		if k != "" && !stringsContains(sealed, k) {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		err := w.WriteString(k)
+		if err != nil {
+			return err
+		}
+		err = w.WriteValue(members[k])
+		if err != nil {
+			return err
+		}
+	}
+	return w.WriteString("")
+}
+
+func stringsContains(a []string, s string) bool {
+	for i := range a {
+		if a[i] == s {
+			return true
+		}
+	}
+	return false
+}
+
+func (w *AMF3Writer) writeObject(v interface{}, traits *AMF3Traits, members map[string]interface{}) error {
+	err := w.writeMarker(amf3Object)
+	if err != nil {
+		return err
+	}
+	ok, err := w.writeReference(v)
+	if ok || err != nil {
+		return err
+	}
+	err = w.writeTraits(traits)
+	if err != nil {
+		return err
+	}
+	for _, name := range traits.Sealed {
+		err = w.WriteValue(members[name])
+		if err != nil {
+			return err
+		}
+	}
+	if traits.Dynamic {
+		return w.writeMembers(members, traits.Sealed)
+	}
+	return nil
+}
+
+// 匿名的动态object，或者只有关联部分的array，按顺序写入属性
+func (w *AMF3Writer) writeOrdered(marker byte, o []AMFProperty) error {
+	err := w.writeMarker(marker)
+	if err != nil {
+		return err
+	}
+	w.objectCount++
+	if marker == amf3Object {
+		err = w.writeTraits(&AMF3Traits{Dynamic: true})
+	} else {
+		err = w.writeLength(0)
+	}
+	if err != nil {
+		return err
+	}
+	for i := range o {
+		if o[i].Name == "" {
+			continue
+		}
+		err = w.WriteString(o[i].Name)
+		if err != nil {
+			return err
+		}
+		err = w.WriteValue(o[i].Value)
+		if err != nil {
+			return err
+		}
+	}
+	return w.WriteString("")
+}
+
+func (w *AMF3Writer) writeExternalizable(v AMF3Externalizable) error {
+	err := w.writeMarker(amf3Object)
+	if err != nil {
+		return err
+	}
+	ok, err := w.writeReference(v)
+	if ok || err != nil {
+		return err
+	}
+	err = w.writeTraits(&AMF3Traits{ClassName: v.AMF3ClassName(), Externalizable: true})
+	if err != nil {
+		return err
+	}
+	return v.WriteAMF3External(w)
+}
+
+func (w *AMF3Writer) writeVector(v interface{}) error {
+	var marker byte
+	var n int
+	switch vv := v.(type) {
+	case []int32:
+		marker, n = amf3VectorInt, len(vv)
+	case []uint32:
+		marker, n = amf3VectorUint, len(vv)
+	case []float64:
+		marker, n = amf3VectorDouble, len(vv)
+	case *AMF3VectorObject:
+		marker, n = amf3VectorObject, len(vv.Items)
+	}
+	err := w.writeMarker(marker)
+	if err != nil {
+		return err
+	}
+	ok, err := w.writeReference(v)
+	if ok || err != nil {
+		return err
+	}
+	err = w.writeLength(n)
+	if err != nil {
+		return err
+	}
+	switch vv := v.(type) {
+	case []int32:
+		err = w.writeMarker(0)
+		for i := 0; err == nil && i < len(vv); i++ {
+			binary.BigEndian.PutUint32(w.buff[:], uint32(vv[i]))
+			_, err = w.w.Write(w.buff[:4])
+		}
+	case []uint32:
+		err = w.writeMarker(0)
+		for i := 0; err == nil && i < len(vv); i++ {
+			binary.BigEndian.PutUint32(w.buff[:], vv[i])
+			_, err = w.w.Write(w.buff[:4])
+		}
+	case []float64:
+		err = w.writeMarker(0)
+		for i := 0; err == nil && i < len(vv); i++ {
+			binary.BigEndian.PutUint64(w.buff[:], math.Float64bits(vv[i]))
+			_, err = w.w.Write(w.buff[:8])
+		}
+	case *AMF3VectorObject:
+		if vv.Fixed {
+			err = w.writeMarker(1)
+		} else {
+			err = w.writeMarker(0)
+		}
+		if err == nil {
+			err = w.WriteString(vv.TypeName)
+		}
+		for i := 0; err == nil && i < len(vv.Items); i++ {
+			err = w.WriteValue(vv.Items[i])
+		}
+	}
+	return err
+}
+
+func (w *AMF3Writer) writeDictionary(v *AMF3Dictionary) error {
+	err := w.writeMarker(amf3Dictionary)
+	if err != nil {
+		return err
+	}
+	ok, err := w.writeReference(v)
+	if ok || err != nil {
+		return err
+	}
+	err = w.writeLength(len(v.Entries))
+	if err != nil {
+		return err
+	}
+	if v.WeakKeys {
+		err = w.writeMarker(1)
+	} else {
+		err = w.writeMarker(0)
+	}
+	if err != nil {
+		return err
+	}
+	for _, e := range v.Entries {
+		err = w.WriteValue(e.Key)
+		if err != nil {
+			return err
+		}
+		err = w.WriteValue(e.Value)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
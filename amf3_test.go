@@ -0,0 +1,143 @@
+package rtmp
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestAMF3U29(t *testing.T) {
+	var b bytes.Buffer
+	w := NewAMF3Writer(&b)
+	r := NewAMF3Reader(&b)
+	for _, n := range []uint32{0, 0x7f, 0x80, 0x3fff, 0x4000, 0x1fffff, 0x200000, amf3MaxU29} {
+		err := w.WriteU29(n)
+		if err != nil {
+			t.Fatal(err)
+		}
+		m, err := r.ReadU29()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if m != n {
+			t.Fatalf("u29 <%d> != <%d>", m, n)
+		}
+	}
+	if w.WriteU29(amf3MaxU29+1) != errAMF3U29 {
+		t.FailNow()
+	}
+}
+
+func TestAMF3(t *testing.T) {
+	now := time.Unix(time.Now().Unix(), 0)
+	object := &AMF3Object{
+		ClassName: "Point",
+		Dynamic:   true,
+		Sealed:    []string{"x", "y"},
+		Members:   map[string]interface{}{"x": int32(1), "y": int32(-2), "z": "dynamic"},
+	}
+	values := []interface{}{
+		Undefined{},
+		nil,
+		true,
+		false,
+		int32(amf3MinInteger),
+		int32(amf3MaxInteger),
+		float64(amf3MaxInteger + 1),
+		1.5,
+		"",
+		"connect",
+		XMLDocument("<a/>"),
+		XML("<b/>"),
+		now,
+		[]interface{}{"a", int32(1), nil},
+		&AMF3Array{Dense: []interface{}{"a"}, Associative: map[string]interface{}{"k": "v"}},
+		map[string]interface{}{"app": "live", "objectEncoding": int32(3)},
+		object,
+		[]byte{1, 2, 3},
+		[]int32{-1, 2},
+		[]uint32{1, 2},
+		[]float64{1.5, 2.5},
+		&AMF3VectorObject{TypeName: "Point", Items: []interface{}{object, object}},
+		&AMF3Dictionary{Entries: []AMF3DictionaryEntry{{Key: int32(1), Value: "one"}}},
+		&AMF3ArrayCollection{Source: []interface{}{"a", "b"}},
+	}
+	var b bytes.Buffer
+	w := NewAMF3Writer(&b)
+	for _, v := range values {
+		err := w.WriteValue(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	r := NewAMF3Reader(&b)
+	for _, v := range values {
+		a, err := r.ReadValue()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tm, ok := v.(time.Time); ok {
+			if !tm.Equal(a.(time.Time)) {
+				t.Fatalf("%v != %v", a, v)
+			}
+			continue
+		}
+		if !reflect.DeepEqual(a, v) {
+			t.Fatalf("%#v != %#v", a, v)
+		}
+	}
+	if b.Len() != 0 {
+		t.FailNow()
+	}
+}
+
+func TestAMF3Reference(t *testing.T) {
+	o := map[string]interface{}{"a": "a"}
+	var b bytes.Buffer
+	err := WriteAMF3(&b, []interface{}{o, o, "a", "a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 0x09 0x09 0x01, 0x0a 0x0b 0x01 0x03 0x61 0x06 0x00 0x01, 0x0a 0x02, 0x06 0x00, 0x06 0x00
+	if b.Len() != 3+8+2+2+2 {
+		t.Fatalf("length <%d>", b.Len())
+	}
+	amf, err := ReadAMF3(&b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := amf.([]interface{})
+	if reflect.ValueOf(a[0]).Pointer() != reflect.ValueOf(a[1]).Pointer() {
+		t.FailNow()
+	}
+}
+
+func TestAMFAVMPlus(t *testing.T) {
+	var b bytes.Buffer
+	err := WriteAMFs(&b, "connect", AVMPlus{Value: map[string]interface{}{"a": int32(1)}}, []byte{1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	amf, err := ReadAMF(&b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if amf != "connect" {
+		t.FailNow()
+	}
+	amf, err = ReadAMF(&b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(amf, map[string]interface{}{"a": int32(1)}) {
+		t.FailNow()
+	}
+	amf, err = ReadAMF(&b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(amf, []byte{1}) {
+		t.FailNow()
+	}
+}
@@ -2,7 +2,10 @@ package rtmp
 
 import (
 	"bytes"
+	"reflect"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestAMF(t *testing.T) {
@@ -83,3 +86,126 @@ func TestAMF(t *testing.T) {
 		t.FailNow()
 	}
 }
+
+func TestAMFTypes(t *testing.T) {
+	now := time.Unix(time.Now().Unix(), 0)
+	values := []interface{}{
+		Undefined{},
+		Unsupported{},
+		XMLDocument("<a/>"),
+		now,
+		[]interface{}{"a", 1.0, nil, []interface{}{true}},
+		&TypedObject{ClassName: "Point", Object: map[string]interface{}{"x": 1.0}},
+		strings.Repeat("a", 0x10000),
+	}
+	var b bytes.Buffer
+	err := WriteAMFs(&b, values...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, v := range values {
+		amf, err := ReadAMF(&b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tm, ok := v.(time.Time); ok {
+			if !tm.Equal(amf.(time.Time)) {
+				t.Fatalf("%v != %v", amf, v)
+			}
+			continue
+		}
+		if !reflect.DeepEqual(amf, v) {
+			t.Fatalf("%#v != %#v", amf, v)
+		}
+	}
+	// reflect
+	b.Reset()
+	err = WriteAMFs(&b, []string{"a"}, map[string]int{"a": 1}, (*int)(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, v := range []interface{}{
+		[]interface{}{"a"},
+		map[string]interface{}{"a": 1.0},
+		nil,
+	} {
+		amf, err := ReadAMF(&b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(amf, v) {
+			t.Fatalf("%#v != %#v", amf, v)
+		}
+	}
+	// unsupported
+	if WriteAMF(&b, make(chan int)) == nil {
+		t.FailNow()
+	}
+}
+
+func TestAMFReference(t *testing.T) {
+	b := bytes.NewBuffer([]byte{
+		amfStrictArray, 0, 0, 0, 2,
+		amfObject, 0, 1, 'a', amfBoolean, 1, 0, 0, amfObjectEnd,
+		amfReference, 0, 1,
+	})
+	amf, err := ReadAMF(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := amf.([]interface{})
+	if reflect.ValueOf(a[0]).Pointer() != reflect.ValueOf(a[1]).Pointer() {
+		t.FailNow()
+	}
+}
+
+func TestAMFOrdered(t *testing.T) {
+	var b bytes.Buffer
+	err := WriteAMFs(&b, ECMAArray{
+		{Name: "duration", Value: 0},
+		{Name: "width", Value: 1280},
+	}, OrderedObject{
+		{Name: "b", Value: true},
+		{Name: "a", Value: nil},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b.Bytes(), []byte{
+		amfEcmaArray, 0, 0, 0, 2,
+		0, 8, 'd', 'u', 'r', 'a', 't', 'i', 'o', 'n', amfNumber, 0, 0, 0, 0, 0, 0, 0, 0,
+		0, 5, 'w', 'i', 'd', 't', 'h', amfNumber, 0x40, 0x94, 0, 0, 0, 0, 0, 0,
+		0, 0, amfObjectEnd,
+		amfObject,
+		0, 1, 'b', amfBoolean, 1,
+		0, 1, 'a', amfNull,
+		0, 0, amfObjectEnd,
+	}) {
+		t.Fatalf("%v", b.Bytes())
+	}
+	amf, err := ReadOrderedAMF(&b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(amf, ECMAArray{{Name: "duration", Value: 0.0}, {Name: "width", Value: 1280.0}}) {
+		t.Fatalf("%#v", amf)
+	}
+	amf, err = ReadOrderedAMF(&b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	o := amf.(OrderedObject)
+	if len(o) != 2 || o[0].Name != "b" || o[1].Name != "a" {
+		t.Fatalf("%#v", amf)
+	}
+	o.Set("c", "c")
+	if v, ok := o.Get("c"); !ok || v != "c" || len(o) != 3 {
+		t.FailNow()
+	}
+	// map按key的顺序
+	b1, _ := MarshalAMF0(map[string]interface{}{"b": 1, "a": 2, "c": 3})
+	b2, _ := MarshalAMF0(OrderedObject{{Name: "a", Value: 2}, {Name: "b", Value: 1}, {Name: "c", Value: 3}})
+	if !bytes.Equal(b1, b2) {
+		t.FailNow()
+	}
+}
@@ -0,0 +1,118 @@
+package rtmp
+
+import (
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+const (
+	AuthModAdobe = "adobe"
+	AuthModLLNW  = "llnw"
+	// llnw验证使用的固定值
+	llnwRealm  = "live"
+	llnwMethod = "publish"
+	llnwQop    = "auth"
+	llnwNC     = "00000001"
+)
+
+// adobe验证的response，
+// base64(md5(base64(md5(user+salt+password))+opaque或者challenge+challenge2))
+func AdobeAuthResponse(user, password, salt, opaque, challenge, challenge2 string) string {
+	h := md5.Sum([]byte(user + salt + password))
+	s := base64.StdEncoding.EncodeToString(h[:])
+	if opaque != "" {
+		s += opaque
+	} else {
+		s += challenge
+	}
+	h = md5.Sum([]byte(s + challenge2))
+	return base64.StdEncoding.EncodeToString(h[:])
+}
+
+// llnw验证的response，和http的digest验证一样，realm是live，method是publish，
+// uri是/app，app没有/的时候加上/_definst_
+func LLNWAuthResponse(user, password, app, nonce, cnonce string) string {
+	ha1 := md5Hex(user + ":" + llnwRealm + ":" + password)
+	uri := "/" + app
+	if !strings.Contains(app, "/") {
+		uri += "/_definst_"
+	}
+	ha2 := md5Hex(llnwMethod + ":" + uri)
+	return md5Hex(ha1 + ":" + nonce + ":" + llnwNC + ":" + cnonce + ":" + llnwQop + ":" + ha2)
+}
+
+func md5Hex(s string) string {
+	h := md5.Sum([]byte(s))
+	return hex.EncodeToString(h[:])
+}
+
+// 随机的8个十六进制字符
+func authNonce() string {
+	var b [4]byte
+	rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
+// 解析验证的参数，不做url解码，因为base64中的+会被解码成空格，
+// s是"?a=1&b=2"或者"a=1&b=2"
+func ParseAuthParams(s string) map[string]string {
+	params := make(map[string]string)
+	for _, kv := range strings.FieldsFunc(s, func(r rune) bool { return r == '?' || r == '&' }) {
+		i := strings.IndexByte(kv, '=')
+		if i < 0 {
+			params[kv] = ""
+			continue
+		}
+		params[kv[:i]] = kv[i+1:]
+	}
+	return params
+}
+
+// 根据connect的_error的description，生成下一次connect的app和tcUrl需要加上的参数，
+// 返回错误表示不能继续验证
+func nextAuthParams(description, authParams, user, password, app string) (string, error) {
+	if strings.Contains(description, "?reason=authfailed") {
+		return "", fmt.Errorf("authentication failed")
+	}
+	if strings.Contains(description, "?reason=nosuchuser") {
+		return "", fmt.Errorf("no such user <%s>", user)
+	}
+	if strings.Contains(authParams, "response=") {
+		// 已经验证过了
+		return "", fmt.Errorf("authentication failed <%s>", description)
+	}
+	if user == "" {
+		return "", fmt.Errorf("authentication required <%s>", description)
+	}
+	if strings.Contains(description, "code=403 need auth") {
+		authMod := AuthModAdobe
+		if strings.Contains(description, "authmod="+AuthModLLNW) {
+			authMod = AuthModLLNW
+		}
+		return "?authmod=" + authMod + "&user=" + user, nil
+	}
+	i := strings.Index(description, "?reason=needauth")
+	if i < 0 {
+		return "", fmt.Errorf("connect rejected <%s>", description)
+	}
+	params := ParseAuthParams(description[i:])
+	if strings.Contains(description, "authmod="+AuthModLLNW) {
+		nonce := params["nonce"]
+		cnonce := authNonce()
+		return fmt.Sprintf("?authmod=%s&user=%s&nonce=%s&cn=%s&nc=%s&response=%s",
+			AuthModLLNW, user, nonce, cnonce, llnwNC,
+			LLNWAuthResponse(user, password, app, nonce, cnonce)), nil
+	}
+	challenge2 := authNonce()
+	s := fmt.Sprintf("?authmod=%s&user=%s&challenge=%s&response=%s",
+		AuthModAdobe, user, challenge2,
+		AdobeAuthResponse(user, password, params["salt"], params["opaque"], params["challenge"], challenge2))
+	if opaque := params["opaque"]; opaque != "" {
+		s += "&opaque=" + opaque
+	}
+	return s, nil
+}
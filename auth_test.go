@@ -0,0 +1,59 @@
+package rtmp
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestAuthResponse(t *testing.T) {
+	// 和ffmpeg的do_adobe_auth，do_llnw_auth计算的一样
+	if s := AdobeAuthResponse("user", "pass", "salt", "opaque", "challenge", "00000001"); s != "drftN1w9uDADhofo8GXj7Q==" {
+		t.Fatal(s)
+	}
+	if s := AdobeAuthResponse("user", "pass", "salt", "", "challenge", "00000001"); s != "/BZenHpkZFX/7QRMk7debQ==" {
+		t.Fatal(s)
+	}
+	if s := LLNWAuthResponse("user", "pass", "live", "nonce", "00000001"); s != "b055864fe284d2196615b4aa129fe243" {
+		t.Fatal(s)
+	}
+}
+
+func TestAuthParams(t *testing.T) {
+	params := ParseAuthParams("live?authmod=adobe&user=a&response=a+b/c==")
+	if params["authmod"] != "adobe" || params["response"] != "a+b/c==" {
+		t.Fatal(params)
+	}
+	// 第一次
+	s, err := nextAuthParams("[ AccessManager.Reject ] : [ code=403 need auth; authmod=llnw ] : ", "", "user", "pass", "live")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s != "?authmod=llnw&user=user" {
+		t.Fatal(s)
+	}
+	// challenge
+	s, err = nextAuthParams("[ AccessManager.Reject ] : [ authmod=adobe ] : ?reason=needauth&user=user&salt=s&challenge=c&opaque=o", s, "user", "pass", "live")
+	if err != nil {
+		t.Fatal(err)
+	}
+	params = ParseAuthParams(s)
+	if params["authmod"] != "adobe" || params["opaque"] != "o" ||
+		params["response"] != AdobeAuthResponse("user", "pass", "s", "o", "c", params["challenge"]) {
+		t.Fatal(s)
+	}
+	// 失败
+	for _, desc := range []string{
+		"[ AccessManager.Reject ] : [ authmod=adobe ] : ?reason=authfailed&opaque=o",
+		"[ AccessManager.Reject ] : [ authmod=adobe ] : ?reason=nosuchuser",
+		"[ AccessManager.Reject ] : [ authmod=adobe ] : ?reason=needauth&user=user&salt=s",
+	} {
+		_, err = nextAuthParams(desc, s, "user", "pass", "live")
+		if err == nil {
+			t.Fatal(desc)
+		}
+	}
+	_, err = nextAuthParams("[ AccessManager.Reject ] : [ code=403 need auth; authmod=adobe ] : ", "", "", "", "live")
+	if err == nil || !strings.Contains(err.Error(), "authentication required") {
+		t.Fatal(err)
+	}
+}
@@ -1,8 +1,12 @@
 package rtmp
 
 import (
+	"bytes"
 	"encoding/binary"
+	"errors"
+	"fmt"
 	"io"
+	"sync"
 )
 
 const (
@@ -213,3 +217,364 @@ func (c *ChunkHeader) Write(w io.Writer) (err error) {
 	}
 	return
 }
+
+var (
+	errChunkStreamHeader = errors.New("chunk stream has no previous header")
+)
+
+// 读取时，每个chunk stream的状态
+type chunkReadStream struct {
+	init      bool     // 是否已经收到过header
+	extended  bool     // 上一个header是否有extended timestamp
+	timestamp uint32   // 上一个消息的时间戳
+	delta     uint32   // 上一个header的时间戳增量
+	length    uint32   // 上一个header的消息长度
+	typeID    uint8    // 上一个header的消息类型
+	streamID  uint32   // 上一个header的消息流
+	message   *Message // 没读完的消息
+}
+
+// 统计读取的字节数
+type countReader struct {
+	r io.Reader
+	n uint32
+}
+
+func (r *countReader) Read(b []byte) (int, error) {
+	n, err := r.r.Read(b)
+	r.n += uint32(n)
+	return n, err
+}
+
+// 从chunk中组合出完整的消息，每个chunk stream单独保存header的状态。
+// 读到SetChunkSize和Abort消息时会自动应用，然后照常返回。
+type ChunkReader struct {
+	r         countReader
+	chunkSize uint32
+	streams   map[uint32]*chunkReadStream
+	header    ChunkHeader
+}
+
+func NewChunkReader(r io.Reader) *ChunkReader {
+	return &ChunkReader{
+		r:         countReader{r: r},
+		chunkSize: ChunkSize,
+		streams:   make(map[uint32]*chunkReadStream),
+	}
+}
+
+// 返回读取的字节数，用于acknowledgement
+func (r *ChunkReader) BytesRead() uint32 {
+	return r.r.n
+}
+
+func (r *ChunkReader) ChunkSize() uint32 {
+	return r.chunkSize
+}
+
+func (r *ChunkReader) SetChunkSize(n uint32) {
+	if n > MaxChunkSize {
+		n = MaxChunkSize
+	}
+	if n < 1 {
+		n = 1
+	}
+	r.chunkSize = n
+}
+
+// 丢弃chunk stream没读完的消息
+func (r *ChunkReader) Abort(csid uint32) {
+	s, ok := r.streams[csid]
+	if ok && s.message != nil {
+		PutMessage(s.message)
+		s.message = nil
+	}
+}
+
+// 回收所有没读完的消息
+func (r *ChunkReader) Reset() {
+	for csid := range r.streams {
+		r.Abort(csid)
+	}
+	r.streams = make(map[uint32]*chunkReadStream)
+}
+
+func (r *ChunkReader) readTimestamp(s *chunkReadStream) (uint32, error) {
+	s.extended = r.header.MessageTimestamp >= MaxMessageTimestamp
+	if !s.extended {
+		return r.header.MessageTimestamp, nil
+	}
+	err := r.header.ReadExtendedTimestamp(&r.r)
+	return r.header.ExtendedTimestamp, err
+}
+
+// 读取一个完整的消息，使用完后可以调用PutMessage回收
+func (r *ChunkReader) ReadMessage() (*Message, error) {
+	for {
+		err := r.header.ReadBaisc(&r.r)
+		if err != nil {
+			return nil, err
+		}
+		s, ok := r.streams[r.header.CSID]
+		if !ok {
+			s = new(chunkReadStream)
+			r.streams[r.header.CSID] = s
+		}
+		if r.header.FMT != ChunkFmt0 && !s.init {
+			return nil, errChunkStreamHeader
+		}
+		if r.header.FMT != ChunkFmt3 && s.message != nil {
+			return nil, fmt.Errorf("chunk stream <%d> message incomplete", r.header.CSID)
+		}
+		err = r.header.ReadMessage(&r.r)
+		if err != nil {
+			return nil, err
+		}
+		switch r.header.FMT {
+		case ChunkFmt0:
+			s.timestamp, err = r.readTimestamp(s)
+			if err != nil {
+				return nil, err
+			}
+			// fmt3紧跟fmt0时，增量就是fmt0的时间戳
+			s.delta = s.timestamp
+			s.length = r.header.MessageLength
+			s.typeID = r.header.MessageTypeID
+			s.streamID = r.header.MessageStreamID
+			s.init = true
+		case ChunkFmt1:
+			s.delta, err = r.readTimestamp(s)
+			if err != nil {
+				return nil, err
+			}
+			s.timestamp += s.delta
+			s.length = r.header.MessageLength
+			s.typeID = r.header.MessageTypeID
+		case ChunkFmt2:
+			s.delta, err = r.readTimestamp(s)
+			if err != nil {
+				return nil, err
+			}
+			s.timestamp += s.delta
+		default:
+			// 上一个header有extended timestamp，fmt3也有
+			if s.extended {
+				err = r.header.ReadExtendedTimestamp(&r.r)
+				if err != nil {
+					return nil, err
+				}
+			}
+			// 新的消息，时间戳加上增量
+			if s.message == nil {
+				s.timestamp += s.delta
+			}
+		}
+		msg := s.message
+		if msg == nil {
+			msg = GetMessage()
+			msg.CSID = r.header.CSID
+			msg.TypeID = s.typeID
+			msg.Timestamp = s.timestamp
+			msg.StreamID = s.streamID
+			msg.Length = s.length
+			s.message = msg
+		}
+		// chunk data
+		n := msg.Length - uint32(msg.Data.Len())
+		if n > r.chunkSize {
+			n = r.chunkSize
+		}
+		_, err = io.CopyN(&msg.Data, &r.r, int64(n))
+		if err != nil {
+			return nil, err
+		}
+		if uint32(msg.Data.Len()) < msg.Length {
+			continue
+		}
+		// 读完整个消息了
+		s.message = nil
+		r.handleControlMessage(msg)
+		return msg, nil
+	}
+}
+
+// 应用SetChunkSize和Abort
+func (r *ChunkReader) handleControlMessage(msg *Message) {
+	if msg.StreamID != ControlMessageStreamID {
+		return
+	}
+	switch msg.TypeID {
+	case ControlMessageSetChunkSize:
+		var m SetChunkSize
+		if m.Decode(msg) == nil {
+			r.SetChunkSize(m.ChunkSize)
+		}
+	case ControlMessageAbort:
+		var m Abort
+		if m.Decode(msg) == nil {
+			r.Abort(m.CSID)
+		}
+	}
+}
+
+// 写入时，每个chunk stream的状态
+type chunkWriteStream struct {
+	init      bool   // 是否已经发送过header
+	fmt0      bool   // 上一个header是否fmt0
+	timestamp uint32 // 上一个消息的时间戳
+	delta     uint32 // 上一个header的时间戳增量
+	length    uint32 // 上一个header的消息长度
+	typeID    uint8  // 上一个header的消息类型
+	streamID  uint32 // 上一个header的消息流
+}
+
+// 将消息分成chunk写入，每个chunk stream单独保存header的状态，
+// 自动选择最小的fmt。写入SetChunkSize消息后，之后的消息使用新的chunk size。
+type ChunkWriter struct {
+	w         io.Writer
+	lock      sync.Mutex
+	chunkSize uint32
+	streams   map[uint32]*chunkWriteStream
+	header    ChunkHeader
+	buff      bytes.Buffer
+}
+
+func NewChunkWriter(w io.Writer) *ChunkWriter {
+	return &ChunkWriter{
+		w:         w,
+		chunkSize: ChunkSize,
+		streams:   make(map[uint32]*chunkWriteStream),
+	}
+}
+
+func (w *ChunkWriter) ChunkSize() uint32 {
+	w.lock.Lock()
+	n := w.chunkSize
+	w.lock.Unlock()
+	return n
+}
+
+// 发送SetChunkSize消息，然后使用新的chunk size
+func (w *ChunkWriter) SetChunkSize(n uint32) error {
+	if n > MaxChunkSize {
+		n = MaxChunkSize
+	}
+	msg := GetMessage()
+	(&SetChunkSize{ChunkSize: n}).Encode(msg)
+	err := w.WriteMessage(msg)
+	PutMessage(msg)
+	return err
+}
+
+// 写入一个消息，msg.CSID是0则使用消息类型默认的chunk stream
+func (w *ChunkWriter) WriteMessage(msg *Message) error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	w.buff.Reset()
+	data := msg.payload()
+	w.messageHeader(msg)
+	for {
+		err := w.header.Write(&w.buff)
+		if err != nil {
+			return err
+		}
+		n := uint32(len(data))
+		if n > w.chunkSize {
+			n = w.chunkSize
+		}
+		w.buff.Write(data[:n])
+		data = data[n:]
+		if len(data) < 1 {
+			break
+		}
+		w.header.FMT = ChunkFmt3
+	}
+	_, err := w.w.Write(w.buff.Bytes())
+	if err != nil {
+		return err
+	}
+	w.applyChunkSize(msg)
+	return nil
+}
+
+// SetChunkSize消息写入后生效
+func (w *ChunkWriter) applyChunkSize(msg *Message) {
+	if msg.TypeID != ControlMessageSetChunkSize {
+		return
+	}
+	var m SetChunkSize
+	if m.Decode(msg) == nil {
+		w.chunkSize = m.ChunkSize
+		if w.chunkSize > MaxChunkSize {
+			w.chunkSize = MaxChunkSize
+		}
+		if w.chunkSize < 1 {
+			w.chunkSize = 1
+		}
+	}
+}
+
+// 消息类型默认的chunk stream
+func messageChunkStreamID(msg *Message) uint32 {
+	if msg.CSID > 1 {
+		return msg.CSID
+	}
+	switch msg.TypeID {
+	case AudioMessage:
+		return AudioMessageChunkStreamID
+	case VideoMessage:
+		return VideoMessageChunkStreamID
+	case DataMessageAMF0, DataMessageAMF3:
+		return DataMessageChunkStreamID
+	case CommandMessageAMF0, CommandMessageAMF3:
+		return CommandMessageChunkStreamID
+	default:
+		return ControlMessageChunkStreamID
+	}
+}
+
+// 计算消息第一个chunk的header，保存在w.header，然后更新chunk stream的状态
+func (w *ChunkWriter) messageHeader(msg *Message) {
+	csid := messageChunkStreamID(msg)
+	s, ok := w.streams[csid]
+	if !ok {
+		s = new(chunkWriteStream)
+		w.streams[csid] = s
+	}
+	length := uint32(len(msg.payload()))
+	w.header.CSID = csid
+	w.header.MessageLength = length
+	w.header.MessageTypeID = msg.TypeID
+	w.header.MessageStreamID = msg.StreamID
+	var timestamp uint32
+	if !s.init || s.streamID != msg.StreamID || msg.Timestamp < s.timestamp {
+		// 时间戳是绝对值
+		w.header.FMT = ChunkFmt0
+		timestamp = msg.Timestamp
+		s.delta = timestamp
+	} else {
+		timestamp = msg.Timestamp - s.timestamp
+		if s.length != length || s.typeID != msg.TypeID {
+			w.header.FMT = ChunkFmt1
+		} else if s.delta != timestamp || s.fmt0 {
+			// fmt3紧跟fmt0时，有的实现把增量当成0，所以不用fmt3
+			w.header.FMT = ChunkFmt2
+		} else {
+			w.header.FMT = ChunkFmt3
+		}
+		s.delta = timestamp
+	}
+	if timestamp >= MaxMessageTimestamp {
+		w.header.MessageTimestamp = MaxMessageTimestamp
+		w.header.ExtendedTimestamp = timestamp
+	} else {
+		w.header.MessageTimestamp = timestamp
+		w.header.ExtendedTimestamp = 0
+	}
+	s.init = true
+	s.fmt0 = w.header.FMT == ChunkFmt0
+	s.timestamp = msg.Timestamp
+	s.length = length
+	s.typeID = msg.TypeID
+	s.streamID = msg.StreamID
+}
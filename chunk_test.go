@@ -33,3 +33,137 @@ func TestChunkHeader(t *testing.T) {
 		t.FailNow()
 	}
 }
+
+func testChunk(t *testing.T, w *bytes.Buffer, fmt uint8, csid, timestamp, length uint32, typeID uint8, data []byte) {
+	var c ChunkHeader
+	c.FMT = fmt
+	c.CSID = csid
+	c.MessageTimestamp = timestamp
+	if timestamp >= MaxMessageTimestamp {
+		c.MessageTimestamp = MaxMessageTimestamp
+		c.ExtendedTimestamp = timestamp
+	}
+	c.MessageLength = length
+	c.MessageTypeID = typeID
+	c.MessageStreamID = 1
+	err := c.Write(w)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write(data)
+}
+
+func TestChunkReader(t *testing.T) {
+	var b bytes.Buffer
+	video := bytes.Repeat([]byte{9}, 200)
+	audio := bytes.Repeat([]byte{8}, 10)
+	ts := uint32(MaxMessageTimestamp + 10)
+	// 交错的chunk
+	testChunk(t, &b, ChunkFmt0, 4, ts, 200, VideoMessage, video[:128])
+	testChunk(t, &b, ChunkFmt0, 5, 100, 10, AudioMessage, audio)
+	testChunk(t, &b, ChunkFmt3, 4, ts, 0, 0, video[128:])
+	testChunk(t, &b, ChunkFmt2, 5, 20, 0, 0, audio)
+	testChunk(t, &b, ChunkFmt3, 5, 0, 0, 0, audio)
+	// set chunk size
+	var c ChunkHeader
+	c.CSID = ControlMessageChunkStreamID
+	c.MessageLength = 4
+	c.MessageTypeID = ControlMessageSetChunkSize
+	c.Write(&b)
+	b.Write([]byte{0, 0, 1, 0})
+	testChunk(t, &b, ChunkFmt1, 4, 5, 200, VideoMessage, video)
+	r := NewChunkReader(&b)
+	for _, m := range []struct {
+		csid      uint32
+		typeID    uint8
+		timestamp uint32
+		data      []byte
+	}{
+		{5, AudioMessage, 100, audio},
+		{4, VideoMessage, ts, video},
+		{5, AudioMessage, 120, audio},
+		{5, AudioMessage, 140, audio},
+		{ControlMessageChunkStreamID, ControlMessageSetChunkSize, 0, []byte{0, 0, 1, 0}},
+		{4, VideoMessage, ts + 5, video},
+	} {
+		msg, err := r.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if msg.CSID != m.csid || msg.TypeID != m.typeID || msg.Timestamp != m.timestamp || !bytes.Equal(msg.Data.Bytes(), m.data) {
+			t.Fatalf("csid <%d> type <%d> timestamp <%d> length <%d>", msg.CSID, msg.TypeID, msg.Timestamp, msg.Data.Len())
+		}
+		PutMessage(msg)
+	}
+	if r.ChunkSize() != 256 {
+		t.FailNow()
+	}
+	if b.Len() != 0 {
+		t.FailNow()
+	}
+}
+
+func TestChunkWriter(t *testing.T) {
+	var b bytes.Buffer
+	w := NewChunkWriter(&b)
+	ts := uint32(MaxMessageTimestamp + 10)
+	messages := []struct {
+		typeID    uint8
+		timestamp uint32
+		data      []byte
+	}{
+		{VideoMessage, 0, bytes.Repeat([]byte{9}, 300)},
+		{VideoMessage, 40, bytes.Repeat([]byte{9}, 300)},
+		{VideoMessage, 80, bytes.Repeat([]byte{9}, 300)},
+		{VideoMessage, 120, bytes.Repeat([]byte{9}, 100)},
+		{AudioMessage, 20, bytes.Repeat([]byte{8}, 10)},
+		{AudioMessage, ts, bytes.Repeat([]byte{8}, 200)},
+		{AudioMessage, ts + 20, bytes.Repeat([]byte{8}, 200)},
+		{VideoMessage, 10, bytes.Repeat([]byte{9}, 300)},
+	}
+	for i, m := range messages {
+		if i == 4 {
+			err := w.SetChunkSize(256)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		msg := GetMessage()
+		msg.TypeID = m.typeID
+		msg.Timestamp = m.timestamp
+		msg.StreamID = 1
+		msg.Data.Write(m.data)
+		err := w.WriteMessage(msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		PutMessage(msg)
+	}
+	if w.ChunkSize() != 256 {
+		t.FailNow()
+	}
+	r := NewChunkReader(&b)
+	for i, m := range messages {
+		if i == 4 {
+			msg, err := r.ReadMessage()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if msg.TypeID != ControlMessageSetChunkSize {
+				t.FailNow()
+			}
+			PutMessage(msg)
+		}
+		msg, err := r.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if msg.TypeID != m.typeID || msg.Timestamp != m.timestamp || msg.StreamID != 1 || !bytes.Equal(msg.Data.Bytes(), m.data) {
+			t.Fatalf("%d: type <%d> timestamp <%d> length <%d>", i, msg.TypeID, msg.Timestamp, msg.Data.Len())
+		}
+		PutMessage(msg)
+	}
+	if r.ChunkSize() != 256 || b.Len() != 0 {
+		t.FailNow()
+	}
+}
@@ -0,0 +1,422 @@
+package rtmp
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+const (
+	DefaultPort = "1935"
+)
+
+var (
+	errClientClosed = errors.New("rtmp client closed")
+)
+
+// rtmp客户端，可以推流和拉流。
+// 一个Client只创建一个消息流。
+type Client struct {
+	conn                  net.Conn
+	url                   *url.URL
+	app                   string
+	tcURL                 string
+	reader                *ChunkReader
+	writer                *ChunkScheduler
+	lock                  sync.Mutex
+	err                   error
+	closeOnce             sync.Once
+	closed                chan struct{} // 调用了closeWithError
+	done                  chan struct{} // readLoop退出
+	transactions          *TransactionManager
+	packets               chan *Message // 接收的音视频和数据消息
+	streamID              uint32        // createStream返回
+	objectEncoding        float64       // connect使用的编码
+	acknowledgement       uint32        // 上一次ack时收到的字节数
+	windowAcknowledgeSize uint32        // 服务端设置的值
+	user                  string        // url中的用户名，用于adobe和llnw验证
+	password              string        // url中的密码
+	authParams            string        // connect的app和tcUrl后面加上的验证参数
+	// connect的command object可以修改的字段，在Connect之前设置
+	FlashVer string
+	SwfURL   string
+	PageURL  string
+}
+
+// 连接到rawurl并握手，rawurl的格式是rtmp://[user:password@]host[:port]/app[/stream]，
+// app是路径的第一段，之后需要调用Connect，需要验证的话使用DialAndConnect
+func Dial(rawurl string) (*Client, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "rtmp" {
+		return nil, fmt.Errorf("unsupported url scheme <%s>", u.Scheme)
+	}
+	host := u.Host
+	if u.Port() == "" {
+		host = net.JoinHostPort(u.Hostname(), DefaultPort)
+	}
+	conn, err := net.Dial("tcp", host)
+	if err != nil {
+		return nil, err
+	}
+	_, err = HandshakeDial(conn, 0)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	c := &Client{
+		conn:     conn,
+		url:      u,
+		reader:   NewChunkReader(bufio.NewReader(conn)),
+		writer:   NewChunkScheduler(conn),
+		closed:   make(chan struct{}),
+		done:     make(chan struct{}),
+		packets:  make(chan *Message, 64),
+		FlashVer: "FMLE/3.0 (compatible; FMSc/1.0)",
+	}
+	c.transactions = NewTransactionManager(c.sendCommand)
+	// app是路径的第一段
+	c.app = strings.TrimPrefix(u.Path, "/")
+	if i := strings.IndexByte(c.app, '/'); i >= 0 {
+		c.app = c.app[:i]
+	}
+	c.tcURL = fmt.Sprintf("%s://%s/%s", u.Scheme, u.Host, c.app)
+	if u.RawQuery != "" {
+		c.tcURL += "?" + u.RawQuery
+	}
+	if u.User != nil {
+		c.user = u.User.Username()
+		c.password, _ = u.User.Password()
+	}
+	go c.readLoop()
+	return c, nil
+}
+
+// Dial然后Connect，url中有用户名和密码时，支持adobe和llnw的验证。
+// 服务端每次拒绝connect后会关闭连接，所以验证的过程中会重新连接
+func DialAndConnect(rawurl string) (*Client, error) {
+	return DialAndConnectContext(context.Background(), rawurl)
+}
+
+func DialAndConnectContext(ctx context.Context, rawurl string) (*Client, error) {
+	var authParams string
+	// 不带参数，带上authmod和user，带上response
+	for i := 0; i < 3; i++ {
+		c, err := Dial(rawurl)
+		if err != nil {
+			return nil, err
+		}
+		c.authParams = authParams
+		err = c.ConnectContext(ctx)
+		if err == nil {
+			return c, nil
+		}
+		c.Close()
+		e, ok := err.(*ConnectError)
+		if !ok || e.Info.Code != "NetConnection.Connect.Rejected" {
+			return nil, err
+		}
+		authParams, err = nextAuthParams(e.Info.Description, authParams, c.user, c.password, c.app)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return nil, fmt.Errorf("authentication failed")
+}
+
+// connect被拒绝
+type ConnectError struct {
+	Info StatusInfo // _error的information
+}
+
+func (e *ConnectError) Error() string {
+	return fmt.Sprintf("command message '%s' error <%s> <%s>", CommandConnect, e.Info.Code, e.Info.Description)
+}
+
+// Dial的url
+func (c *Client) URL() *url.URL {
+	return c.url
+}
+
+// createStream返回的消息流
+func (c *Client) StreamID() uint32 {
+	return c.streamID
+}
+
+// 命令的调用和响应，可以设置超时
+func (c *Client) Transactions() *TransactionManager {
+	return c.transactions
+}
+
+// 注册服务端主动调用的处理函数，比如onBWDone
+func (c *Client) Handle(name string, h CommandHandler) {
+	c.transactions.Handle(name, h)
+}
+
+// 调用服务端的方法，等待_result
+func (c *Client) Call(ctx context.Context, cmd Command) (*ResultCommand, error) {
+	return c.transactions.Call(ctx, CommandMessageStreamID, cmd)
+}
+
+// 连接到url的app，等待_result
+func (c *Client) Connect() error {
+	return c.ConnectContext(context.Background())
+}
+
+// connect被拒绝返回*ConnectError
+func (c *Client) ConnectContext(ctx context.Context) error {
+	tcURL := c.tcURL
+	if c.authParams != "" && strings.Contains(tcURL, "?") {
+		tcURL += "&" + strings.TrimPrefix(c.authParams, "?")
+	} else {
+		tcURL += c.authParams
+	}
+	res, err := c.Call(ctx, &ConnectCommand{
+		CommandObject: ConnectObject{
+			App:            c.app + c.authParams,
+			FlashVer:       c.FlashVer,
+			SwfURL:         c.SwfURL,
+			TcURL:          tcURL,
+			Capabilities:   15,
+			AudioCodecs:    3575,
+			VideoCodecs:    252,
+			VideoFunction:  1,
+			PageURL:        c.PageURL,
+			ObjectEncoding: c.objectEncoding,
+		},
+	})
+	if err != nil && res != nil && res.Error {
+		e := new(ConnectError)
+		if UnmarshalAMF(res.Information, &e.Info) == nil {
+			return e
+		}
+	}
+	return err
+}
+
+// 创建消息流，返回消息流的id
+func (c *Client) CreateStream() (uint32, error) {
+	return c.CreateStreamContext(context.Background())
+}
+
+func (c *Client) CreateStreamContext(ctx context.Context) (uint32, error) {
+	res, err := c.Call(ctx, new(CreateStreamCommand))
+	if err != nil {
+		return 0, err
+	}
+	var streamID float64
+	err = UnmarshalAMF(res.Information, &streamID)
+	if err != nil {
+		return 0, fmt.Errorf("command message '%s'.'stream id' <%s>", CommandCreateStream, err.Error())
+	}
+	c.streamID = uint32(streamID)
+	return c.streamID, nil
+}
+
+// 推流，mode是live，record或者append，等待NetStream.Publish.Start
+func (c *Client) Publish(name, mode string) error {
+	return c.PublishContext(context.Background(), name, mode)
+}
+
+func (c *Client) PublishContext(ctx context.Context, name, mode string) error {
+	return c.streamCommand(ctx, &PublishCommand{PublishingName: name, PublishingType: mode}, "NetStream.Publish.Start")
+}
+
+// 拉流，start和duration参考PlayCommand，等待NetStream.Play.Start
+func (c *Client) Play(name string, start, duration float64) error {
+	return c.PlayContext(context.Background(), name, start, duration)
+}
+
+func (c *Client) PlayContext(ctx context.Context, name string, start, duration float64) error {
+	return c.streamCommand(ctx, &PlayCommand{StreamName: name, Start: start, Duration: duration}, "NetStream.Play.Start")
+}
+
+// 在消息流上发送cmd，等待onStatus的code
+func (c *Client) streamCommand(ctx context.Context, cmd Command, code string) error {
+	if timeout := c.transactions.Timeout; timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	w := c.transactions.WatchStatus(c.streamID)
+	defer w.Close()
+	err := c.transactions.Send(c.streamID, cmd)
+	if err != nil {
+		return err
+	}
+	_, err = w.Wait(ctx, code)
+	return err
+}
+
+// 发送音频数据，data是flv的audio tag data
+func (c *Client) WriteAudio(timestamp uint32, data []byte) error {
+	return c.writeMedia(AudioMessage, timestamp, data)
+}
+
+// 发送视频数据，data是flv的video tag data
+func (c *Client) WriteVideo(timestamp uint32, data []byte) error {
+	return c.writeMedia(VideoMessage, timestamp, data)
+}
+
+// 发送@setDataFrame onMetaData，metaData可以是MarshalAMF支持的数据
+func (c *Client) WriteMetadata(metaData interface{}) error {
+	msg := GetMessage()
+	msg.CSID = DataMessageChunkStreamID
+	msg.TypeID = DataMessageAMF0
+	msg.StreamID = c.streamID
+	msg.Timestamp = 0
+	err := NewAMF0Encoder(&msg.Data).Encode("@setDataFrame", "onMetaData", metaData)
+	if err != nil {
+		PutMessage(msg)
+		return err
+	}
+	return c.writer.Send(msg)
+}
+
+func (c *Client) writeMedia(typeID uint8, timestamp uint32, data []byte) error {
+	msg := GetMessage()
+	msg.CSID = 0
+	msg.TypeID = typeID
+	msg.StreamID = c.streamID
+	msg.Timestamp = timestamp
+	msg.Data.Write(data)
+	return c.writer.Send(msg)
+}
+
+// 读取音视频和数据消息，使用完后可以调用PutMessage回收。
+// 不读取的话，接收缓存满了之后会阻塞其他消息的处理。
+func (c *Client) ReadPacket() (*Message, error) {
+	select {
+	case msg := <-c.packets:
+		return msg, nil
+	case <-c.done:
+		// 先返回已经收到的
+		select {
+		case msg := <-c.packets:
+			return msg, nil
+		default:
+			return nil, c.error()
+		}
+	}
+}
+
+// 关闭连接
+func (c *Client) Close() error {
+	c.closeWithError(errClientClosed)
+	<-c.done
+	return nil
+}
+
+func (c *Client) error() error {
+	c.lock.Lock()
+	err := c.err
+	c.lock.Unlock()
+	return err
+}
+
+// 关闭连接，唤醒所有等待响应的调用
+func (c *Client) closeWithError(err error) {
+	c.closeOnce.Do(func() {
+		c.lock.Lock()
+		c.err = err
+		c.lock.Unlock()
+		c.transactions.Close(err)
+		close(c.closed)
+		c.conn.Close()
+		c.writer.Close()
+	})
+}
+
+// 发送命令
+func (c *Client) sendCommand(streamID uint32, cmd Command) error {
+	msg := GetMessage()
+	err := EncodeCommand(msg, cmd, c.objectEncoding)
+	if err != nil {
+		PutMessage(msg)
+		return err
+	}
+	msg.StreamID = streamID
+	return c.writer.Send(msg)
+}
+
+// 循环读取并处理消息
+func (c *Client) readLoop() {
+	var err error
+	defer func() {
+		c.closeWithError(err)
+		close(c.done)
+	}()
+	var msg *Message
+	for {
+		msg, err = c.reader.ReadMessage()
+		if err != nil {
+			return
+		}
+		// ack
+		n := c.reader.BytesRead()
+		if c.windowAcknowledgeSize > 0 && n-c.acknowledgement >= c.windowAcknowledgeSize {
+			c.acknowledgement = n
+			err = c.sendControl(&Acknowledgement{SequenceNumber: n})
+			if err != nil {
+				PutMessage(msg)
+				return
+			}
+		}
+		switch msg.TypeID {
+		case AudioMessage, VideoMessage, DataMessageAMF0, DataMessageAMF3:
+			select {
+			case c.packets <- msg:
+				continue
+			case <-c.closed:
+				PutMessage(msg)
+				err = c.error()
+				return
+			}
+		case CommandMessageAMF0, CommandMessageAMF3:
+			err = c.handleCommand(msg)
+		default:
+			err = c.handleControl(msg)
+		}
+		PutMessage(msg)
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (c *Client) sendControl(m ControlMessage) error {
+	msg := GetMessage()
+	m.Encode(msg)
+	return c.writer.Send(msg)
+}
+
+func (c *Client) handleControl(msg *Message) error {
+	m, err := Parse(msg)
+	if err != nil {
+		// 不认识的消息，忽略
+		return nil
+	}
+	switch m := m.(type) {
+	case *WindowAckSize:
+		c.windowAcknowledgeSize = m.Size
+	case *PingRequest:
+		return c.sendControl(&PingResponse{Timestamp: m.Timestamp})
+	}
+	return nil
+}
+
+func (c *Client) handleCommand(msg *Message) error {
+	cmd, err := DecodeCommand(msg)
+	if err != nil {
+		return err
+	}
+	_, err = c.transactions.Dispatch(msg.StreamID, cmd)
+	return err
+}
@@ -0,0 +1,172 @@
+package rtmp
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"net"
+	"testing"
+)
+
+// 简单的服务端，收到的音视频和数据消息写到media
+func testClientServer(t *testing.T, conn net.Conn, media chan<- *Message) {
+	defer conn.Close()
+	_, err := HandshakeAccept(conn, 0)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	r := NewChunkReader(bufio.NewReader(conn))
+	w := NewChunkScheduler(conn)
+	defer w.Close()
+	send := func(streamID uint32, cmd Command) {
+		msg := GetMessage()
+		EncodeCommand(msg, cmd, 0)
+		msg.StreamID = streamID
+		w.Send(msg)
+	}
+	for {
+		msg, err := r.ReadMessage()
+		if err != nil {
+			return
+		}
+		switch msg.TypeID {
+		case CommandMessageAMF0:
+			cmd, err := DecodeCommand(msg)
+			PutMessage(msg)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			switch cmd := cmd.(type) {
+			case *ConnectCommand:
+				if cmd.CommandObject.App != "live" || cmd.CommandObject.TcURL != "rtmp://"+conn.LocalAddr().String()+"/live" {
+					t.Errorf("%#v", cmd.CommandObject)
+				}
+				send(0, &ResultCommand{
+					CommandTransaction: cmd.CommandTransaction,
+					Information:        map[string]interface{}{"level": "status", "code": "NetConnection.Connect.Success"},
+				})
+			case *CreateStreamCommand:
+				send(0, &ResultCommand{CommandTransaction: cmd.CommandTransaction, Information: float64(1)})
+			case *PublishCommand:
+				send(1, &OnStatusCommand{Info: StatusInfo{Level: "status", Code: "NetStream.Publish.Start"}})
+			case *PlayCommand:
+				if cmd.StreamName != "test" {
+					send(1, &OnStatusCommand{Info: StatusInfo{Level: "error", Code: "NetStream.Play.StreamNotFound"}})
+					break
+				}
+				send(1, &OnStatusCommand{Info: StatusInfo{Level: "status", Code: "NetStream.Play.Reset"}})
+				send(1, &OnStatusCommand{Info: StatusInfo{Level: "status", Code: "NetStream.Play.Start"}})
+				video := GetMessage()
+				video.TypeID = VideoMessage
+				video.StreamID = 1
+				video.Timestamp = 40
+				video.Data.Write([]byte{0x17, 0x01})
+				w.Send(video)
+			default:
+				send(0, &ResultCommand{
+					CommandTransaction: CommandTransaction{TransactionID: cmd.Transaction()},
+					Error:              true,
+					Information:        map[string]interface{}{"level": "error", "code": "NetConnection.Call.Failed"},
+				})
+			}
+		case AudioMessage, VideoMessage, DataMessageAMF0:
+			media <- msg
+		default:
+			PutMessage(msg)
+		}
+	}
+}
+
+func TestClient(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	media := make(chan *Message, 8)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go testClientServer(t, conn, media)
+		}
+	}()
+	// 推流
+	c, err := Dial("rtmp://" + ln.Addr().String() + "/live/test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	err = c.Connect()
+	if err != nil {
+		t.Fatal(err)
+	}
+	streamID, err := c.CreateStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if streamID != 1 {
+		t.FailNow()
+	}
+	err = c.Publish("test", "live")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = c.WriteMetadata(map[string]interface{}{"width": 1280})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = c.WriteAudio(20, []byte{0xaf, 0x01})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, typeID := range []uint8{DataMessageAMF0, AudioMessage} {
+		msg := <-media
+		if msg.TypeID != typeID || msg.StreamID != 1 {
+			t.Fatalf("type <%d> stream <%d>", msg.TypeID, msg.StreamID)
+		}
+		PutMessage(msg)
+	}
+	// _error
+	_, err = c.Call(context.Background(), &CallCommand{Name: "unknown"})
+	if err == nil {
+		t.FailNow()
+	}
+	// 拉流
+	p, err := Dial("rtmp://" + ln.Addr().String() + "/live")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = p.Connect()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = p.CreateStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Play("none", -2, -1) == nil {
+		t.FailNow()
+	}
+	err = p.Play("test", -2, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, err := p.ReadPacket()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.TypeID != VideoMessage || msg.Timestamp != 40 || !bytes.Equal(msg.Data.Bytes(), []byte{0x17, 0x01}) {
+		t.FailNow()
+	}
+	PutMessage(msg)
+	p.Close()
+	_, err = p.ReadPacket()
+	if err != errClientClosed {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/qq51529210/log"
+	"github.com/qq51529210/rtmp/server"
+)
+
+var (
+	configFile = flag.String("config", "", "json配置文件，SIGHUP重新加载")
+	listen     = flag.String("listen", "", "rtmp监听的地址，多个用逗号分隔，覆盖配置文件")
+	httpListen = flag.String("http", "", "http-flv监听的地址，覆盖配置文件")
+	chunkSize  = flag.Uint("chunk-size", 0, "发送的chunk size，覆盖配置文件")
+	logLevel   = flag.String("log-level", "", "日志级别debug，error或者off，覆盖配置文件")
+	recordDir  = flag.String("record-dir", "", "录制的目录，覆盖配置文件")
+)
+
+func main() {
+	flag.Parse()
+	cfg, err := loadConfig()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	a := &app{server: new(server.Server), listeners: make(map[string]context.CancelFunc)}
+	err = a.apply(cfg)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM)
+	for sig := range c {
+		if sig != syscall.SIGHUP {
+			break
+		}
+		// 重新加载，失败则继续使用之前的配置
+		cfg, err = loadConfig()
+		if err == nil {
+			err = a.apply(cfg)
+		}
+		if err != nil {
+			log.Error(err)
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(a.config.Timeout.Shutdown))
+	defer cancel()
+	if a.http != nil {
+		a.http.Shutdown(ctx)
+	}
+	err = a.server.Shutdown(ctx)
+	if err != nil {
+		log.Error(err)
+	}
+}
+
+// 读取配置文件，没有则使用默认的配置，然后使用命令行参数覆盖
+func loadConfig() (*server.Config, error) {
+	cfg := server.DefaultConfig()
+	if *configFile != "" {
+		var err error
+		cfg, err = server.LoadConfig(*configFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+	flag.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "listen":
+			cfg.Listen = strings.Split(*listen, ",")
+		case "http":
+			cfg.HTTP.Listen = *httpListen
+		case "chunk-size":
+			cfg.ChunkSize = uint32(*chunkSize)
+		case "log-level":
+			cfg.Log.Level = *logLevel
+		case "record-dir":
+			cfg.Record.Dir = *recordDir
+		}
+	})
+	return cfg, cfg.Validate()
+}
+
+// 运行中的服务和监听
+type app struct {
+	server    *server.Server
+	config    *server.Config
+	listeners map[string]context.CancelFunc
+	http      *http.Server
+}
+
+// 使用新的配置，只启动和关闭改变了的监听，已经建立的连接不受影响
+func (a *app) apply(cfg *server.Config) error {
+	listeners := make(map[string]net.Listener)
+	for _, addr := range cfg.Listen {
+		if _, ok := a.listeners[addr]; ok {
+			continue
+		}
+		ln, err := net.Listen("tcp", addr)
+		if err != nil {
+			for _, ln := range listeners {
+				ln.Close()
+			}
+			return err
+		}
+		listeners[addr] = ln
+	}
+	var httpServer *http.Server
+	if cfg.HTTP.Listen != "" && (a.http == nil || a.http.Addr != cfg.HTTP.Listen) {
+		ln, err := net.Listen("tcp", cfg.HTTP.Listen)
+		if err != nil {
+			for _, ln := range listeners {
+				ln.Close()
+			}
+			return err
+		}
+		httpServer = &http.Server{Addr: cfg.HTTP.Listen, Handler: a.server}
+		go httpServer.Serve(ln)
+	}
+	a.server.SetConfig(cfg)
+	a.config = cfg
+	for addr, ln := range listeners {
+		ctx, cancel := context.WithCancel(context.Background())
+		a.listeners[addr] = cancel
+		go a.serve(ctx, ln)
+	}
+	// 关闭不再使用的监听
+	for addr, cancel := range a.listeners {
+		if !contains(cfg.Listen, addr) {
+			cancel()
+			delete(a.listeners, addr)
+		}
+	}
+	if httpServer != nil || cfg.HTTP.Listen == "" {
+		if a.http != nil {
+			a.http.Close()
+		}
+		a.http = httpServer
+	}
+	return nil
+}
+
+func (a *app) serve(ctx context.Context, ln net.Listener) {
+	err := a.server.Serve(ctx, ln)
+	if err != nil && err != server.ErrServerClosed && err != context.Canceled {
+		log.Error(err)
+	}
+}
+
+func contains(a []string, s string) bool {
+	for _, v := range a {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
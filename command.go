@@ -0,0 +1,503 @@
+package rtmp
+
+import (
+	"bytes"
+	"fmt"
+)
+
+// 命令消息的名称
+const (
+	CommandConnect         = "connect"
+	CommandCreateStream    = "createStream"
+	CommandPlay            = "play"
+	CommandPlay2           = "play2"
+	CommandDeleteStream    = "deleteStream"
+	CommandCloseStream     = "closeStream"
+	CommandReceiveAudio    = "receiveAudio"
+	CommandReceiveVideo    = "receiveVideo"
+	CommandPublish         = "publish"
+	CommandSeek            = "seek"
+	CommandPause           = "pause"
+	CommandReleaseStream   = "releaseStream"
+	CommandFCPublish       = "FCPublish"
+	CommandFCUnpublish     = "FCUnpublish"
+	CommandGetStreamLength = "getStreamLength"
+	CommandResult          = "_result"
+	CommandError           = "_error"
+	CommandOnStatus        = "onStatus"
+)
+
+// NetConnection和NetStream的命令，
+// 编码是[name][transaction id][其他的值]
+type Command interface {
+	// 命令的名称
+	CommandName() string
+	// 返回transaction id
+	Transaction() float64
+	// 设置transaction id
+	SetTransaction(id float64)
+	// name之后的值，按顺序，可以是MarshalAMF支持的数据
+	MarshalCommand() []interface{}
+	// name之后的值，是ReadAMF返回的数据
+	UnmarshalCommand(values []interface{}) error
+}
+
+var (
+	// 解码时，命令名称对应的结构
+	commandTypes = map[string]func() Command{
+		CommandConnect:         func() Command { return new(ConnectCommand) },
+		CommandCreateStream:    func() Command { return new(CreateStreamCommand) },
+		CommandPlay:            func() Command { return new(PlayCommand) },
+		CommandPlay2:           func() Command { return new(Play2Command) },
+		CommandDeleteStream:    func() Command { return new(DeleteStreamCommand) },
+		CommandCloseStream:     func() Command { return new(CloseStreamCommand) },
+		CommandReceiveAudio:    func() Command { return &ReceiveAVCommand{Audio: true} },
+		CommandReceiveVideo:    func() Command { return new(ReceiveAVCommand) },
+		CommandPublish:         func() Command { return new(PublishCommand) },
+		CommandSeek:            func() Command { return new(SeekCommand) },
+		CommandPause:           func() Command { return new(PauseCommand) },
+		CommandReleaseStream:   func() Command { return &StreamNameCommand{Name: CommandReleaseStream} },
+		CommandFCPublish:       func() Command { return &StreamNameCommand{Name: CommandFCPublish} },
+		CommandFCUnpublish:     func() Command { return &StreamNameCommand{Name: CommandFCUnpublish} },
+		CommandGetStreamLength: func() Command { return &StreamNameCommand{Name: CommandGetStreamLength} },
+		CommandResult:          func() Command { return new(ResultCommand) },
+		CommandError:           func() Command { return &ResultCommand{Error: true} },
+		CommandOnStatus:        func() Command { return new(OnStatusCommand) },
+	}
+)
+
+// 将cmd写入msg，objectEncoding是3时使用amf3命令消息，
+// 对象切换到amf3编码
+func EncodeCommand(msg *Message, cmd Command, objectEncoding float64) error {
+	msg.CSID = CommandMessageChunkStreamID
+	msg.Timestamp = 0
+	msg.Data.Reset()
+	amf3 := objectEncoding == 3
+	if amf3 {
+		msg.TypeID = CommandMessageAMF3
+		// 第一个字节是0
+		msg.Data.WriteByte(0)
+	} else {
+		msg.TypeID = CommandMessageAMF0
+	}
+	err := WriteAMF(&msg.Data, cmd.CommandName())
+	if err != nil {
+		return err
+	}
+	for _, v := range cmd.MarshalCommand() {
+		amf, err := MarshalAMF(v)
+		if err != nil {
+			return fmt.Errorf("command message '%s' <%s>", cmd.CommandName(), err.Error())
+		}
+		if amf3 {
+			switch amf.(type) {
+			case nil, float64, string, bool:
+			default:
+				amf = AVMPlus{Value: amf}
+			}
+		}
+		err = WriteAMF(&msg.Data, amf)
+		if err != nil {
+			return fmt.Errorf("command message '%s' <%s>", cmd.CommandName(), err.Error())
+		}
+	}
+	return nil
+}
+
+// 解析命令消息，返回的是指针，比如*ConnectCommand，
+// 不认识的命令返回*CallCommand
+func DecodeCommand(msg *Message) (Command, error) {
+	r := bytes.NewReader(msg.Data.Bytes())
+	switch msg.TypeID {
+	case CommandMessageAMF0:
+	case CommandMessageAMF3:
+		// 第一个字节是0，后面是amf0编码，对象可以切换到amf3
+		_, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("message type <%d> is not command message", msg.TypeID)
+	}
+	var name string
+	err := NewAMF0Decoder(r).Decode(&name)
+	if err != nil {
+		return nil, fmt.Errorf("command message invalid 'name' <%s>", err.Error())
+	}
+	var values []interface{}
+	for r.Len() > 0 {
+		amf, err := ReadAMF(r)
+		if err != nil {
+			return nil, fmt.Errorf("command message '%s' <%s>", name, err.Error())
+		}
+		values = append(values, amf)
+	}
+	var cmd Command
+	if f, ok := commandTypes[name]; ok {
+		cmd = f()
+	} else {
+		cmd = &CallCommand{Name: name}
+	}
+	err = cmd.UnmarshalCommand(values)
+	if err != nil {
+		return nil, fmt.Errorf("command message '%s' <%s>", name, err.Error())
+	}
+	return cmd, nil
+}
+
+// 按顺序解码values到v，values比v少时，剩下的v不变，v是nil表示跳过
+func unmarshalCommandValues(values []interface{}, v ...interface{}) error {
+	for i, a := range v {
+		if i >= len(values) {
+			break
+		}
+		if a == nil {
+			continue
+		}
+		err := UnmarshalAMF(values[i], a)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 所有命令都有的transaction id
+type CommandTransaction struct {
+	TransactionID float64
+}
+
+func (c *CommandTransaction) Transaction() float64 {
+	return c.TransactionID
+}
+
+func (c *CommandTransaction) SetTransaction(id float64) {
+	c.TransactionID = id
+}
+
+// connect的command object
+type ConnectObject struct {
+	App            string  `amf:"app"`
+	FlashVer       string  `amf:"flashVer,omitempty"`
+	SwfURL         string  `amf:"swfUrl,omitempty"`
+	TcURL          string  `amf:"tcUrl"`
+	Type           string  `amf:"type,omitempty"`
+	Fpad           bool    `amf:"fpad"`
+	Capabilities   float64 `amf:"capabilities,omitempty"`
+	AudioCodecs    float64 `amf:"audioCodecs,omitempty"`
+	VideoCodecs    float64 `amf:"videoCodecs,omitempty"`
+	VideoFunction  float64 `amf:"videoFunction,omitempty"`
+	PageURL        string  `amf:"pageUrl,omitempty"`
+	ObjectEncoding float64 `amf:"objectEncoding"`
+}
+
+// 客户端请求连接到服务器的应用
+type ConnectCommand struct {
+	CommandTransaction
+	CommandObject ConnectObject
+	Arguments     []interface{} // 可选的用户参数
+}
+
+func (c *ConnectCommand) CommandName() string {
+	return CommandConnect
+}
+
+func (c *ConnectCommand) MarshalCommand() []interface{} {
+	return append([]interface{}{c.TransactionID, &c.CommandObject}, c.Arguments...)
+}
+
+func (c *ConnectCommand) UnmarshalCommand(values []interface{}) error {
+	err := unmarshalCommandValues(values, &c.TransactionID, &c.CommandObject)
+	if err != nil {
+		return err
+	}
+	if len(values) > 2 {
+		c.Arguments = values[2:]
+	}
+	return nil
+}
+
+// 不认识的命令，或者自定义的远程调用，比如onBWDone
+type CallCommand struct {
+	CommandTransaction
+	Name          string
+	CommandObject interface{}
+	Arguments     []interface{}
+}
+
+func (c *CallCommand) CommandName() string {
+	return c.Name
+}
+
+func (c *CallCommand) MarshalCommand() []interface{} {
+	return append([]interface{}{c.TransactionID, c.CommandObject}, c.Arguments...)
+}
+
+func (c *CallCommand) UnmarshalCommand(values []interface{}) error {
+	err := unmarshalCommandValues(values, &c.TransactionID, &c.CommandObject)
+	if err != nil {
+		return err
+	}
+	if len(values) > 2 {
+		c.Arguments = values[2:]
+	}
+	return nil
+}
+
+// 创建一个消息流，在_result中返回消息流的id
+type CreateStreamCommand struct {
+	CommandTransaction
+	CommandObject interface{}
+}
+
+func (c *CreateStreamCommand) CommandName() string {
+	return CommandCreateStream
+}
+
+func (c *CreateStreamCommand) MarshalCommand() []interface{} {
+	return []interface{}{c.TransactionID, c.CommandObject}
+}
+
+func (c *CreateStreamCommand) UnmarshalCommand(values []interface{}) error {
+	return unmarshalCommandValues(values, &c.TransactionID, &c.CommandObject)
+}
+
+// 响应，_result或者_error
+type ResultCommand struct {
+	CommandTransaction
+	Error       bool        // 是否_error
+	Properties  interface{} // command object
+	Information interface{} // 比如createStream的消息流id，connect的状态
+}
+
+func (c *ResultCommand) CommandName() string {
+	if c.Error {
+		return CommandError
+	}
+	return CommandResult
+}
+
+func (c *ResultCommand) MarshalCommand() []interface{} {
+	return []interface{}{c.TransactionID, c.Properties, c.Information}
+}
+
+func (c *ResultCommand) UnmarshalCommand(values []interface{}) error {
+	return unmarshalCommandValues(values, &c.TransactionID, &c.Properties, &c.Information)
+}
+
+// onStatus的info object
+type StatusInfo struct {
+	Level       string `amf:"level"`
+	Code        string `amf:"code"`
+	Description string `amf:"description,omitempty"`
+	Details     string `amf:"details,omitempty"`
+	ClientID    string `amf:"clientid,omitempty"`
+}
+
+// 消息流的状态，transaction id是0
+type OnStatusCommand struct {
+	CommandTransaction
+	Info StatusInfo
+}
+
+func (c *OnStatusCommand) CommandName() string {
+	return CommandOnStatus
+}
+
+func (c *OnStatusCommand) MarshalCommand() []interface{} {
+	return []interface{}{c.TransactionID, nil, &c.Info}
+}
+
+func (c *OnStatusCommand) UnmarshalCommand(values []interface{}) error {
+	return unmarshalCommandValues(values, &c.TransactionID, nil, &c.Info)
+}
+
+// 播放一个流，Start是-2表示先直播后录制，-1只播放直播，>=0从录制的位置开始；
+// Duration是-1表示播放到结束
+type PlayCommand struct {
+	CommandTransaction
+	StreamName string
+	Start      float64
+	Duration   float64
+	Reset      bool
+}
+
+func (c *PlayCommand) CommandName() string {
+	return CommandPlay
+}
+
+func (c *PlayCommand) MarshalCommand() []interface{} {
+	return []interface{}{c.TransactionID, nil, c.StreamName, c.Start, c.Duration, c.Reset}
+}
+
+func (c *PlayCommand) UnmarshalCommand(values []interface{}) error {
+	// 可选参数的默认值
+	c.Start = -2
+	c.Duration = -1
+	return unmarshalCommandValues(values, &c.TransactionID, nil, &c.StreamName, &c.Start, &c.Duration, &c.Reset)
+}
+
+// play2的参数
+type Play2Parameters struct {
+	Len           float64 `amf:"len"`
+	Offset        float64 `amf:"offset"`
+	OldStreamName string  `amf:"oldStreamName"`
+	Start         float64 `amf:"start"`
+	StreamName    string  `amf:"streamName"`
+	Transition    string  `amf:"transition"`
+}
+
+// 切换到另一个码率的流
+type Play2Command struct {
+	CommandTransaction
+	Parameters Play2Parameters
+}
+
+func (c *Play2Command) CommandName() string {
+	return CommandPlay2
+}
+
+func (c *Play2Command) MarshalCommand() []interface{} {
+	return []interface{}{c.TransactionID, nil, &c.Parameters}
+}
+
+func (c *Play2Command) UnmarshalCommand(values []interface{}) error {
+	return unmarshalCommandValues(values, &c.TransactionID, nil, &c.Parameters)
+}
+
+// 删除消息流
+type DeleteStreamCommand struct {
+	CommandTransaction
+	StreamID float64
+}
+
+func (c *DeleteStreamCommand) CommandName() string {
+	return CommandDeleteStream
+}
+
+func (c *DeleteStreamCommand) MarshalCommand() []interface{} {
+	return []interface{}{c.TransactionID, nil, c.StreamID}
+}
+
+func (c *DeleteStreamCommand) UnmarshalCommand(values []interface{}) error {
+	return unmarshalCommandValues(values, &c.TransactionID, nil, &c.StreamID)
+}
+
+// 关闭消息流上的播放或推流
+type CloseStreamCommand struct {
+	CommandTransaction
+}
+
+func (c *CloseStreamCommand) CommandName() string {
+	return CommandCloseStream
+}
+
+func (c *CloseStreamCommand) MarshalCommand() []interface{} {
+	return []interface{}{c.TransactionID, nil}
+}
+
+func (c *CloseStreamCommand) UnmarshalCommand(values []interface{}) error {
+	return unmarshalCommandValues(values, &c.TransactionID)
+}
+
+// receiveAudio或者receiveVideo
+type ReceiveAVCommand struct {
+	CommandTransaction
+	Audio bool // 是否receiveAudio
+	Flag  bool // 是否接收
+}
+
+func (c *ReceiveAVCommand) CommandName() string {
+	if c.Audio {
+		return CommandReceiveAudio
+	}
+	return CommandReceiveVideo
+}
+
+func (c *ReceiveAVCommand) MarshalCommand() []interface{} {
+	return []interface{}{c.TransactionID, nil, c.Flag}
+}
+
+func (c *ReceiveAVCommand) UnmarshalCommand(values []interface{}) error {
+	return unmarshalCommandValues(values, &c.TransactionID, nil, &c.Flag)
+}
+
+// 推流，PublishingType是live，record或者append
+type PublishCommand struct {
+	CommandTransaction
+	PublishingName string
+	PublishingType string
+}
+
+func (c *PublishCommand) CommandName() string {
+	return CommandPublish
+}
+
+func (c *PublishCommand) MarshalCommand() []interface{} {
+	return []interface{}{c.TransactionID, nil, c.PublishingName, c.PublishingType}
+}
+
+func (c *PublishCommand) UnmarshalCommand(values []interface{}) error {
+	err := unmarshalCommandValues(values, &c.TransactionID, nil, &c.PublishingName, &c.PublishingType)
+	// 没有，null或者空字符串都是live
+	if c.PublishingType == "" {
+		c.PublishingType = "live"
+	}
+	return err
+}
+
+// 跳到指定的毫秒
+type SeekCommand struct {
+	CommandTransaction
+	Milliseconds float64
+}
+
+func (c *SeekCommand) CommandName() string {
+	return CommandSeek
+}
+
+func (c *SeekCommand) MarshalCommand() []interface{} {
+	return []interface{}{c.TransactionID, nil, c.Milliseconds}
+}
+
+func (c *SeekCommand) UnmarshalCommand(values []interface{}) error {
+	return unmarshalCommandValues(values, &c.TransactionID, nil, &c.Milliseconds)
+}
+
+// 暂停或者继续播放
+type PauseCommand struct {
+	CommandTransaction
+	Pause        bool
+	Milliseconds float64
+}
+
+func (c *PauseCommand) CommandName() string {
+	return CommandPause
+}
+
+func (c *PauseCommand) MarshalCommand() []interface{} {
+	return []interface{}{c.TransactionID, nil, c.Pause, c.Milliseconds}
+}
+
+func (c *PauseCommand) UnmarshalCommand(values []interface{}) error {
+	return unmarshalCommandValues(values, &c.TransactionID, nil, &c.Pause, &c.Milliseconds)
+}
+
+// 只有流名称参数的命令，releaseStream，FCPublish，FCUnpublish，getStreamLength
+type StreamNameCommand struct {
+	CommandTransaction
+	Name       string // 命令的名称
+	StreamName string
+}
+
+func (c *StreamNameCommand) CommandName() string {
+	return c.Name
+}
+
+func (c *StreamNameCommand) MarshalCommand() []interface{} {
+	return []interface{}{c.TransactionID, nil, c.StreamName}
+}
+
+func (c *StreamNameCommand) UnmarshalCommand(values []interface{}) error {
+	return unmarshalCommandValues(values, &c.TransactionID, nil, &c.StreamName)
+}
@@ -0,0 +1,103 @@
+package rtmp
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestCommand(t *testing.T) {
+	commands := []Command{
+		&ConnectCommand{
+			CommandTransaction: CommandTransaction{TransactionID: 1},
+			CommandObject: ConnectObject{
+				App:            "live",
+				FlashVer:       "FMLE/3.0",
+				TcURL:          "rtmp://localhost/live",
+				AudioCodecs:    3575,
+				VideoCodecs:    252,
+				ObjectEncoding: 3,
+			},
+			Arguments: []interface{}{"user"},
+		},
+		&CallCommand{
+			CommandTransaction: CommandTransaction{TransactionID: 2},
+			Name:               "onBWDone",
+			Arguments:          []interface{}{"a", map[string]interface{}{"b": "c"}},
+		},
+		&CreateStreamCommand{CommandTransaction: CommandTransaction{TransactionID: 3}},
+		&ResultCommand{
+			CommandTransaction: CommandTransaction{TransactionID: 3},
+			Information:        float64(1),
+		},
+		&ResultCommand{
+			CommandTransaction: CommandTransaction{TransactionID: 4},
+			Error:              true,
+			Information:        map[string]interface{}{"code": "NetConnection.Call.Failed"},
+		},
+		&OnStatusCommand{Info: StatusInfo{Level: "status", Code: "NetStream.Play.Start", Description: "start"}},
+		&PlayCommand{StreamName: "test", Start: -2, Duration: -1, Reset: true},
+		&Play2Command{Parameters: Play2Parameters{StreamName: "test2", OldStreamName: "test", Transition: "switch"}},
+		&DeleteStreamCommand{StreamID: 1},
+		&CloseStreamCommand{},
+		&ReceiveAVCommand{Audio: true, Flag: true},
+		&ReceiveAVCommand{Flag: false},
+		&PublishCommand{PublishingName: "test", PublishingType: "record"},
+		&SeekCommand{Milliseconds: 1000},
+		&PauseCommand{Pause: true, Milliseconds: 1000},
+		&StreamNameCommand{Name: CommandReleaseStream, StreamName: "test"},
+		&StreamNameCommand{Name: CommandFCPublish, StreamName: "test"},
+		&StreamNameCommand{Name: CommandFCUnpublish, StreamName: "test"},
+		&StreamNameCommand{Name: CommandGetStreamLength, StreamName: "test"},
+	}
+	for _, objectEncoding := range []float64{0, 3} {
+		for _, c := range commands {
+			msg := GetMessage()
+			err := EncodeCommand(msg, c, objectEncoding)
+			if err != nil {
+				t.Fatal(err)
+			}
+			d, err := DecodeCommand(msg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(d, c) {
+				t.Fatalf("%#v != %#v", d, c)
+			}
+			PutMessage(msg)
+		}
+	}
+}
+
+func TestCommandDefault(t *testing.T) {
+	msg := GetMessage()
+	msg.TypeID = CommandMessageAMF0
+	WriteAMFs(&msg.Data, CommandPlay, float64(4), nil, "test")
+	c, err := DecodeCommand(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	play, ok := c.(*PlayCommand)
+	if !ok || play.Transaction() != 4 || play.StreamName != "test" || play.Start != -2 || play.Duration != -1 {
+		t.Fatalf("%#v", c)
+	}
+	PutMessage(msg)
+	// publish的类型没有，是null或者空字符串都是live
+	for _, values := range [][]interface{}{
+		{CommandPublish, float64(0), nil, "s"},
+		{CommandPublish, float64(0), nil, "s", nil},
+		{CommandPublish, float64(0), nil, "s", ""},
+	} {
+		msg = GetMessage()
+		msg.TypeID = CommandMessageAMF0
+		WriteAMFs(&msg.Data, values...)
+		c, err = DecodeCommand(msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		publish, ok := c.(*PublishCommand)
+		if !ok || publish.PublishingName != "s" || publish.PublishingType != "live" {
+			t.Fatalf("%#v", c)
+		}
+		PutMessage(msg)
+	}
+}
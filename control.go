@@ -0,0 +1,293 @@
+package rtmp
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// 协议控制消息和用户控制消息
+type ControlMessage interface {
+	// 写入msg，设置消息类型，chunk stream和消息流
+	Encode(msg *Message)
+	// 从msg解析
+	Decode(msg *Message) error
+}
+
+// 检查消息的长度
+func controlMessageData(msg *Message, name string, n int) ([]byte, error) {
+	data := msg.Data.Bytes()
+	if len(data) != n {
+		return nil, fmt.Errorf("control message '%s' invalid length <%d>", name, len(data))
+	}
+	return data, nil
+}
+
+// 初始化控制消息
+func encodeControlMessage(msg *Message, typeID uint8) {
+	msg.CSID = ControlMessageChunkStreamID
+	msg.TypeID = typeID
+	msg.StreamID = ControlMessageStreamID
+	msg.Timestamp = 0
+	msg.Data.Reset()
+}
+
+// 解析协议控制消息或用户控制消息，返回的是指针，比如*SetChunkSize，*StreamBegin
+func Parse(msg *Message) (ControlMessage, error) {
+	var m ControlMessage
+	switch msg.TypeID {
+	case ControlMessageSetChunkSize:
+		m = new(SetChunkSize)
+	case ControlMessageAbort:
+		m = new(Abort)
+	case ControlMessageAcknowledgement:
+		m = new(Acknowledgement)
+	case ControlMessageWindowAcknowledgementSize:
+		m = new(WindowAckSize)
+	case ControlMessageSetBandWidth:
+		m = new(SetPeerBandwidth)
+	case UserControlMessage:
+		data := msg.Data.Bytes()
+		if len(data) < 2 {
+			return nil, fmt.Errorf("user control message invalid length <%d>", len(data))
+		}
+		switch binary.BigEndian.Uint16(data) {
+		case UserControlMessageStreamBegin:
+			m = new(StreamBegin)
+		case UserControlMessageStreamEOF:
+			m = new(StreamEOF)
+		case UserControlMessageStreamDry:
+			m = new(StreamDry)
+		case UserControlMessageSetBufferLength:
+			m = new(SetBufferLength)
+		case UserControlMessageStreamIsRecorded:
+			m = new(StreamIsRecorded)
+		case UserControlMessagePingRequest:
+			m = new(PingRequest)
+		case UserControlMessagePingResponse:
+			m = new(PingResponse)
+		default:
+			return nil, fmt.Errorf("user control message unsupported event <%d>", binary.BigEndian.Uint16(data))
+		}
+	default:
+		return nil, fmt.Errorf("message type <%d> is not control message", msg.TypeID)
+	}
+	err := m.Decode(msg)
+	if err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// 之后的chunk的大小
+type SetChunkSize struct {
+	ChunkSize uint32
+}
+
+func (m *SetChunkSize) Encode(msg *Message) {
+	encodeControlMessage(msg, ControlMessageSetChunkSize)
+	msg.WriteB32(m.ChunkSize & 0x7fffffff)
+}
+
+func (m *SetChunkSize) Decode(msg *Message) error {
+	data, err := controlMessageData(msg, "set chunk size", 4)
+	if err != nil {
+		return err
+	}
+	// 第一位是0
+	m.ChunkSize = binary.BigEndian.Uint32(data) & 0x7fffffff
+	return nil
+}
+
+// 丢弃chunk stream没有接收完的消息
+type Abort struct {
+	CSID uint32
+}
+
+func (m *Abort) Encode(msg *Message) {
+	encodeControlMessage(msg, ControlMessageAbort)
+	msg.WriteB32(m.CSID)
+}
+
+func (m *Abort) Decode(msg *Message) error {
+	data, err := controlMessageData(msg, "abort", 4)
+	if err != nil {
+		return err
+	}
+	m.CSID = binary.BigEndian.Uint32(data)
+	return nil
+}
+
+// 到目前为止接收的字节数
+type Acknowledgement struct {
+	SequenceNumber uint32
+}
+
+func (m *Acknowledgement) Encode(msg *Message) {
+	encodeControlMessage(msg, ControlMessageAcknowledgement)
+	msg.WriteB32(m.SequenceNumber)
+}
+
+func (m *Acknowledgement) Decode(msg *Message) error {
+	data, err := controlMessageData(msg, "acknowledgement", 4)
+	if err != nil {
+		return err
+	}
+	m.SequenceNumber = binary.BigEndian.Uint32(data)
+	return nil
+}
+
+// 接收多少字节后发送Acknowledgement
+type WindowAckSize struct {
+	Size uint32
+}
+
+func (m *WindowAckSize) Encode(msg *Message) {
+	encodeControlMessage(msg, ControlMessageWindowAcknowledgementSize)
+	msg.WriteB32(m.Size)
+}
+
+func (m *WindowAckSize) Decode(msg *Message) error {
+	data, err := controlMessageData(msg, "window acknowledgement size", 4)
+	if err != nil {
+		return err
+	}
+	m.Size = binary.BigEndian.Uint32(data)
+	return nil
+}
+
+// 对方的发送带宽，LimitType是0(hard)，1(soft)，2(dynamic)
+type SetPeerBandwidth struct {
+	Size      uint32
+	LimitType uint8
+}
+
+func (m *SetPeerBandwidth) Encode(msg *Message) {
+	encodeControlMessage(msg, ControlMessageSetBandWidth)
+	msg.WriteB32(m.Size)
+	msg.Data.WriteByte(m.LimitType)
+}
+
+func (m *SetPeerBandwidth) Decode(msg *Message) error {
+	data, err := controlMessageData(msg, "set peer bandwidth", 5)
+	if err != nil {
+		return err
+	}
+	m.Size = binary.BigEndian.Uint32(data)
+	m.LimitType = data[4]
+	return nil
+}
+
+// 用户控制消息，[event type 2字节][event data]
+func encodeUserControl(msg *Message, event uint16, values ...uint32) {
+	encodeControlMessage(msg, UserControlMessage)
+	msg.WriteB16(event)
+	for _, v := range values {
+		msg.WriteB32(v)
+	}
+}
+
+// 解析用户控制消息的event data
+func decodeUserControl(msg *Message, name string, values ...*uint32) error {
+	data, err := controlMessageData(msg, name, 2+len(values)*4)
+	if err != nil {
+		return err
+	}
+	data = data[2:]
+	for _, v := range values {
+		*v = binary.BigEndian.Uint32(data)
+		data = data[4:]
+	}
+	return nil
+}
+
+// 流开始传输数据
+type StreamBegin struct {
+	StreamID uint32
+}
+
+func (m *StreamBegin) Encode(msg *Message) {
+	encodeUserControl(msg, UserControlMessageStreamBegin, m.StreamID)
+}
+
+func (m *StreamBegin) Decode(msg *Message) error {
+	return decodeUserControl(msg, "stream begin", &m.StreamID)
+}
+
+// 流的数据已经传输完
+type StreamEOF struct {
+	StreamID uint32
+}
+
+func (m *StreamEOF) Encode(msg *Message) {
+	encodeUserControl(msg, UserControlMessageStreamEOF, m.StreamID)
+}
+
+func (m *StreamEOF) Decode(msg *Message) error {
+	return decodeUserControl(msg, "stream eof", &m.StreamID)
+}
+
+// 流暂时没有数据
+type StreamDry struct {
+	StreamID uint32
+}
+
+func (m *StreamDry) Encode(msg *Message) {
+	encodeUserControl(msg, UserControlMessageStreamDry, m.StreamID)
+}
+
+func (m *StreamDry) Decode(msg *Message) error {
+	return decodeUserControl(msg, "stream dry", &m.StreamID)
+}
+
+// 客户端的缓存时长，毫秒
+type SetBufferLength struct {
+	StreamID     uint32
+	BufferLength uint32
+}
+
+func (m *SetBufferLength) Encode(msg *Message) {
+	encodeUserControl(msg, UserControlMessageSetBufferLength, m.StreamID, m.BufferLength)
+}
+
+func (m *SetBufferLength) Decode(msg *Message) error {
+	return decodeUserControl(msg, "set buffer length", &m.StreamID, &m.BufferLength)
+}
+
+// 流是录制的
+type StreamIsRecorded struct {
+	StreamID uint32
+}
+
+func (m *StreamIsRecorded) Encode(msg *Message) {
+	encodeUserControl(msg, UserControlMessageStreamIsRecorded, m.StreamID)
+}
+
+func (m *StreamIsRecorded) Decode(msg *Message) error {
+	return decodeUserControl(msg, "stream is recorded", &m.StreamID)
+}
+
+// 检查对方是否可达，Timestamp是本地时间
+type PingRequest struct {
+	Timestamp uint32
+}
+
+func (m *PingRequest) Encode(msg *Message) {
+	encodeUserControl(msg, UserControlMessagePingRequest, m.Timestamp)
+}
+
+func (m *PingRequest) Decode(msg *Message) error {
+	return decodeUserControl(msg, "ping request", &m.Timestamp)
+}
+
+// 响应PingRequest，Timestamp是PingRequest的值
+type PingResponse struct {
+	Timestamp uint32
+}
+
+func (m *PingResponse) Encode(msg *Message) {
+	encodeUserControl(msg, UserControlMessagePingResponse, m.Timestamp)
+}
+
+func (m *PingResponse) Decode(msg *Message) error {
+	return decodeUserControl(msg, "ping response", &m.Timestamp)
+}
@@ -0,0 +1,50 @@
+package rtmp
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestControlMessage(t *testing.T) {
+	for _, m := range []ControlMessage{
+		&SetChunkSize{ChunkSize: 4096},
+		&Abort{CSID: 4},
+		&Acknowledgement{SequenceNumber: 123456},
+		&WindowAckSize{Size: 2500000},
+		&SetPeerBandwidth{Size: 2500000, LimitType: 2},
+		&StreamBegin{StreamID: 1},
+		&StreamEOF{StreamID: 1},
+		&StreamDry{StreamID: 1},
+		&SetBufferLength{StreamID: 1, BufferLength: 3000},
+		&StreamIsRecorded{StreamID: 1},
+		&PingRequest{Timestamp: 100},
+		&PingResponse{Timestamp: 100},
+	} {
+		msg := GetMessage()
+		m.Encode(msg)
+		if msg.CSID != ControlMessageChunkStreamID || msg.StreamID != ControlMessageStreamID {
+			t.FailNow()
+		}
+		p, err := Parse(msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(p, m) {
+			t.Fatalf("%#v != %#v", p, m)
+		}
+		// 长度不对
+		msg.Data.WriteByte(0)
+		_, err = Parse(msg)
+		if err == nil {
+			t.FailNow()
+		}
+		PutMessage(msg)
+	}
+	msg := GetMessage()
+	msg.TypeID = AudioMessage
+	_, err := Parse(msg)
+	if err == nil {
+		t.FailNow()
+	}
+	PutMessage(msg)
+}
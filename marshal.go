@@ -0,0 +1,520 @@
+package rtmp
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	amfFieldsCache     sync.Map // reflect.Type -> []*amfField
+	amfMarshalerType   = reflect.TypeOf((*AMFMarshaler)(nil)).Elem()
+	amfUnmarshalerType = reflect.TypeOf((*AMFUnmarshaler)(nil)).Elem()
+	timeType           = reflect.TypeOf(time.Time{})
+)
+
+// 自定义编码，返回可以直接使用WriteAMF的数据
+type AMFMarshaler interface {
+	MarshalAMF() (interface{}, error)
+}
+
+// 自定义解码，amf是ReadAMF返回的数据
+type AMFUnmarshaler interface {
+	UnmarshalAMF(amf interface{}) error
+}
+
+// 将v编码成amf0
+func MarshalAMF0(v interface{}) ([]byte, error) {
+	var b bytes.Buffer
+	err := NewAMF0Encoder(&b).Encode(v)
+	if err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+// 从data中解码一个amf0到v，v必须是指针
+func UnmarshalAMF0(data []byte, v interface{}) error {
+	return NewAMF0Decoder(bytes.NewReader(data)).Decode(v)
+}
+
+// 将go的数据编码成amf0写入w
+type AMF0Encoder struct {
+	w io.Writer
+}
+
+func NewAMF0Encoder(w io.Writer) *AMF0Encoder {
+	return &AMF0Encoder{w: w}
+}
+
+// 按顺序编码多个数据
+func (e *AMF0Encoder) Encode(v ...interface{}) error {
+	for _, a := range v {
+		amf, err := MarshalAMF(a)
+		if err != nil {
+			return err
+		}
+		err = WriteAMF(e.w, amf)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 从r读取amf0，解码成go的数据
+type AMF0Decoder struct {
+	r       io.Reader
+	ordered bool
+}
+
+func NewAMF0Decoder(r io.Reader) *AMF0Decoder {
+	return &AMF0Decoder{r: r}
+}
+
+// 解码到interface{}时，object和ecma array使用OrderedObject和ECMAArray
+func (d *AMF0Decoder) UseOrderedObject() {
+	d.ordered = true
+}
+
+// 按顺序解码多个数据，v必须是指针，nil表示跳过这个数据
+func (d *AMF0Decoder) Decode(v ...interface{}) error {
+	var amf interface{}
+	var err error
+	for _, a := range v {
+		if d.ordered {
+			amf, err = ReadOrderedAMF(d.r)
+		} else {
+			amf, err = ReadAMF(d.r)
+		}
+		if err != nil {
+			return err
+		}
+		if a == nil {
+			continue
+		}
+		err = UnmarshalAMF(amf, a)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 结构的字段
+type amfField struct {
+	name      string
+	index     []int
+	omitEmpty bool
+}
+
+// 解析结构的字段，包括嵌入的结构
+func amfFields(t reflect.Type) []*amfField {
+	if v, ok := amfFieldsCache.Load(t); ok {
+		return v.([]*amfField)
+	}
+	var fields []*amfField
+	names := make(map[string]bool)
+	// 广度优先，外层的字段优先
+	current := []*amfField{{}}
+	types := []reflect.Type{t}
+	for len(types) > 0 {
+		var nextFields []*amfField
+		var nextTypes []reflect.Type
+		for i, st := range types {
+			for j := 0; j < st.NumField(); j++ {
+				f := st.Field(j)
+				tag := f.Tag.Get("amf")
+				if tag == "-" {
+					continue
+				}
+				name, opts := tag, ""
+				if k := strings.IndexByte(tag, ','); k >= 0 {
+					name, opts = tag[:k], tag[k+1:]
+				}
+				index := make([]int, len(current[i].index)+1)
+				copy(index, current[i].index)
+				index[len(index)-1] = j
+				ft := f.Type
+				if ft.Kind() == reflect.Ptr {
+					ft = ft.Elem()
+				}
+				if f.Anonymous && name == "" && ft.Kind() == reflect.Struct {
+					nextFields = append(nextFields, &amfField{index: index})
+					nextTypes = append(nextTypes, ft)
+					continue
+				}
+				if f.PkgPath != "" {
+					// 没有导出
+					continue
+				}
+				if name == "" {
+					name = f.Name
+				}
+				if names[name] {
+					continue
+				}
+				names[name] = true
+				fields = append(fields, &amfField{
+					name:      name,
+					index:     index,
+					omitEmpty: strings.Contains(opts, "omitempty"),
+				})
+			}
+		}
+		current, types = nextFields, nextTypes
+	}
+	amfFieldsCache.Store(t, fields)
+	return fields
+}
+
+// 查找字段，先区分大小写，再不区分
+func findAMFField(fields []*amfField, name string) *amfField {
+	for _, f := range fields {
+		if f.name == name {
+			return f
+		}
+	}
+	for _, f := range fields {
+		if strings.EqualFold(f.name, name) {
+			return f
+		}
+	}
+	return nil
+}
+
+// 将go的数据转换成可以直接使用WriteAMF的数据
+func MarshalAMF(v interface{}) (interface{}, error) {
+	return marshalAMFValue(reflect.ValueOf(v))
+}
+
+func marshalAMFValue(v reflect.Value) (interface{}, error) {
+	if !v.IsValid() {
+		return nil, nil
+	}
+	if v.Type().Implements(amfMarshalerType) {
+		if (v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface) && v.IsNil() {
+			return nil, nil
+		}
+		return v.Interface().(AMFMarshaler).MarshalAMF()
+	}
+	if v.Kind() != reflect.Ptr && v.CanAddr() && v.Addr().Type().Implements(amfMarshalerType) {
+		return v.Addr().Interface().(AMFMarshaler).MarshalAMF()
+	}
+	// amf的类型，直接返回
+	if v.CanInterface() {
+		switch a := v.Interface().(type) {
+		case Undefined, Unsupported, XMLDocument, XML, time.Time, *TypedObject, AVMPlus, []byte, OrderedObject, ECMAArray,
+			*AMF3Array, *AMF3Object, *AMF3VectorObject, *AMF3Dictionary, AMF3Externalizable:
+			return a, nil
+		}
+	}
+	switch v.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		if v.IsNil() {
+			return nil, nil
+		}
+		return marshalAMFValue(v.Elem())
+	case reflect.Struct:
+		// 按字段的顺序
+		var object OrderedObject
+		for _, f := range amfFields(v.Type()) {
+			fv, ok := fieldByIndex(v, f.index, false)
+			if !ok {
+				continue
+			}
+			if f.omitEmpty && isEmptyValue(fv) {
+				continue
+			}
+			a, err := marshalAMFValue(fv)
+			if err != nil {
+				return nil, err
+			}
+			object = append(object, AMFProperty{Name: f.name, Value: a})
+		}
+		if object == nil {
+			object = OrderedObject{}
+		}
+		return object, nil
+	case reflect.Map:
+		if v.Type().Key().Kind() != reflect.String {
+			break
+		}
+		if v.IsNil() {
+			return nil, nil
+		}
+		object := make(map[string]interface{}, v.Len())
+		iter := v.MapRange()
+		for iter.Next() {
+			a, err := marshalAMFValue(iter.Value())
+			if err != nil {
+				return nil, err
+			}
+			object[iter.Key().String()] = a
+		}
+		return object, nil
+	case reflect.Slice, reflect.Array:
+		if v.Kind() == reflect.Slice && v.IsNil() {
+			return nil, nil
+		}
+		array := make([]interface{}, v.Len())
+		for i := range array {
+			a, err := marshalAMFValue(v.Index(i))
+			if err != nil {
+				return nil, err
+			}
+			array[i] = a
+		}
+		return array, nil
+	case reflect.Bool:
+		return v.Bool(), nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(v.Int()), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return float64(v.Uint()), nil
+	case reflect.Float32, reflect.Float64:
+		return v.Float(), nil
+	case reflect.String:
+		return v.String(), nil
+	}
+	return nil, fmt.Errorf("unsupported amf data type <%s>", v.Type().String())
+}
+
+// 嵌入的结构是nil指针时，alloc为true则分配，否则返回false，
+// 没有导出的结构的指针不能分配，也返回false，这时v是这个指针
+func fieldByIndex(v reflect.Value, index []int, alloc bool) (reflect.Value, bool) {
+	for i, j := range index {
+		if i > 0 && v.Kind() == reflect.Ptr {
+			if v.IsNil() {
+				if !alloc || !v.CanSet() {
+					return v, false
+				}
+				v.Set(reflect.New(v.Type().Elem()))
+			}
+			v = v.Elem()
+		}
+		v = v.Field(j)
+	}
+	return v, true
+}
+
+func isEmptyValue(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Array, reflect.Map, reflect.Slice, reflect.String:
+		return v.Len() == 0
+	case reflect.Bool:
+		return !v.Bool()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return v.Int() == 0
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return v.Uint() == 0
+	case reflect.Float32, reflect.Float64:
+		return v.Float() == 0
+	case reflect.Interface, reflect.Ptr:
+		return v.IsNil()
+	}
+	return false
+}
+
+// 将ReadAMF返回的数据转换到v，v必须是指针
+func UnmarshalAMF(amf interface{}, v interface{}) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() {
+		return fmt.Errorf("unmarshal amf into non-pointer <%v>", reflect.TypeOf(v))
+	}
+	return unmarshalAMFValue(amf, rv.Elem())
+}
+
+func amfTypeError(amf interface{}, v reflect.Value) error {
+	return fmt.Errorf("cannot unmarshal amf <%T> into <%s>", amf, v.Type().String())
+}
+
+func unmarshalAMFValue(amf interface{}, v reflect.Value) error {
+	if v.Kind() != reflect.Ptr && v.CanAddr() && v.Addr().Type().Implements(amfUnmarshalerType) {
+		return v.Addr().Interface().(AMFUnmarshaler).UnmarshalAMF(amf)
+	}
+	switch amf.(type) {
+	case nil, Undefined:
+		v.Set(reflect.Zero(v.Type()))
+		return nil
+	}
+	switch v.Kind() {
+	case reflect.Ptr:
+		if v.IsNil() {
+			v.Set(reflect.New(v.Type().Elem()))
+		}
+		if v.Type().Implements(amfUnmarshalerType) {
+			return v.Interface().(AMFUnmarshaler).UnmarshalAMF(amf)
+		}
+		return unmarshalAMFValue(amf, v.Elem())
+	case reflect.Interface:
+		a := reflect.ValueOf(amf)
+		if !a.Type().AssignableTo(v.Type()) {
+			return amfTypeError(amf, v)
+		}
+		v.Set(a)
+		return nil
+	case reflect.Bool:
+		b, ok := amf.(bool)
+		if !ok {
+			return amfTypeError(amf, v)
+		}
+		v.SetBool(b)
+		return nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, ok := amfNumberValue(amf)
+		if !ok || v.OverflowInt(int64(n)) {
+			return amfTypeError(amf, v)
+		}
+		v.SetInt(int64(n))
+		return nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		n, ok := amfNumberValue(amf)
+		if !ok || n < 0 || v.OverflowUint(uint64(n)) {
+			return amfTypeError(amf, v)
+		}
+		v.SetUint(uint64(n))
+		return nil
+	case reflect.Float32, reflect.Float64:
+		n, ok := amfNumberValue(amf)
+		if !ok {
+			return amfTypeError(amf, v)
+		}
+		v.SetFloat(n)
+		return nil
+	case reflect.String:
+		switch s := amf.(type) {
+		case string:
+			v.SetString(s)
+		case XMLDocument:
+			v.SetString(string(s))
+		case XML:
+			v.SetString(string(s))
+		default:
+			return amfTypeError(amf, v)
+		}
+		return nil
+	case reflect.Struct:
+		if v.Type() == timeType {
+			t, ok := amf.(time.Time)
+			if !ok {
+				return amfTypeError(amf, v)
+			}
+			v.Set(reflect.ValueOf(t))
+			return nil
+		}
+		object, ok := amfObjectValue(amf)
+		if !ok {
+			return amfTypeError(amf, v)
+		}
+		fields := amfFields(v.Type())
+		for name, a := range object {
+			f := findAMFField(fields, name)
+			if f == nil {
+				continue
+			}
+			fv, ok := fieldByIndex(v, f.index, true)
+			if !ok {
+				return fmt.Errorf("'%s' cannot set embedded pointer to unexported struct <%s>", name, fv.Type().Elem().String())
+			}
+			err := unmarshalAMFValue(a, fv)
+			if err != nil {
+				return fmt.Errorf("'%s' %s", name, err.Error())
+			}
+		}
+		return nil
+	case reflect.Map:
+		if v.Type().Key().Kind() != reflect.String {
+			return amfTypeError(amf, v)
+		}
+		object, ok := amfObjectValue(amf)
+		if !ok {
+			return amfTypeError(amf, v)
+		}
+		if v.IsNil() {
+			v.Set(reflect.MakeMapWithSize(v.Type(), len(object)))
+		}
+		for name, a := range object {
+			ev := reflect.New(v.Type().Elem()).Elem()
+			err := unmarshalAMFValue(a, ev)
+			if err != nil {
+				return fmt.Errorf("'%s' %s", name, err.Error())
+			}
+			v.SetMapIndex(reflect.ValueOf(name).Convert(v.Type().Key()), ev)
+		}
+		return nil
+	case reflect.Slice, reflect.Array:
+		if b, ok := amf.([]byte); ok && v.Type().Elem().Kind() == reflect.Uint8 && v.Kind() == reflect.Slice {
+			v.SetBytes(append([]byte(nil), b...))
+			return nil
+		}
+		array, ok := amfArrayValue(amf)
+		if !ok {
+			return amfTypeError(amf, v)
+		}
+		n := array.Len()
+		if v.Kind() == reflect.Slice {
+			v.Set(reflect.MakeSlice(v.Type(), n, n))
+		} else if n > v.Len() {
+			n = v.Len()
+		}
+		for i := 0; i < n; i++ {
+			err := unmarshalAMFValue(array.Index(i).Interface(), v.Index(i))
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return amfTypeError(amf, v)
+}
+
+func amfNumberValue(amf interface{}) (float64, bool) {
+	switch n := amf.(type) {
+	case float64:
+		return n, true
+	case int32:
+		return float64(n), true
+	}
+	return 0, false
+}
+
+func amfObjectValue(amf interface{}) (map[string]interface{}, bool) {
+	switch o := amf.(type) {
+	case map[string]interface{}:
+		return o, true
+	case *TypedObject:
+		return o.Object, true
+	case *AMF3Object:
+		return o.Members, true
+	case *AMF3Array:
+		return o.Associative, true
+	case OrderedObject:
+		return o.Map(), true
+	case ECMAArray:
+		return o.Map(), true
+	}
+	return nil, false
+}
+
+func amfArrayValue(amf interface{}) (reflect.Value, bool) {
+	switch a := amf.(type) {
+	case []interface{}, []int32, []uint32, []float64:
+		return reflect.ValueOf(a), true
+	case *AMF3Array:
+		return reflect.ValueOf(a.Dense), true
+	case *AMF3VectorObject:
+		return reflect.ValueOf(a.Items), true
+	case AMF3Externalizable:
+		// ArrayCollection之类的
+		switch e := a.(type) {
+		case *AMF3ArrayCollection:
+			return amfArrayValue(e.Source)
+		}
+	}
+	return reflect.Value{}, false
+}
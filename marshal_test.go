@@ -0,0 +1,131 @@
+package rtmp
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+type testAMFMode string
+
+func (m testAMFMode) MarshalAMF() (interface{}, error) {
+	return strings.ToLower(string(m)), nil
+}
+
+func (m *testAMFMode) UnmarshalAMF(amf interface{}) error {
+	s, _ := amf.(string)
+	*m = testAMFMode(strings.ToUpper(s))
+	return nil
+}
+
+type testAMFBase struct {
+	App   string `amf:"app"`
+	TcURL string `amf:"tcUrl,omitempty"`
+}
+
+type testAMFConnect struct {
+	testAMFBase
+	ObjectEncoding uint8                  `amf:"objectEncoding"`
+	Fpad           *bool                  `amf:"fpad,omitempty"`
+	Codecs         []int                  `amf:"codecs"`
+	Args           map[string]interface{} `amf:"args"`
+	Mode           testAMFMode            `amf:"mode"`
+	Ignore         string                 `amf:"-"`
+	private        string
+}
+
+func TestMarshalAMF(t *testing.T) {
+	fpad := true
+	c1 := &testAMFConnect{
+		testAMFBase:    testAMFBase{App: "live"},
+		ObjectEncoding: 3,
+		Fpad:           &fpad,
+		Codecs:         []int{7, 10},
+		Args:           map[string]interface{}{"a": "A"},
+		Mode:           "LIVE",
+		Ignore:         "ignore",
+		private:        "private",
+	}
+	data, err := MarshalAMF0(c1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	amf, err := ReadAMF(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(amf, map[string]interface{}{
+		"app":            "live",
+		"objectEncoding": 3.0,
+		"fpad":           true,
+		"codecs":         []interface{}{7.0, 10.0},
+		"args":           map[string]interface{}{"a": "A"},
+		"mode":           "live",
+	}) {
+		t.Fatalf("%#v", amf)
+	}
+	var c2 testAMFConnect
+	err = UnmarshalAMF0(data, &c2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c1.Ignore = ""
+	c1.private = ""
+	if !reflect.DeepEqual(c1, &c2) {
+		t.Fatalf("%#v", c2)
+	}
+	// 多个值
+	var b bytes.Buffer
+	err = NewAMF0Encoder(&b).Encode("connect", 1, c1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var name string
+	var transactionID float64
+	var c3 *testAMFConnect
+	err = NewAMF0Decoder(&b).Decode(&name, &transactionID, &c3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name != "connect" || transactionID != 1 || c3.App != "live" {
+		t.FailNow()
+	}
+	// 类型错误
+	err = UnmarshalAMF0(data, &name)
+	if err == nil {
+		t.FailNow()
+	}
+}
+
+type testAMFInner struct {
+	A float64 `amf:"a"`
+}
+
+type testAMFOuter struct {
+	*testAMFInner
+	B float64 `amf:"b"`
+}
+
+func TestUnmarshalAMFEmbeddedPointer(t *testing.T) {
+	amf := map[string]interface{}{"a": float64(1), "b": float64(2)}
+	// 没有导出的指针是nil，不能分配
+	var o testAMFOuter
+	if UnmarshalAMF(amf, &o) == nil || o.testAMFInner != nil {
+		t.FailNow()
+	}
+	// 不是nil可以设置
+	o.testAMFInner = new(testAMFInner)
+	err := UnmarshalAMF(amf, &o)
+	if err != nil || o.A != 1 || o.B != 2 {
+		t.Fatal(err)
+	}
+	// 编码跳过nil
+	v, err := MarshalAMF(&testAMFOuter{B: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if o := v.(OrderedObject); len(o) != 1 || o[0].Name != "b" {
+		t.Fatal(v)
+	}
+}
@@ -57,8 +57,12 @@ func GetMessage() *Message {
 	return msg
 }
 
-// 回收缓存
+// 回收缓存，Shared不是nil则Release
 func PutMessage(msg *Message) {
+	if msg.Shared != nil {
+		msg.Shared.Release()
+		msg.Shared = nil
+	}
 	msgPool.Put(msg)
 }
 
@@ -99,11 +103,13 @@ func WriteMessage(writer io.Writer, chunkHeader *ChunkHeader, chunkSize uint32,
 }
 
 type Message struct {
+	CSID      uint32       // 消息所在的chunk stream
 	TypeID    uint8        // 消息类型
 	Timestamp uint32       // 时间戳
 	StreamID  uint32       // 消息属于的流
 	Length    uint32       // 消息的长度
 	Data      bytes.Buffer // 消息的数据
+	Shared    *SharedData  // 不是nil则发送它的数据，代替Data，只用于发送
 }
 
 func (m *Message) WriteB16(n uint16) {
@@ -0,0 +1,339 @@
+package rtmp
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"sync"
+)
+
+// 消息发送的优先级，值越小越优先
+const (
+	priorityControl = iota // 协议控制和用户控制消息
+	priorityCommand        // 命令和数据消息
+	priorityAudio          // 音频消息
+	priorityVideo          // 视频消息
+	priorityCount
+)
+
+const (
+	chunkSchedulerBatchSize  = 64 * 1024   // 一次系统调用最多写入的数据
+	chunkSchedulerBufferSize = 1024 * 1024 // 队列中音视频数据的上限
+)
+
+var (
+	errChunkSchedulerClosed = errors.New("chunk scheduler closed")
+)
+
+// 消息类型的发送优先级
+func messagePriority(typeID uint8) int {
+	switch typeID {
+	case ControlMessageSetChunkSize,
+		ControlMessageAbort,
+		ControlMessageAcknowledgement,
+		ControlMessageWindowAcknowledgementSize,
+		ControlMessageSetBandWidth,
+		UserControlMessage:
+		return priorityControl
+	case AudioMessage:
+		return priorityAudio
+	case VideoMessage, AggregateMessage:
+		return priorityVideo
+	default:
+		return priorityCommand
+	}
+}
+
+// 调度时，每个chunk stream的状态
+type chunkScheduleStream struct {
+	queue     []*Message  // 等待发送的消息，第一个是正在发送的
+	started   bool        // 第一个消息是否已经发送了第一个chunk
+	header    ChunkHeader // 第一个消息的header，之后的chunk使用fmt3
+	data      []byte      // 第一个消息没有发送的数据
+	shared    []byte      // 第一个消息是共享的，没有发送的chunk，包含header
+	chunkSize uint32      // 共享的chunk的chunk size
+}
+
+// 一个chunk在header缓存中的位置和数据
+type scheduledChunk struct {
+	header int
+	data   []byte
+}
+
+// 每个连接一个发送协程，按优先级交错发送多个chunk stream的chunk，
+// 避免大的关键帧阻塞控制消息和音频。
+// 每次调度的chunk合并成net.Buffers，使用一次系统调用(writev)写入。
+type ChunkScheduler struct {
+	w        io.Writer
+	lock     sync.Mutex
+	cond     *sync.Cond
+	closed   bool
+	err      error
+	done     chan struct{}
+	writer   ChunkWriter // 只使用header的状态和chunk size
+	streams  map[uint32]*chunkScheduleStream
+	active   [priorityCount][]*chunkScheduleStream // 有消息等待发送的chunk stream
+	buffered int                                   // 队列中的数据
+	headers  bytes.Buffer                          // 本次调度的chunk header
+	chunks   []scheduledChunk                      // 本次调度的chunk
+	sent     []*Message                            // 本次调度发送完的消息
+	buffs    net.Buffers
+}
+
+func NewChunkScheduler(w io.Writer) *ChunkScheduler {
+	s := &ChunkScheduler{
+		w:       w,
+		done:    make(chan struct{}),
+		streams: make(map[uint32]*chunkScheduleStream),
+	}
+	s.cond = sync.NewCond(&s.lock)
+	s.writer.chunkSize = ChunkSize
+	s.writer.streams = make(map[uint32]*chunkWriteStream)
+	go s.writeLoop()
+	return s
+}
+
+func (s *ChunkScheduler) ChunkSize() uint32 {
+	s.lock.Lock()
+	n := s.writer.chunkSize
+	s.lock.Unlock()
+	return n
+}
+
+// 发送SetChunkSize消息，在它之后发送的chunk使用新的chunk size
+func (s *ChunkScheduler) SetChunkSize(n uint32) error {
+	if n > MaxChunkSize {
+		n = MaxChunkSize
+	}
+	msg := GetMessage()
+	(&SetChunkSize{ChunkSize: n}).Encode(msg)
+	return s.Send(msg)
+}
+
+// 将消息加入发送队列，msg.CSID是0则使用消息类型默认的chunk stream。
+// 消息发送后会被回收，调用之后不能再使用msg。
+// 队列中的音视频数据过多时，发送音视频消息会阻塞。
+func (s *ChunkScheduler) Send(msg *Message) error {
+	p := messagePriority(msg.TypeID)
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for p >= priorityAudio && s.buffered >= chunkSchedulerBufferSize && !s.closed {
+		s.cond.Wait()
+	}
+	if s.closed {
+		PutMessage(msg)
+		if s.err != nil {
+			return s.err
+		}
+		return errChunkSchedulerClosed
+	}
+	csid := messageChunkStreamID(msg)
+	cs, ok := s.streams[csid]
+	if !ok {
+		cs = new(chunkScheduleStream)
+		s.streams[csid] = cs
+	}
+	cs.queue = append(cs.queue, msg)
+	if len(cs.queue) == 1 {
+		s.active[p] = append(s.active[p], cs)
+	}
+	s.buffered += len(msg.payload())
+	s.cond.Broadcast()
+	return nil
+}
+
+// 发送完队列中的消息，然后停止发送协程，不会关闭w
+func (s *ChunkScheduler) Close() error {
+	s.lock.Lock()
+	s.closed = true
+	s.cond.Broadcast()
+	s.lock.Unlock()
+	<-s.done
+	return s.err
+}
+
+// 发送协程
+func (s *ChunkScheduler) writeLoop() {
+	defer close(s.done)
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for {
+		for !s.pending() && !s.closed {
+			s.cond.Wait()
+		}
+		if !s.pending() {
+			return
+		}
+		s.schedule()
+		// 写的时候不需要锁，调度的状态只有这个协程使用
+		s.lock.Unlock()
+		buffs := s.buffs
+		_, err := buffs.WriteTo(s.w)
+		s.lock.Lock()
+		for i, msg := range s.sent {
+			s.buffered -= len(msg.payload())
+			PutMessage(msg)
+			s.sent[i] = nil
+		}
+		s.sent = s.sent[:0]
+		s.cond.Broadcast()
+		if err != nil {
+			s.err = err
+			s.closed = true
+			s.discard()
+			return
+		}
+	}
+}
+
+// 是否有消息等待发送
+func (s *ChunkScheduler) pending() bool {
+	for _, a := range s.active {
+		if len(a) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// 出错后回收队列中的消息
+func (s *ChunkScheduler) discard() {
+	for p, a := range s.active {
+		for i, cs := range a {
+			for j, msg := range cs.queue {
+				PutMessage(msg)
+				cs.queue[j] = nil
+			}
+			cs.queue = cs.queue[:0]
+			a[i] = nil
+		}
+		s.active[p] = a[:0]
+	}
+	s.buffered = 0
+}
+
+// 按优先级选择chunk，同一优先级的chunk stream轮流发送一个chunk，
+// 结果保存在s.buffs
+func (s *ChunkScheduler) schedule() {
+	s.headers.Reset()
+	s.chunks = s.chunks[:0]
+	size := 0
+	for p := 0; p < priorityCount && size < chunkSchedulerBatchSize; {
+		a := s.active[p]
+		if len(a) < 1 {
+			p++
+			continue
+		}
+		// 轮流一次
+		n := 0
+		for _, cs := range a {
+			size += s.scheduleChunk(cs)
+			if !cs.started {
+				// 发送完一个消息，下一个消息可能是其他优先级
+				if len(cs.queue) > 0 {
+					q := messagePriority(cs.queue[0].TypeID)
+					if q != p {
+						s.active[q] = append(s.active[q], cs)
+						continue
+					}
+				} else {
+					continue
+				}
+			}
+			a[n] = cs
+			n++
+		}
+		for i := n; i < len(a); i++ {
+			a[i] = nil
+		}
+		s.active[p] = a[:n]
+		// 有更高优先级的消息
+		for q := 0; q < p; q++ {
+			if len(s.active[q]) > 0 {
+				p = q
+				break
+			}
+		}
+	}
+	// header缓存已经不会变化了
+	headers := s.headers.Bytes()
+	s.buffs = s.buffs[:0]
+	for _, c := range s.chunks {
+		if c.header > 0 {
+			s.buffs = append(s.buffs, headers[:c.header])
+			headers = headers[c.header:]
+		}
+		if len(c.data) > 0 {
+			s.buffs = append(s.buffs, c.data)
+		}
+	}
+}
+
+// 发送cs第一个消息的一个chunk，返回数据的大小
+func (s *ChunkScheduler) scheduleChunk(cs *chunkScheduleStream) int {
+	if cs.shared != nil {
+		return s.scheduleSharedChunk(cs)
+	}
+	msg := cs.queue[0]
+	first := !cs.started
+	if first {
+		s.writer.messageHeader(msg)
+		cs.header = s.writer.header
+		cs.data = msg.payload()
+		cs.started = true
+	} else {
+		cs.header.FMT = ChunkFmt3
+	}
+	n := s.headers.Len()
+	cs.header.Write(&s.headers)
+	data := cs.data[:chunkLen(s.writer.chunkSize, len(cs.data))]
+	cs.data = cs.data[len(data):]
+	s.chunks = append(s.chunks, scheduledChunk{header: s.headers.Len() - n, data: data})
+	if len(cs.data) < 1 {
+		s.finishMessage(cs)
+	} else if first && msg.Shared != nil && cs.header.ExtendedTimestamp == 0 {
+		// 之后的chunk使用共享的数据，不用再生成header
+		cs.chunkSize = s.writer.chunkSize
+		cs.shared = msg.Shared.continuation(cs.header.CSID, cs.chunkSize)
+	}
+	return s.headers.Len() - n + len(data)
+}
+
+// 发送共享的一个chunk，header已经在数据里
+func (s *ChunkScheduler) scheduleSharedChunk(cs *chunkScheduleStream) int {
+	if cs.chunkSize != s.writer.chunkSize {
+		// 发送的时候修改了chunk size，剩下的数据重新生成chunk
+		cs.shared = nil
+		return s.scheduleChunk(cs)
+	}
+	// fmt3的header是1到3个字节
+	n := 1
+	if cs.header.CSID >= 64 {
+		n++
+		if cs.header.CSID > 319 {
+			n++
+		}
+	}
+	data := chunkLen(cs.chunkSize, len(cs.data))
+	n += data
+	s.chunks = append(s.chunks, scheduledChunk{data: cs.shared[:n]})
+	cs.shared = cs.shared[n:]
+	cs.data = cs.data[data:]
+	if len(cs.data) < 1 {
+		s.finishMessage(cs)
+	}
+	return n
+}
+
+// cs的第一个消息发送完了
+func (s *ChunkScheduler) finishMessage(cs *chunkScheduleStream) {
+	msg := cs.queue[0]
+	cs.started = false
+	cs.data = nil
+	cs.shared = nil
+	cs.queue[0] = nil
+	cs.queue = cs.queue[1:]
+	s.writer.applyChunkSize(msg)
+	s.sent = append(s.sent, msg)
+}
@@ -0,0 +1,88 @@
+package rtmp
+
+import (
+	"bytes"
+	"sync"
+	"testing"
+)
+
+type testGateWriter struct {
+	once    sync.Once
+	started chan struct{}
+	gate    chan struct{}
+	b       bytes.Buffer
+}
+
+func (w *testGateWriter) Write(b []byte) (int, error) {
+	w.once.Do(func() {
+		close(w.started)
+	})
+	<-w.gate
+	return w.b.Write(b)
+}
+
+func testSchedulerMessage(csid uint32, typeID uint8, streamID uint32, data []byte) *Message {
+	msg := GetMessage()
+	msg.CSID = csid
+	msg.TypeID = typeID
+	msg.StreamID = streamID
+	msg.Timestamp = 0
+	msg.Data.Write(data)
+	return msg
+}
+
+func TestChunkScheduler(t *testing.T) {
+	w := &testGateWriter{started: make(chan struct{}), gate: make(chan struct{})}
+	s := NewChunkScheduler(w)
+	video := bytes.Repeat([]byte{9}, chunkSchedulerBatchSize*3)
+	audio := bytes.Repeat([]byte{8}, 300)
+	err := s.Send(testSchedulerMessage(0, VideoMessage, 1, video))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 第一次写入阻塞的时候，加入其他消息
+	<-w.started
+	err = s.Send(testSchedulerMessage(0, AudioMessage, 1, audio))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.SetChunkSize(1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.Send(testSchedulerMessage(0, CommandMessageAMF0, 0, []byte{1, 2, 3}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	close(w.gate)
+	err = s.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Send(testSchedulerMessage(0, AudioMessage, 1, audio)) != errChunkSchedulerClosed {
+		t.FailNow()
+	}
+	// 控制，命令和音频消息在视频之前完成
+	r := NewChunkReader(&w.b)
+	for _, m := range []struct {
+		typeID uint8
+		length int
+	}{
+		{ControlMessageSetChunkSize, 4},
+		{CommandMessageAMF0, 3},
+		{AudioMessage, len(audio)},
+		{VideoMessage, len(video)},
+	} {
+		msg, err := r.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if msg.TypeID != m.typeID || msg.Data.Len() != m.length {
+			t.Fatalf("type <%d> length <%d>", msg.TypeID, msg.Data.Len())
+		}
+		PutMessage(msg)
+	}
+	if r.ChunkSize() != 1024 || w.b.Len() != 0 {
+		t.FailNow()
+	}
+}
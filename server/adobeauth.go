@@ -0,0 +1,170 @@
+package server
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/qq51529210/rtmp"
+)
+
+const (
+	authChallengeTimeout = time.Minute
+)
+
+// adobe和llnw验证的用户名和密码
+type CredentialStore interface {
+	// vhost的app的user的密码，不存在返回false
+	Password(vhost, app, user string) (string, bool)
+}
+
+// 所有的vhost和app使用相同的用户，user:password
+type Credentials map[string]string
+
+func (c Credentials) Password(vhost, app, user string) (string, bool) {
+	password, ok := c[user]
+	return password, ok
+}
+
+// 拒绝connect，错误的内容是_error的description，客户端根据它继续验证
+type connectAuthError string
+
+func (e connectAuthError) Error() string {
+	return string(e)
+}
+
+// 发出的challenge，等待客户端的response
+type authChallenge struct {
+	authMod   string
+	user      string
+	salt      string
+	challenge string
+	expire    time.Time
+}
+
+// 客户端每一步都会重新连接，所以challenge保存在Server
+type authChallenges struct {
+	lock sync.Mutex
+	m    map[string]*authChallenge
+}
+
+func (a *authChallenges) add(key string, c *authChallenge) {
+	now := time.Now()
+	c.expire = now.Add(authChallengeTimeout)
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if a.m == nil {
+		a.m = make(map[string]*authChallenge)
+	}
+	// 删除过期的
+	for k, v := range a.m {
+		if now.After(v.expire) {
+			delete(a.m, k)
+		}
+	}
+	a.m[key] = c
+}
+
+// 返回并删除key的challenge，每个challenge只能使用一次
+func (a *authChallenges) take(key string) *authChallenge {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	c, ok := a.m[key]
+	if !ok {
+		return nil
+	}
+	delete(a.m, key)
+	if time.Now().After(c.expire) {
+		return nil
+	}
+	return c
+}
+
+// 随机字符串，不包含url需要编码的字符
+func randomString(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// 验证使用的用户和authmod，不需要验证返回nil
+func (c *Conn) credentials() (CredentialStore, string) {
+	app, err := c.appConfig()
+	if err != nil {
+		return nil, ""
+	}
+	auth := c.vhost.auth(app)
+	authMod := auth.AuthMod
+	if authMod == "" {
+		authMod = rtmp.AuthModAdobe
+	}
+	if c.server.Credentials != nil {
+		return c.server.Credentials, authMod
+	}
+	if len(auth.Users) > 0 {
+		return Credentials(auth.Users), authMod
+	}
+	return nil, ""
+}
+
+// adobe或者llnw验证，客户端先connect不带参数，然后带上authmod和user，
+// 服务端返回challenge，最后客户端带上response
+func (c *Conn) checkCredentials(cmd *rtmp.ConnectCommand) error {
+	store, authMod := c.credentials()
+	if store == nil {
+		return nil
+	}
+	// 参数在app或者tcUrl后面
+	var params map[string]string
+	if i := strings.IndexByte(cmd.CommandObject.App, '?'); i >= 0 {
+		params = rtmp.ParseAuthParams(cmd.CommandObject.App[i:])
+	} else if i = strings.IndexByte(cmd.CommandObject.TcURL, '?'); i >= 0 {
+		params = rtmp.ParseAuthParams(cmd.CommandObject.TcURL[i:])
+	}
+	user := params["user"]
+	if params["authmod"] == "" || user == "" {
+		return connectAuthError(fmt.Sprintf("[ AccessManager.Reject ] : [ code=403 need auth; authmod=%s ] : ", authMod))
+	}
+	authMod = params["authmod"]
+	switch authMod {
+	case rtmp.AuthModAdobe:
+		if params["response"] == "" {
+			// 不存在的用户也发送challenge，验证的时候才失败
+			ch := &authChallenge{authMod: authMod, user: user, salt: randomString(6), challenge: randomString(6)}
+			opaque := randomString(6)
+			c.server.challenges.add(opaque, ch)
+			return connectAuthError(fmt.Sprintf("[ AccessManager.Reject ] : [ authmod=%s ] : ?reason=needauth&user=%s&salt=%s&challenge=%s&opaque=%s",
+				authMod, user, ch.salt, ch.challenge, opaque))
+		}
+		ch := c.server.challenges.take(params["opaque"])
+		if ch != nil && ch.authMod == authMod && ch.user == user {
+			password, ok := store.Password(c.connectKey.Vhost, c.connectKey.App, user)
+			response := rtmp.AdobeAuthResponse(user, password, ch.salt, params["opaque"], ch.challenge, params["challenge"])
+			if ok && subtle.ConstantTimeCompare([]byte(response), []byte(params["response"])) == 1 {
+				return nil
+			}
+		}
+		return connectAuthError(fmt.Sprintf("[ AccessManager.Reject ] : [ authmod=%s ] : ?reason=authfailed&opaque=%s", authMod, params["opaque"]))
+	case rtmp.AuthModLLNW:
+		if params["response"] == "" {
+			nonce := randomString(6)
+			c.server.challenges.add(nonce, &authChallenge{authMod: authMod, user: user})
+			return connectAuthError(fmt.Sprintf("[ AccessManager.Reject ] : [ authmod=%s ] : ?reason=needauth&user=%s&nonce=%s", authMod, user, nonce))
+		}
+		ch := c.server.challenges.take(params["nonce"])
+		if ch != nil && ch.authMod == authMod && ch.user == user {
+			password, ok := store.Password(c.connectKey.Vhost, c.connectKey.App, user)
+			response := rtmp.LLNWAuthResponse(user, password, c.connectKey.App, params["nonce"], params["cn"])
+			if ok && subtle.ConstantTimeCompare([]byte(response), []byte(params["response"])) == 1 {
+				return nil
+			}
+		}
+		return connectAuthError(fmt.Sprintf("[ AccessManager.Reject ] : [ authmod=%s ] : ?reason=authfailed", authMod))
+	default:
+		return connectAuthError(fmt.Sprintf("[ AccessManager.Reject ] : [ authmod=%s ] : ?reason=unsupported", authMod))
+	}
+}
@@ -0,0 +1,60 @@
+package server
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/qq51529210/rtmp"
+)
+
+func TestServerAdobeAuth(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.Auth.Users = map[string]string{"user": "pass"}
+	cfg.Apps = map[string]*AppConfig{
+		"live": {},
+		"llnw": {Auth: &AuthConfig{Users: map[string]string{"user": "pass2"}, AuthMod: rtmp.AuthModLLNW}},
+	}
+	err := cfg.Validate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := new(Server)
+	s.SetConfig(cfg)
+	go s.Serve(context.Background(), ln)
+	defer s.Shutdown(context.Background())
+	host := ln.Addr().String()
+	for _, url := range []string{
+		"rtmp://user:pass@" + host + "/live",
+		"rtmp://user:pass2@" + host + "/llnw",
+	} {
+		c, err := rtmp.DialAndConnect(url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = c.CreateStream()
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = c.Publish("test", "live")
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.Close()
+	}
+	for _, url := range []string{
+		"rtmp://" + host + "/live",
+		"rtmp://user:pass2@" + host + "/live",
+		"rtmp://other:pass@" + host + "/live",
+		"rtmp://user:pass@" + host + "/llnw",
+	} {
+		_, err = rtmp.DialAndConnect(url)
+		if err == nil {
+			t.Fatal(url)
+		}
+	}
+}
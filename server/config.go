@@ -0,0 +1,356 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/qq51529210/rtmp"
+)
+
+const (
+	DefaultListen             = "127.0.0.1:1935"
+	DefaultVersion            = 100
+	DefaultChunkSize          = 4 * 1024
+	DefaultWindowAckSize      = 1024 * 5000
+	DefaultPeerBandwidth      = 1024 * 500
+	DefaultPeerBandwidthLimit = 2
+	DefaultHandshakeTimeout   = 10 * time.Second
+	DefaultShutdownTimeout    = 10 * time.Second
+	// 没有配置的vhost使用的配置，没有配置任何vhost时，所有的连接都属于它
+	DefaultVhost = "__defaultVhost__"
+)
+
+// 时间间隔，json中使用字符串，比如"10s"，"1m30s"
+type Duration time.Duration
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	err := json.Unmarshal(b, &s)
+	if err != nil {
+		return err
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+// 服务的配置，使用LoadConfig读取json文件
+type Config struct {
+	Listen             []string              `json:"listen"`             // rtmp监听的地址
+	Version            uint32                `json:"version"`            // 握手的版本
+	ChunkSize          uint32                `json:"chunkSize"`          // 发送的chunk size
+	WindowAckSize      uint32                `json:"windowAckSize"`      // Window Acknowledgement Size
+	PeerBandwidth      uint32                `json:"peerBandwidth"`      // Set Peer Bandwidth
+	PeerBandwidthLimit byte                  `json:"peerBandwidthLimit"` // 0硬限制，1软限制，2动态
+	Timeout            TimeoutConfig         `json:"timeout"`
+	Apps               map[string]*AppConfig `json:"apps"`       // 空则接受所有的app，否则只接受列出的app
+	MaxStreams         int                   `json:"maxStreams"` // 推流的最大数量，0不限制
+	Log                LogConfig             `json:"log"`
+	Record             RecordConfig          `json:"record"`
+	HTTP               HTTPConfig            `json:"http"`
+	Auth               AuthConfig            `json:"auth"`
+	Hooks              HooksConfig           `json:"hooks"`
+	Access             AccessConfig          `json:"access"`
+	Limit              LimitConfig           `json:"limit"`
+	// 虚拟主机，使用tcUrl的host或者query参数vhost查找，
+	// 空则使用上面的apps，maxStreams，record，auth，hooks和access，
+	// 否则不接受没有配置的vhost，除非配置了DefaultVhost
+	Vhosts map[string]*VhostConfig `json:"vhosts"`
+}
+
+// 虚拟主机的配置，每个vhost的流是隔离的
+type VhostConfig struct {
+	ChunkSize  uint32                `json:"chunkSize"`  // 0使用Config.ChunkSize
+	Apps       map[string]*AppConfig `json:"apps"`       // 空则接受所有的app，否则只接受列出的app
+	MaxStreams int                   `json:"maxStreams"` // 推流的最大数量，0不限制
+	Record     RecordConfig          `json:"record"`
+	Auth       AuthConfig            `json:"auth"`
+	Hooks      HooksConfig           `json:"hooks"`
+	Access     AccessConfig          `json:"access"`
+}
+
+type TimeoutConfig struct {
+	Handshake Duration `json:"handshake"` // 握手的超时
+	Read      Duration `json:"read"`      // 读取一个消息的超时，0不超时
+	Shutdown  Duration `json:"shutdown"`  // 优雅关闭的超时，之后直接关闭连接
+}
+
+type AppConfig struct {
+	DisablePublish bool            `json:"disablePublish"` // 不允许推流
+	DisablePlay    bool            `json:"disablePlay"`    // 不允许播放
+	Record         bool            `json:"record"`         // 推流保存到Record.Dir
+	Auth           *AuthConfig     `json:"auth"`           // 不是null则代替vhost的auth
+	Access         *AccessConfig   `json:"access"`         // 不是null则代替vhost的access
+	GOPCache       GOPCacheConfig  `json:"gopCache"`
+	PlayQueue      PlayQueueConfig `json:"playQueue"`
+}
+
+type LogConfig struct {
+	Level string `json:"level"` // debug，error或者off
+}
+
+type RecordConfig struct {
+	Dir string `json:"dir"` // 保存flv文件的目录，文件是dir/app/name-unix时间.flv
+}
+
+type HTTPConfig struct {
+	Listen string `json:"listen"` // http-flv监听的地址，空则不启用
+}
+
+// token是推流和播放时，流名称或者tcUrl的query参数token，空则不验证。
+// keys不是空则还要验证SignToken生成的参数，可以配置多个key用于轮换。
+// users不是空则connect需要adobe或者llnw验证
+type AuthConfig struct {
+	PublishToken      string            `json:"publishToken"`
+	PlayToken         string            `json:"playToken"`
+	Keys              []string          `json:"keys"`
+	AllowUnsignedPlay bool              `json:"allowUnsignedPlay"` // 播放不验证签名
+	Users             map[string]string `json:"users"`             // user:password
+	AuthMod           string            `json:"authMod"`           // 要求客户端使用的验证，adobe或者llnw，默认是adobe
+}
+
+func (c *AuthConfig) validate(prefix string) error {
+	switch c.AuthMod {
+	case "", rtmp.AuthModAdobe, rtmp.AuthModLLNW:
+	default:
+		return fmt.Errorf("%s.'auth'.'authMod' <%s> unsupported", prefix, c.AuthMod)
+	}
+	for _, key := range c.Keys {
+		if key == "" {
+			return fmt.Errorf("%s.'auth'.'keys' empty key", prefix)
+		}
+	}
+	return nil
+}
+
+// 默认的配置
+func DefaultConfig() *Config {
+	return &Config{
+		Listen:             []string{DefaultListen},
+		Version:            DefaultVersion,
+		ChunkSize:          DefaultChunkSize,
+		WindowAckSize:      DefaultWindowAckSize,
+		PeerBandwidth:      DefaultPeerBandwidth,
+		PeerBandwidthLimit: DefaultPeerBandwidthLimit,
+		Timeout: TimeoutConfig{
+			Handshake: Duration(DefaultHandshakeTimeout),
+			Shutdown:  Duration(DefaultShutdownTimeout),
+		},
+		Log: LogConfig{Level: "error"},
+	}
+}
+
+// 读取json配置文件，没有的字段使用DefaultConfig的值，然后检查
+func LoadConfig(name string) (*Config, error) {
+	b, err := ioutil.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	cfg := DefaultConfig()
+	err = json.Unmarshal(b, cfg)
+	if err != nil {
+		return nil, fmt.Errorf("config <%s> %s", name, err.Error())
+	}
+	err = cfg.Validate()
+	if err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// 检查配置的值
+func (c *Config) Validate() error {
+	if len(c.Listen) < 1 {
+		return fmt.Errorf("config.'listen' empty")
+	}
+	for _, addr := range c.Listen {
+		_, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			return fmt.Errorf("config.'listen' <%s> %s", addr, err.Error())
+		}
+	}
+	if c.ChunkSize < rtmp.ChunkSize || c.ChunkSize > rtmp.MaxChunkSize {
+		return fmt.Errorf("config.'chunkSize' <%d> out of range [%d,%d]", c.ChunkSize, rtmp.ChunkSize, rtmp.MaxChunkSize)
+	}
+	if c.WindowAckSize < 1 {
+		return fmt.Errorf("config.'windowAckSize' <%d> invalid", c.WindowAckSize)
+	}
+	if c.PeerBandwidth < 1 {
+		return fmt.Errorf("config.'peerBandwidth' <%d> invalid", c.PeerBandwidth)
+	}
+	if c.PeerBandwidthLimit > 2 {
+		return fmt.Errorf("config.'peerBandwidthLimit' <%d> invalid", c.PeerBandwidthLimit)
+	}
+	if c.Timeout.Handshake < 0 || c.Timeout.Read < 0 || c.Timeout.Shutdown < 0 {
+		return fmt.Errorf("config.'timeout' negative")
+	}
+	err := validateApps("config", c.Apps, c.MaxStreams, c.Record.Dir)
+	if err != nil {
+		return err
+	}
+	err = c.Hooks.validate("config")
+	if err != nil {
+		return err
+	}
+	err = c.Auth.validate("config")
+	if err != nil {
+		return err
+	}
+	err = c.Access.validate("config")
+	if err != nil {
+		return err
+	}
+	err = c.Limit.validate()
+	if err != nil {
+		return err
+	}
+	for name, vhost := range c.Vhosts {
+		if name == "" || strings.ContainsAny(name, "/?") {
+			return fmt.Errorf("config.'vhosts' <%s> invalid name", name)
+		}
+		if vhost == nil {
+			return fmt.Errorf("config.'vhosts'.'%s' null", name)
+		}
+		if vhost.ChunkSize != 0 && (vhost.ChunkSize < rtmp.ChunkSize || vhost.ChunkSize > rtmp.MaxChunkSize) {
+			return fmt.Errorf("config.'vhosts'.'%s'.'chunkSize' <%d> out of range [%d,%d]", name, vhost.ChunkSize, rtmp.ChunkSize, rtmp.MaxChunkSize)
+		}
+		prefix := fmt.Sprintf("config.'vhosts'.'%s'", name)
+		err = validateApps(prefix, vhost.Apps, vhost.MaxStreams, vhost.Record.Dir)
+		if err != nil {
+			return err
+		}
+		err = vhost.Hooks.validate(prefix)
+		if err != nil {
+			return err
+		}
+		err = vhost.Auth.validate(prefix)
+		if err != nil {
+			return err
+		}
+		err = vhost.Access.validate(prefix)
+		if err != nil {
+			return err
+		}
+	}
+	if _, ok := logLevels[c.Log.Level]; !ok {
+		return fmt.Errorf("config.'log'.'level' <%s> invalid", c.Log.Level)
+	}
+	if c.HTTP.Listen != "" {
+		_, _, err := net.SplitHostPort(c.HTTP.Listen)
+		if err != nil {
+			return fmt.Errorf("config.'http'.'listen' <%s> %s", c.HTTP.Listen, err.Error())
+		}
+	}
+	return nil
+}
+
+func validateApps(prefix string, apps map[string]*AppConfig, maxStreams int, recordDir string) error {
+	if maxStreams < 0 {
+		return fmt.Errorf("%s.'maxStreams' <%d> invalid", prefix, maxStreams)
+	}
+	for name, app := range apps {
+		if name == "" || strings.ContainsAny(name, "/?") {
+			return fmt.Errorf("%s.'apps' <%s> invalid name", prefix, name)
+		}
+		if app == nil {
+			return fmt.Errorf("%s.'apps'.'%s' null", prefix, name)
+		}
+		if app.Record && recordDir == "" {
+			return fmt.Errorf("%s.'apps'.'%s'.'record' without %s.'record'.'dir'", prefix, name, prefix)
+		}
+		if app.Auth != nil {
+			err := app.Auth.validate(fmt.Sprintf("%s.'apps'.'%s'", prefix, name))
+			if err != nil {
+				return err
+			}
+		}
+		err := app.GOPCache.validate(fmt.Sprintf("%s.'apps'.'%s'", prefix, name))
+		if err != nil {
+			return err
+		}
+		err = app.PlayQueue.validate(fmt.Sprintf("%s.'apps'.'%s'", prefix, name))
+		if err != nil {
+			return err
+		}
+		if app.Access != nil {
+			err := app.Access.validate(fmt.Sprintf("%s.'apps'.'%s'", prefix, name))
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// 查找host的vhost，返回vhost的名称和配置，没有找到返回错误，
+// c是nil返回DefaultVhost和空的配置
+func (c *Config) vhost(host string) (string, *VhostConfig, error) {
+	if c == nil {
+		return DefaultVhost, &VhostConfig{}, nil
+	}
+	if len(c.Vhosts) < 1 {
+		return DefaultVhost, &VhostConfig{
+			ChunkSize:  c.ChunkSize,
+			Apps:       c.Apps,
+			MaxStreams: c.MaxStreams,
+			Record:     c.Record,
+			Auth:       c.Auth,
+			Hooks:      c.Hooks,
+			Access:     c.Access,
+		}, nil
+	}
+	name := host
+	vhost, ok := c.Vhosts[name]
+	if !ok {
+		name = DefaultVhost
+		vhost, ok = c.Vhosts[name]
+		if !ok {
+			return "", nil, fmt.Errorf("vhost <%s> not found", host)
+		}
+	}
+	if vhost.ChunkSize == 0 {
+		v := *vhost
+		v.ChunkSize = c.ChunkSize
+		vhost = &v
+	}
+	return name, vhost, nil
+}
+
+// app的配置，没有配置Apps返回默认的配置，没有找到返回错误
+func (c *VhostConfig) app(name string) (*AppConfig, error) {
+	if len(c.Apps) < 1 {
+		return &AppConfig{}, nil
+	}
+	app, ok := c.Apps[name]
+	if !ok {
+		return nil, fmt.Errorf("app <%s> not found", name)
+	}
+	return app, nil
+}
+
+// app的验证配置
+func (c *VhostConfig) auth(app *AppConfig) *AuthConfig {
+	if app.Auth != nil {
+		return app.Auth
+	}
+	return &c.Auth
+}
+
+// app的访问规则
+func (c *VhostConfig) access(app *AppConfig) *AccessConfig {
+	if app.Access != nil {
+		return app.Access
+	}
+	return &c.Access
+}
@@ -0,0 +1,68 @@
+package server
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rtmp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	name := filepath.Join(dir, "config.json")
+	err = ioutil.WriteFile(name, []byte(`{
+	"listen": [":1935", "127.0.0.1:1936"],
+	"chunkSize": 60000,
+	"timeout": {"read": "30s"},
+	"apps": {"live": {"record": true}, "vod": {"disablePublish": true}},
+	"record": {"dir": "/tmp"},
+	"log": {"level": "debug"}
+}`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := LoadConfig(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cfg.Listen) != 2 || cfg.ChunkSize != 60000 ||
+		time.Duration(cfg.Timeout.Read) != 30*time.Second ||
+		time.Duration(cfg.Timeout.Handshake) != DefaultHandshakeTimeout ||
+		cfg.WindowAckSize != DefaultWindowAckSize ||
+		!cfg.Apps["live"].Record || !cfg.Apps["vod"].DisablePublish {
+		t.FailNow()
+	}
+	_, vhost, err := cfg.vhost("example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = vhost.app("other"); err == nil {
+		t.FailNow()
+	}
+	// 检查
+	for _, f := range []func(*Config){
+		func(c *Config) { c.Listen = nil },
+		func(c *Config) { c.Listen = []string{"1935"} },
+		func(c *Config) { c.ChunkSize = 1 },
+		func(c *Config) { c.PeerBandwidthLimit = 3 },
+		func(c *Config) { c.Timeout.Read = -1 },
+		func(c *Config) { c.Apps = map[string]*AppConfig{"a/b": {}} },
+		func(c *Config) { c.Apps = map[string]*AppConfig{"live": {Record: true}} },
+		func(c *Config) { c.Log.Level = "info" },
+		func(c *Config) { c.HTTP.Listen = "8080" },
+	} {
+		cfg := DefaultConfig()
+		f(cfg)
+		if cfg.Validate() == nil {
+			t.Fatal(cfg)
+		}
+	}
+	if DefaultConfig().Validate() != nil {
+		t.FailNow()
+	}
+}
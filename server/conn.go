@@ -1,16 +1,14 @@
-package main
+package server
 
 import (
-	"bytes"
-	"encoding/binary"
+	"context"
 	"fmt"
-	"io"
-	"net/url"
-	"path"
-	"reflect"
+	"net"
+	"strconv"
 	"sync"
+	"sync/atomic"
+	"time"
 
-	"github.com/qq51529210/log"
 	"github.com/qq51529210/rtmp"
 )
 
@@ -25,299 +23,320 @@ func init() {
 	}
 }
 
+// 一个客户端连接
 type Conn struct {
+	id                    uint64
 	server                *Server
-	reader                io.Reader
-	writer                io.Writer
-	readMessage           map[uint32]*rtmp.Message
-	readChunkSize         uint32           // 接收消息的一个chunk的大小
-	writeChunkSize        uint32           // 发送消息的一个chunk的大小
-	syncChunkHeader       rtmp.ChunkHeader // 同步消息使用
-	syncMessageBuffer     bytes.Buffer     // 同步消息缓存，以便一次发出多条
-	acknowledgement       uint32           // 收到的消息数据的大小
-	windowAcknowledgeSize uint32           // 接收消息的值
-	bandWidth             uint32           // 接收消息的值
-	bandWidthLimit        byte             // 接收消息的值
-	connectUrl            *url.URL         // 接收消息的值
-	streamID              uint32           // createStream递增
-	publishStream         *Stream          // 接收消息的值
-	receiveVideo          bool             // 接收消息的值
-	receiveAudio          bool             // 接收消息的值
-	playChan              chan *StreamData // 可以播放的数据
-	vts                   uint32
-	ats                   uint32
-}
-
-// 播放，循环发送音视频数据
-func (c *Conn) playLoop(stream *Stream) {
-	defer stream.RemovePlayConn(c)
-	c.playChan = make(chan *StreamData, 1)
-	stream.AddPlayConn(c)
-	var err error
-	var chunk rtmp.ChunkHeader
-	var lastVideoTimestap uint32
-	var lastAudioTimestap uint32
-	var lastVideoLength uint32
-	var lastAudioLength uint32
-	var buff bytes.Buffer
-	chunk.MessageStreamID = c.streamID
-	// 先发送h264的sps&pps
-	chunk.CSID = rtmp.VideoMessageChunkStreamID
-	chunk.MessageTypeID = rtmp.VideoMessage
-	chunk.MessageLength = uint32(stream.avc.data.Len())
-	chunk.FMT = rtmp.ChunkFmt0
-	rtmp.WriteMessage(&buff, &chunk, c.writeChunkSize, stream.avc.data.Bytes())
-	_, err = c.writer.Write(buff.Bytes())
-	if err != nil {
-		log.Error(err)
-		return
+	conn                  net.Conn
+	handler               Handler
+	reader                *rtmp.ChunkReader
+	writer                *rtmp.ChunkScheduler
+	transactions          *rtmp.TransactionManager // 服务端主动的调用和客户端的响应
+	syncMessages          []*rtmp.Message          // 同步消息缓存，以便一次发出多条
+	acknowledgement       uint32                   // 上一次ack时收到的字节数
+	windowAcknowledgeSize uint32                   // 接收消息的值
+	bandWidth             uint32                   // 接收消息的值
+	bandWidthLimit        byte                     // 接收消息的值
+	connect               *rtmp.ConnectCommand     // 接收消息的值
+	connectKey            *StreamKey               // connect的vhost，app和query
+	vhost                 *VhostConfig             // connect的vhost的配置
+	objectEncoding        float64                  // 接收消息的值，0或者3
+	streamID              uint32                   // createStream递增
+	publishStream         *Stream                  // 接收消息的值
+	publishKey            *StreamKey               // 推流的key
+	receiveVideo          int32                    // 接收消息的值，playLoop读取
+	receiveAudio          int32                    // 接收消息的值，playLoop读取
+	subscriber            *subscriber              // 播放的队列
+	playStream            *Stream                  // 正在播放的流
+	paused                int32                    // 播放暂停，playLoop读取
+	playing               int32                    // playLoop在运行，同时只能有一个
+	closed                chan struct{}            // 连接结束时关闭
+	config                *Config                  // 连接时服务的配置，可能是nil
+	version               uint32                   // 握手的版本
+	handshakeTimeout      time.Duration            // 握手的超时
+	readTimeout           time.Duration            // 读取一个消息的超时
+	serverWindowAckSize   uint32                   // 发送的Window Acknowledgement Size
+	serverBandWidth       uint32                   // 发送的Set Peer Bandwidth
+	serverBandWidthLimit  byte                     // 发送的Set Peer Bandwidth
+	serverChunkSize       uint32                   // 发送的Set Chunk Size
+}
+
+// 服务分配的id，从1开始递增
+func (c *Conn) ID() uint64 {
+	return c.id
+}
+
+func (c *Conn) Server() *Server {
+	return c.server
+}
+
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.conn.RemoteAddr()
+}
+
+// 客户端的ip
+func (c *Conn) remoteIP() string {
+	return addrIP(c.conn.RemoteAddr())
+}
+
+// 客户端的connect命令，connect之前是nil
+func (c *Conn) ConnectCommand() *rtmp.ConnectCommand {
+	return c.connect
+}
+
+// connect的vhost，app和query，connect之前是nil
+func (c *Conn) ConnectKey() *StreamKey {
+	return c.connectKey
+}
+
+// 播放的统计，没有播放返回false
+func (c *Conn) PlayStats() (PlayStats, bool) {
+	if c.subscriber == nil {
+		return PlayStats{}, false
 	}
-	// acc
-	chunk.CSID = rtmp.AudioMessageChunkStreamID
-	chunk.MessageTypeID = rtmp.AudioMessage
-	chunk.MessageLength = uint32(stream.acc.data.Len())
-	chunk.FMT = rtmp.ChunkFmt0
-	buff.Reset()
-	rtmp.WriteMessage(&buff, &chunk, c.writeChunkSize, stream.acc.data.Bytes())
-	_, err = c.writer.Write(buff.Bytes())
-	if err != nil {
-		log.Error(err)
+	return c.subscriber.stats(), true
+}
+
+// 正在推的流，没有推流返回nil
+func (c *Conn) PublishKey() *StreamKey {
+	return c.publishKey
+}
+
+// 调用客户端的方法，等待_result
+func (c *Conn) Call(ctx context.Context, cmd rtmp.Command) (*rtmp.ResultCommand, error) {
+	return c.transactions.Call(ctx, rtmp.CommandMessageStreamID, cmd)
+}
+
+// 关闭连接
+func (c *Conn) Close() error {
+	return c.conn.Close()
+}
+
+// 推流结束
+func (c *Conn) unpublish() {
+	if c.publishStream == nil {
 		return
 	}
-	for stream.valid {
-		data, ok := <-c.playChan
-		if !ok {
+	c.server.DeleteStream(c.publishKey)
+	c.handler.OnUnpublish(c, c.publishKey)
+	c.notify(c.vhost.Hooks.OnUnpublish, c.hookRequest(HookOnUnpublish, c.publishKey))
+	c.publishStream = nil
+	c.publishKey = nil
+}
+
+// 发送完缓存的消息后关闭连接，ctx有deadline则写入不会超过它
+func (c *Conn) shutdown(ctx context.Context) {
+	if deadline, ok := ctx.Deadline(); ok {
+		c.conn.SetWriteDeadline(deadline)
+	}
+	c.writer.Close()
+	c.conn.Close()
+}
+
+// 播放，先发送AddPlayConn返回的sequence header和缓存的gop，
+// 然后循环读取sub发送音视频数据，streamID是play的消息流
+func (c *Conn) playLoop(stream *Stream, sub *subscriber, streamID uint32, start []*StreamData) {
+	defer c.server.playWG.Done()
+	defer atomic.StoreInt32(&c.playing, 0)
+	defer stream.unsubscribe(sub)
+	defer func() {
+		for _, data := range start {
+			PutStreamData(data)
+		}
+	}()
+	// sequence header的时间戳是0，gop的时间戳从0开始
+	var ts timestampBase
+	for _, data := range start {
+		if !c.playable(data) {
+			continue
+		}
+		err := c.writeStreamData(streamID, data, ts.start(data))
+		if err != nil {
+			logError(err)
 			return
 		}
-		// 接下来的chunk只要timestamp delta，fmt2就可以了
-		if data.typeID == rtmp.AudioMessage {
-			if !c.receiveAudio {
-				lastAudioLength = uint32(data.data.Len())
-				lastAudioTimestap = data.timestamp
-				PutStreamData(data)
-				continue
-			}
-			chunk.CSID = rtmp.AudioMessageChunkStreamID
-			chunk.MessageTypeID = rtmp.AudioMessage
-			chunk.MessageTimestamp = data.timestamp - lastAudioTimestap
-			if uint32(data.data.Len()) == lastAudioLength {
-				chunk.FMT = rtmp.ChunkFmt2
-			} else {
-				chunk.FMT = rtmp.ChunkFmt1
-			}
-			lastAudioLength = uint32(data.data.Len())
-			lastAudioTimestap = data.timestamp
-		} else {
-			if !c.receiveVideo {
-				lastVideoLength = uint32(data.data.Len())
-				lastVideoTimestap = data.timestamp
-				PutStreamData(data)
-				continue
+	}
+	// 接下来的chunk，scheduler会自动选择fmt
+	for {
+		data := sub.next(c.closed)
+		if data == nil {
+			if sub.isSlow() {
+				logError(fmt.Errorf("player <%s> too slow", c.RemoteAddr().String()))
+				c.Close()
+				return
 			}
-			chunk.CSID = rtmp.VideoMessageChunkStreamID
-			chunk.MessageTypeID = rtmp.VideoMessage
-			chunk.MessageTimestamp = data.timestamp - lastVideoTimestap
-			if uint32(data.data.Len()) == lastVideoLength {
-				chunk.FMT = rtmp.ChunkFmt2
-			} else {
-				chunk.FMT = rtmp.ChunkFmt1
+			select {
+			case <-c.closed:
+				// 连接断开
+			default:
+				// 推流结束
+				c.unpublishNotify(streamID)
 			}
-			lastVideoLength = uint32(data.data.Len())
-			lastVideoTimestap = data.timestamp
+			return
 		}
-		chunk.MessageLength = uint32(data.data.Len())
-		if chunk.MessageTimestamp >= rtmp.MaxMessageTimestamp {
-			chunk.ExtendedTimestamp = chunk.MessageTimestamp
-			chunk.MessageTimestamp = rtmp.MaxMessageTimestamp
+		// 暂停的时候也要发送新的sequence header
+		if (atomic.LoadInt32(&c.paused) != 0 && !isSequenceHeader(data)) || !c.playable(data) {
+			PutStreamData(data)
+			continue
 		}
-		buff.Reset()
-		rtmp.WriteMessage(&buff, &chunk, c.writeChunkSize, data.data.Bytes())
-		_, err = c.writer.Write(buff.Bytes())
+		err := c.writeStreamData(streamID, data, ts.rebase(data.timestamp))
 		PutStreamData(data)
 		if err != nil {
-			log.Error(err)
+			logError(err)
 			return
 		}
 	}
 }
 
+// 客户端是否接收data，receiveAudio和receiveVideo
+func (c *Conn) playable(data *StreamData) bool {
+	return (data.typeID != rtmp.AudioMessage || atomic.LoadInt32(&c.receiveAudio) != 0) &&
+		(data.typeID != rtmp.VideoMessage || atomic.LoadInt32(&c.receiveVideo) != 0)
+}
+
+// 通知播放的客户端推流已经结束
+func (c *Conn) unpublishNotify(streamID uint32) {
+	err := c.sendCommand(streamID, &rtmp.OnStatusCommand{Info: rtmp.StatusInfo{
+		Level: "status",
+		Code:  "NetStream.Play.UnpublishNotify",
+	}})
+	if err != nil {
+		return
+	}
+	msg := rtmp.GetMessage()
+	(&rtmp.StreamEOF{StreamID: streamID}).Encode(msg)
+	c.writer.Send(msg)
+}
+
+// 发送音视频数据，共享data的数据不拷贝，队列满的时候会阻塞
+func (c *Conn) writeStreamData(streamID uint32, data *StreamData, timestamp uint32) error {
+	msg := rtmp.GetMessage()
+	msg.CSID = 0
+	msg.StreamID = streamID
+	msg.TypeID = data.typeID
+	msg.Timestamp = timestamp
+	msg.Shared = data.data.Retain()
+	return c.writer.Send(msg)
+}
+
 // 循环读取并处理消息
 func (c *Conn) readLoop() (err error) {
-	defer func() {
-		for _, v := range c.readMessage {
-			rtmp.PutMessage(v)
-		}
-	}()
-	c.readMessage = make(map[uint32]*rtmp.Message)
-	var lastTypeID uint8
-	var lastStreamID uint32
-	var lastTimestamp uint32
-	var lastLength uint32
-	var n uint32
-	var ok bool
+	defer c.reader.Reset()
 	var msg *rtmp.Message
-	var chunk rtmp.ChunkHeader
-	var ackData [4]byte
 	for {
-		// chunk header
-		err = chunk.Read(c.reader)
+		if c.readTimeout > 0 {
+			c.conn.SetReadDeadline(time.Now().Add(c.readTimeout))
+		}
+		msg, err = c.reader.ReadMessage()
 		if err != nil {
 			return
 		}
-		msg, ok = c.readMessage[chunk.CSID]
-		if !ok {
-			msg = rtmp.GetMessage()
-		}
-		switch chunk.FMT {
-		case 0:
-			if chunk.MessageTimestamp >= rtmp.MaxMessageTimestamp {
-				msg.Timestamp = chunk.ExtendedTimestamp
-			} else {
-				msg.Timestamp = chunk.MessageTimestamp
-			}
-			msg.Length = chunk.MessageLength
-			msg.TypeID = chunk.MessageTypeID
-			msg.StreamID = chunk.MessageStreamID
-			//
-			lastTimestamp = msg.Timestamp
-			lastLength = msg.Length
-			lastTypeID = msg.TypeID
-			lastStreamID = msg.StreamID
-		case 1:
-			if chunk.MessageTimestamp >= rtmp.MaxMessageTimestamp {
-				msg.Timestamp = chunk.ExtendedTimestamp
-			} else {
-				msg.Timestamp = lastTimestamp + chunk.MessageTimestamp
-			}
-			msg.Length = chunk.MessageLength
-			msg.TypeID = chunk.MessageTypeID
-			//
-			lastTimestamp = msg.Timestamp
-			lastLength = msg.Length
-			lastTypeID = msg.TypeID
-			msg.StreamID = lastStreamID
-		case 2:
-			if chunk.MessageTimestamp >= rtmp.MaxMessageTimestamp {
-				msg.Timestamp = chunk.ExtendedTimestamp
-			} else {
-				msg.Timestamp = lastTimestamp + chunk.MessageTimestamp
-			}
-			lastTimestamp = msg.Timestamp
-			msg.Length = lastLength
-			msg.TypeID = lastTypeID
-			msg.StreamID = lastStreamID
-		default:
-			// 新的消息，那么以上一个消息作为模板
-			if !ok {
-				msg.Timestamp = lastTimestamp
-				msg.TypeID = lastTypeID
-				msg.StreamID = lastStreamID
-				msg.Length = lastLength
-			}
-		}
-		// chunk data
-		if int(msg.Length) > msg.Data.Len() {
-			n = msg.Length - uint32(msg.Data.Len())
-			if n > c.readChunkSize {
-				n = c.readChunkSize
-			}
-			_, err = io.CopyN(&msg.Data, c.reader, int64(n))
+		// ack
+		n := c.reader.BytesRead()
+		if c.windowAcknowledgeSize > 0 && n-c.acknowledgement >= c.windowAcknowledgeSize {
+			c.acknowledgement = n
+			c.cacheControlMessage(&rtmp.Acknowledgement{SequenceNumber: n})
+			err = c.writeSyncMessages()
 			if err != nil {
-				return
-			}
-			// 读完整个消息了
-			if int(msg.Length) <= msg.Data.Len() {
-				// ack
-				c.acknowledgement += msg.Length
-				if c.windowAcknowledgeSize > 0 && c.acknowledgement >= c.windowAcknowledgeSize {
-					binary.BigEndian.PutUint32(ackData[:], c.acknowledgement)
-					c.acknowledgement = 0
-					c.syncMessageBuffer.Reset()
-					c.cacheControlMessage(rtmp.ControlMessageAcknowledgement, ackData[:])
-					_, err = c.writer.Write(c.syncMessageBuffer.Bytes())
-					if err != nil {
-						return
-					}
-				}
-				// 处理
-				err = c.handleMessage(msg)
-				if ok {
-					delete(c.readMessage, chunk.CSID)
-				}
 				rtmp.PutMessage(msg)
-				if err != nil {
-					return
-				}
-			} else {
-				// 没读完，先缓存
-				if !ok {
-					c.readMessage[chunk.CSID] = msg
-				}
+				return
 			}
 		}
+		// 处理
+		err = c.handleMessage(msg)
+		rtmp.PutMessage(msg)
+		if err != nil {
+			return
+		}
 	}
 }
 
-func (c *Conn) cacheControlMessage(typeID uint8, data []byte) {
-	c.syncChunkHeader.CSID = rtmp.ControlMessageChunkStreamID
-	c.syncChunkHeader.MessageTimestamp = 0
-	c.syncChunkHeader.MessageLength = uint32(len(data))
-	c.syncChunkHeader.MessageTypeID = typeID
-	c.syncChunkHeader.MessageStreamID = rtmp.ControlMessageStreamID
-	c.syncChunkHeader.ExtendedTimestamp = 0
-	c.syncChunkHeader.FMT = rtmp.ChunkFmt0
-	rtmp.WriteMessage(&c.syncMessageBuffer, &c.syncChunkHeader, c.writeChunkSize, data)
+func (c *Conn) cacheMessage(csid uint32, typeID uint8, streamID uint32, data []byte) {
+	msg := rtmp.GetMessage()
+	msg.CSID = csid
+	msg.TypeID = typeID
+	msg.StreamID = streamID
+	msg.Timestamp = 0
+	msg.Data.Write(data)
+	c.syncMessages = append(c.syncMessages, msg)
+}
+
+func (c *Conn) cacheControlMessage(m rtmp.ControlMessage) {
+	msg := rtmp.GetMessage()
+	m.Encode(msg)
+	c.syncMessages = append(c.syncMessages, msg)
 }
 
-func (c *Conn) cacheCommandMessage(data []byte) {
-	c.syncChunkHeader.CSID = rtmp.CommandMessageChunkStreamID
-	c.syncChunkHeader.MessageTimestamp = 0
-	c.syncChunkHeader.MessageLength = uint32(len(data))
-	c.syncChunkHeader.MessageTypeID = rtmp.CommandMessageAMF0
-	c.syncChunkHeader.MessageStreamID = rtmp.ControlMessageStreamID
-	c.syncChunkHeader.ExtendedTimestamp = 0
-	c.syncChunkHeader.FMT = rtmp.ChunkFmt0
-	rtmp.WriteMessage(&c.syncMessageBuffer, &c.syncChunkHeader, c.writeChunkSize, data)
+// 使用connect的objectEncoding编码
+func (c *Conn) cacheCommandMessage(streamID uint32, cmd rtmp.Command) error {
+	msg := rtmp.GetMessage()
+	err := rtmp.EncodeCommand(msg, cmd, c.objectEncoding)
+	if err != nil {
+		rtmp.PutMessage(msg)
+		return err
+	}
+	msg.StreamID = streamID
+	c.syncMessages = append(c.syncMessages, msg)
+	return nil
 }
 
 func (c *Conn) cacheDataMessage(data []byte) {
-	c.syncChunkHeader.CSID = rtmp.DataMessageChunkStreamID
-	c.syncChunkHeader.MessageTimestamp = 0
-	c.syncChunkHeader.MessageLength = uint32(len(data))
-	c.syncChunkHeader.MessageTypeID = rtmp.DataMessageAMF0
-	c.syncChunkHeader.MessageStreamID = c.streamID
-	c.syncChunkHeader.ExtendedTimestamp = 0
-	c.syncChunkHeader.FMT = rtmp.ChunkFmt0
-	rtmp.WriteMessage(&c.syncMessageBuffer, &c.syncChunkHeader, c.writeChunkSize, data)
+	c.cacheMessage(rtmp.DataMessageChunkStreamID, rtmp.DataMessageAMF0, c.streamID, data)
+}
+
+// 直接发送命令，TransactionManager使用
+func (c *Conn) sendCommand(streamID uint32, cmd rtmp.Command) error {
+	msg := rtmp.GetMessage()
+	err := rtmp.EncodeCommand(msg, cmd, c.objectEncoding)
+	if err != nil {
+		rtmp.PutMessage(msg)
+		return err
+	}
+	msg.StreamID = streamID
+	return c.writer.Send(msg)
+}
+
+// 将缓存的同步消息交给scheduler发送
+func (c *Conn) writeSyncMessages() (err error) {
+	for i, msg := range c.syncMessages {
+		if err == nil {
+			err = c.writer.Send(msg)
+		} else {
+			rtmp.PutMessage(msg)
+		}
+		c.syncMessages[i] = nil
+	}
+	c.syncMessages = c.syncMessages[:0]
+	return
 }
 
 func (c *Conn) handleMessage(msg *rtmp.Message) error {
 	switch msg.TypeID {
-	case rtmp.ControlMessageSetBandWidth:
-		log.Debug("control message 'set bandwidth'")
-		return c.handleControlMessageSetBandWidth(msg)
-	case rtmp.ControlMessageWindowAcknowledgementSize:
-		log.Debug("control message 'window acknowledgement size'")
-		return c.handleControlMessageWindowAcknowledgementSize(msg)
-	case rtmp.ControlMessageAcknowledgement:
-		log.Debug("control message 'acknowledgement'")
-		return c.handleControlMessageAcknowledgement(msg)
-	case rtmp.ControlMessageAbort:
-		log.Debug("control message 'abort'")
-		return c.handleControlMessageAbort(msg)
-	case rtmp.ControlMessageSetChunkSize:
-		log.Debug("control message 'set chunk size'")
-		return c.handleControlMessageSetChunkSize(msg)
-	case rtmp.CommandMessageAMF0:
+	case rtmp.ControlMessageSetBandWidth,
+		rtmp.ControlMessageWindowAcknowledgementSize,
+		rtmp.ControlMessageAcknowledgement,
+		rtmp.ControlMessageAbort,
+		rtmp.ControlMessageSetChunkSize:
+		return c.handleControlMessage(msg)
+	case rtmp.UserControlMessage:
+		return c.handleUserControlMessage(msg)
+	case rtmp.CommandMessageAMF0, rtmp.CommandMessageAMF3:
 		return c.handleCommandMessage(msg)
 	case rtmp.DataMessageAMF0:
-		log.Debug("data message amf0")
+		logDebug("data message amf0")
+		return c.handleDataMessage(msg)
+	case rtmp.DataMessageAMF3:
+		logDebug("data message amf3")
+		_, err := msg.Data.ReadByte()
+		if err != nil {
+			return err
+		}
 		return c.handleDataMessage(msg)
 	case rtmp.AudioMessage:
-		// log.Debug("audio message")
+		// logDebug("audio message")
 		return c.handleAudioMessage(msg)
 	case rtmp.VideoMessage:
-		// log.Debug("video message")
+		// logDebug("video message")
 		return c.handleVideoMessage(msg)
 	default:
 		return nil
@@ -341,449 +360,502 @@ func (c *Conn) handleAudioMessage(msg *rtmp.Message) (err error) {
 }
 
 func (c *Conn) handleCommandMessage(msg *rtmp.Message) error {
-	amf, err := rtmp.ReadAMF(&msg.Data)
+	cmd, err := rtmp.DecodeCommand(msg)
 	if err != nil {
 		return err
 	}
-	if name, ok := amf.(string); ok {
-		log.Debug(fmt.Sprintf("command message '%s'", name))
-		switch name {
-		case "connect":
-			return c.handleCommandMessageConnect(msg)
-		case "createStream":
-			return c.handleCommandMessageCreateStream(msg)
-		case "play":
-			return c.handleCommandMessagePlay(msg)
-		case "receiveAudio":
-			return c.handleCommandMessageReceiveAudio(msg)
-		case "receiveVideo":
-			return c.handleCommandMessageReceiveVideo(msg)
-		case "publish":
-			return c.handleCommandMessagePublish(msg)
-		case "pause":
-			return c.handleCommandMessagePause(msg)
-		}
+	logDebug(fmt.Sprintf("command message '%s'", cmd.CommandName()))
+	// 响应和注册了处理函数的调用
+	ok, err := c.transactions.Dispatch(msg.StreamID, cmd)
+	if ok || err != nil {
+		return err
+	}
+	switch cmd := cmd.(type) {
+	case *rtmp.ConnectCommand:
+		return c.handleCommandMessageConnect(cmd)
+	case *rtmp.CreateStreamCommand:
+		return c.handleCommandMessageCreateStream(cmd)
+	case *rtmp.PlayCommand:
+		return c.handleCommandMessagePlay(cmd)
+	case *rtmp.ReceiveAVCommand:
+		return c.handleCommandMessageReceiveAV(cmd)
+	case *rtmp.PublishCommand:
+		return c.handleCommandMessagePublish(cmd)
+	case *rtmp.PauseCommand:
+		return c.handleCommandMessagePause(cmd)
+	case *rtmp.DeleteStreamCommand, *rtmp.CloseStreamCommand:
+		c.unpublish()
+		return nil
+	}
+	// 交给handler
+	info, err := c.handler.OnCommand(c, cmd)
+	if cmd.Transaction() == 0 {
 		return nil
 	}
-	return fmt.Errorf("command message invalid 'name' data type <%s>", reflect.TypeOf(amf).Kind().String())
+	res := &rtmp.ResultCommand{Information: info}
+	res.SetTransaction(cmd.Transaction())
+	if err != nil {
+		res.Error = true
+		res.Information = &rtmp.StatusInfo{
+			Level:       "error",
+			Code:        "NetConnection.Call.Failed",
+			Description: err.Error(),
+		}
+	}
+	return c.sendCommand(msg.StreamID, res)
+}
+
+// onMetaData中的音视频信息，codecid可能是数字或者字符串
+type metaDataCodec struct {
+	VideoCodecID interface{}  `amf:"videocodecid"`
+	AudioCodecID interface{}  `amf:"audiocodecid"`
+	HasVideo     metaDataFlag `amf:"hasVideo"`
+	HasAudio     metaDataFlag `amf:"hasAudio"`
+}
+
+// 有哪些轨道，hasAudio和hasVideo优先，没有则看codecid
+func (m *metaDataCodec) tracks() (audio, video bool) {
+	audio = m.AudioCodecID != nil
+	if m.HasAudio.ok {
+		audio = m.HasAudio.value
+	}
+	video = m.VideoCodecID != nil
+	if m.HasVideo.ok {
+		video = m.HasVideo.value
+	}
+	return
+}
+
+// onMetaData中的hasAudio和hasVideo，可能是bool，数字（非0是true）或者字符串，
+// 不能解析的忽略
+type metaDataFlag struct {
+	ok    bool
+	value bool
+}
+
+func (f *metaDataFlag) UnmarshalAMF(amf interface{}) error {
+	switch v := amf.(type) {
+	case bool:
+		f.ok, f.value = true, v
+	case float64:
+		f.ok, f.value = true, v != 0
+	case string:
+		b, err := strconv.ParseBool(v)
+		f.ok, f.value = err == nil, b
+	}
+	return nil
 }
 
-// 这里有限定h264和acc
+// 处理onMetaData，音视频都可以没有
 func (c *Conn) handleDataMessage(msg *rtmp.Message) (err error) {
-	var amf interface{}
+	decoder := rtmp.NewAMF0Decoder(&msg.Data)
+	// 保持onMetaData的顺序
+	decoder.UseOrderedObject()
+	var values []interface{}
 	for msg.Data.Len() > 0 {
-		// onMetaData
-		amf, err = rtmp.ReadAMF(&msg.Data)
+		var amf interface{}
+		err = decoder.Decode(&amf)
 		if err != nil {
 			return
 		}
-		if name, ok := amf.(string); ok && name == "onMetaData" {
-			amf, err = rtmp.ReadAMF(&msg.Data)
-			if err != nil {
-				return
-			}
-			metaData, ok := amf.(map[string]interface{})
-			if !ok {
-				return fmt.Errorf("data message.'onMetaData' invalid data type <%s>", reflect.TypeOf(amf).Kind().String())
-			}
-			// h264 avc
-			v := metaData["videocodecid"]
-			videoCodecID, ok := v.(float64)
-			if !ok {
-				return fmt.Errorf("data message.'onMetaData'.'videocodecid' invalid data type <%s>", reflect.TypeOf(amf).Kind().String())
-			}
-			if videoCodecID != 7 {
-				return fmt.Errorf("data message.'onMetaData'.'videocodecid' <%v> unsupported", videoCodecID)
-			}
-			// acc
-			v = metaData["audiocodecid"]
-			audioCodecID, ok := v.(float64)
-			if !ok {
-				return fmt.Errorf("data message.'onMetaData'.'audiocodecid' invalid data type <%s>", reflect.TypeOf(amf).Kind().String())
-			}
-			if audioCodecID != 10 {
-				return fmt.Errorf("data message.'onMetaData'.'audiocodecid' <%v> unsupported", audioCodecID)
-			}
-			if c.publishStream != nil {
-				c.publishStream.metaData.Reset()
-				rtmp.WriteAMF(&c.publishStream.metaData, "onMetaData")
-				rtmp.WriteAMF(&c.publishStream.metaData, metaData)
-			}
+		values = append(values, amf)
+	}
+	err = c.handler.OnData(c, values)
+	if err != nil {
+		return
+	}
+	for i := 0; i < len(values)-1; i++ {
+		// onMetaData
+		if name, _ := values[i].(string); name != "onMetaData" {
+			continue
+		}
+		metaData := values[i+1]
+		// 不能解析的onMetaData不影响推流，轨道从收到的数据判断
+		var codec metaDataCodec
+		if err := rtmp.UnmarshalAMF(metaData, &codec); err != nil {
+			logError(fmt.Errorf("data message.'onMetaData' <%s>", err.Error()))
+			codec = metaDataCodec{}
 		}
+		if c.publishStream != nil {
+			audio, video := codec.tracks()
+			c.publishStream.setMetaData(metaData, audio, video)
+		}
+		break
 	}
 	return
 }
 
-func (c *Conn) handleCommandMessagePause(msg *rtmp.Message) (err error) {
-	var amf interface{}
-	// transaction id
-	amf, err = rtmp.ReadAMF(&msg.Data)
-	if err != nil {
-		return
-	}
-	_, ok := amf.(float64)
-	if !ok {
-		return fmt.Errorf("command message.'pause'.'transaction id' invalid data type <%s>", reflect.TypeOf(amf).Kind().String())
+func (c *Conn) handleCommandMessagePause(cmd *rtmp.PauseCommand) (err error) {
+	atomic.StoreInt32(&c.paused, boolInt32(cmd.Pause))
+	return
+}
+
+// 原子操作的bool
+func boolInt32(b bool) int32 {
+	if b {
+		return 1
 	}
-	// command object is nil
-	amf, err = rtmp.ReadAMF(&msg.Data)
-	if err != nil {
-		return
+	return 0
+}
+
+// 错误的onStatus
+func (c *Conn) cacheStatusError(code, description string) error {
+	return c.cacheCommandMessage(c.streamID, &rtmp.OnStatusCommand{Info: rtmp.StatusInfo{
+		Level:       "error",
+		Code:        code,
+		Description: description,
+	}})
+}
+
+func (c *Conn) handleCommandMessagePublish(cmd *rtmp.PublishCommand) (err error) {
+	var key *StreamKey
+	if c.connect == nil {
+		// 没有connect，没有vhost和app
+		err = c.cacheStatusError("NetStream.Publish.Failed", errNotConnected.Error())
+	} else if err = c.handler.OnPublish(c, cmd); err != nil {
+		err = c.cacheStatusError("NetStream.Publish.Rejected", err.Error())
+	} else if key, err = c.checkPublish(cmd.PublishingName); err != nil {
+		if _, ok := err.(*authError); ok {
+			err = c.cacheStatusError("NetStream.Publish.BadName", err.Error())
+		} else {
+			err = c.cacheStatusError("NetStream.Publish.Rejected", err.Error())
+		}
+	} else if c.publishStream != nil {
+		err = c.cacheStatusError("NetStream.Publish.BadConnection", "connection is publishing")
+	} else if cmd.PublishingType != "live" {
+		// 只支持直播类型的推流
+		err = c.cacheStatusError("NetStream.Publish.Error", "only live publishing is supported")
+	} else {
+		c.publishStream, err = c.server.AddPublishStream(key, c)
+		if err == errStreamExists {
+			err = c.cacheStatusError("NetStream.Publish.BadName", err.Error())
+		} else if err != nil {
+			err = c.cacheStatusError("NetStream.Publish.Rejected", err.Error())
+		} else {
+			c.publishKey = key
+			c.record()
+			c.cacheControlMessage(&rtmp.StreamBegin{StreamID: c.streamID})
+			err = c.cacheCommandMessage(c.streamID, &rtmp.OnStatusCommand{Info: rtmp.StatusInfo{
+				Level: "status",
+				Code:  "NetStream.Publish.Start",
+			}})
+		}
 	}
-	// pause/unpause
-	amf, err = rtmp.ReadAMF(&msg.Data)
 	if err != nil {
 		return
 	}
-	var pause bool
-	pause, ok = amf.(bool)
-	if !ok {
-		return fmt.Errorf("command message.'pause'.'pause' invalid data type <%s>", reflect.TypeOf(amf).Kind().String())
-	}
-	// milliSeconds
-	if pause {
-		c.publishStream.RemovePlayConn(c)
-	} else {
-		c.publishStream.AddPlayConn(c)
-	}
+	err = c.writeSyncMessages()
 	return
 }
 
-func (c *Conn) handleCommandMessagePublish(msg *rtmp.Message) (err error) {
-	var amf interface{}
-	// transaction id
-	amf, err = rtmp.ReadAMF(&msg.Data)
+// 连接的app的配置
+func (c *Conn) appConfig() (*AppConfig, error) {
+	return c.vhost.app(c.connectKey.App)
+}
+
+// 检查配置是否允许connect，tcUrl有签名的token则检查过期时间和ip
+func (c *Conn) checkConnect() error {
+	app, err := c.appConfig()
 	if err != nil {
 		return err
 	}
-	transactionID, ok := amf.(float64)
-	if !ok {
-		return fmt.Errorf("command message.'publish'.'transaction id' invalid data type <%s>", reflect.TypeOf(amf).Kind().String())
+	auth := c.vhost.auth(app)
+	if len(auth.Keys) > 0 && c.connectKey.Query.Get("sign") != "" {
+		return checkTokenExpire(c.connectKey.Query, c.remoteIP(), time.Now())
 	}
-	// command object is nil
-	amf, err = rtmp.ReadAMF(&msg.Data)
+	return nil
+}
+
+// 检查配置是否允许推流，返回流的key
+func (c *Conn) checkPublish(name string) (*StreamKey, error) {
+	key, err := c.connectKey.withName(name)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	// publishing name
-	amf, err = rtmp.ReadAMF(&msg.Data)
+	app, err := c.appConfig()
 	if err != nil {
-		return err
+		return nil, err
 	}
-	_, ok = amf.(string)
-	if !ok {
-		return fmt.Errorf("command message.'publish'.'publishing name' invalid data type <%s>", reflect.TypeOf(amf).Kind().String())
+	if app.DisablePublish {
+		return nil, fmt.Errorf("app <%s> publish disabled", key.App)
 	}
-	// publishing type
-	amf, err = rtmp.ReadAMF(&msg.Data)
+	err = c.vhost.access(app).check(TokenPublish, c.remoteIP())
 	if err != nil {
-		return err
-	}
-	_type, ok := amf.(string)
-	if !ok {
-		return fmt.Errorf("command message.'publish'.'publishing type' invalid data type <%s>", reflect.TypeOf(amf).Kind().String())
+		c.server.rejectAccess(err)
+		return nil, err
 	}
-	c.syncMessageBuffer.Reset()
-	msg.Data.Reset()
-	if _type != "live" {
-		// 只支持直播类型的推流
-		rtmp.WriteAMFs(&msg.Data, "onStatus", transactionID, nil, map[string]interface{}{
-			"level":       "error",
-			"code":        "NetStream.Publish.Error",
-			"description": "other stream is publishing",
-		})
-	} else {
-		c.publishStream, ok = c.server.AddPublishStream(c.connectUrl.Path, c.server.Timestamp)
-		if !ok {
-			// 已经有相同的流
-			rtmp.WriteAMFs(&msg.Data, "onStatus", transactionID, nil, map[string]interface{}{
-				"level":       "error",
-				"code":        "NetStream.Publish.Error",
-				"description": "other stream is publishing",
-			})
-		} else {
-			msg.WriteB16(rtmp.UserControlMessageStreamBegin)
-			msg.WriteB32(c.streamID)
-			c.cacheControlMessage(rtmp.UserControlMessage, msg.Data.Bytes())
-			msg.Data.Reset()
-			rtmp.WriteAMFs(&msg.Data, "onStatus", transactionID, nil, map[string]interface{}{
-				"level": "status",
-				"code":  "NetStream.Publish.Start",
-			})
-		}
+	err = c.vhost.auth(app).check(TokenPublish, key, c.remoteIP())
+	if err != nil {
+		return nil, err
 	}
-	c.cacheCommandMessage(msg.Data.Bytes())
-	_, err = c.writer.Write(c.syncMessageBuffer.Bytes())
-	return
+	return key, c.hookStream(c.vhost.Hooks.OnPublish, HookOnPublish, key)
 }
 
-func (c *Conn) handleCommandMessageReceiveVideo(msg *rtmp.Message) (err error) {
-	var amf interface{}
-	// transaction id
-	amf, err = rtmp.ReadAMF(&msg.Data)
+// 检查配置是否允许播放，返回流的key
+func (c *Conn) checkPlay(name string) (*StreamKey, error) {
+	key, err := c.connectKey.withName(name)
 	if err != nil {
-		return
+		return nil, err
 	}
-	_, ok := amf.(float64)
-	if !ok {
-		return fmt.Errorf("command message.'receiveVideo'.'transaction id' invalid data type <%s>", reflect.TypeOf(amf).Kind().String())
-	}
-	// command object is nil
-	amf, err = rtmp.ReadAMF(&msg.Data)
+	app, err := c.appConfig()
 	if err != nil {
-		return
+		return nil, err
 	}
-	// bool flag
-	amf, err = rtmp.ReadAMF(&msg.Data)
-	if err != nil {
-		return
+	if app.DisablePlay {
+		return nil, fmt.Errorf("app <%s> play disabled", key.App)
 	}
-	c.receiveVideo, ok = amf.(bool)
-	if !ok {
-		return fmt.Errorf("command message.'receiveVideo'.'bool' invalid data type <%s>", reflect.TypeOf(amf).Kind().String())
+	err = c.vhost.access(app).check(TokenPlay, c.remoteIP())
+	if err != nil {
+		c.server.rejectAccess(err)
+		return nil, err
 	}
-	if c.receiveVideo {
-		// h264要发送sps和pps
-		c.syncChunkHeader.CSID = 10
-		c.syncChunkHeader.MessageTimestamp = 0
-		c.syncChunkHeader.MessageLength = uint32(c.publishStream.avc.data.Len())
-		c.syncChunkHeader.MessageTypeID = c.publishStream.avc.typeID
-		c.syncChunkHeader.MessageStreamID = c.streamID
-		c.syncChunkHeader.ExtendedTimestamp = 0
-		c.syncChunkHeader.FMT = rtmp.ChunkFmt0
-		rtmp.WriteMessage(&c.syncMessageBuffer, &c.syncChunkHeader, c.writeChunkSize, c.publishStream.avc.data.Bytes())
-		_, err = c.writer.Write(c.syncMessageBuffer.Bytes())
+	err = c.vhost.auth(app).check(TokenPlay, key, c.remoteIP())
+	if err != nil {
+		return nil, err
 	}
-	return
+	return key, c.hookStream(c.vhost.Hooks.OnPlay, HookOnPlay, key)
 }
 
-func (c *Conn) handleCommandMessageReceiveAudio(msg *rtmp.Message) (err error) {
-	var amf interface{}
-	// transaction id
-	amf, err = rtmp.ReadAMF(&msg.Data)
+// 回调，响应可以修改key的流名称
+func (c *Conn) hookStream(url, action string, key *StreamKey) error {
+	res, err := c.hook(url, action, key)
 	if err != nil {
-		return
+		return err
 	}
-	_, ok := amf.(float64)
-	if !ok {
-		return fmt.Errorf("command message.'receiveAudio'.'transaction id' invalid data type <%s>", reflect.TypeOf(amf).Kind().String())
+	if name := cleanName(res.Stream); name != "" {
+		key.Name = name
 	}
-	// command object is nil
-	amf, err = rtmp.ReadAMF(&msg.Data)
-	if err != nil {
+	return nil
+}
+
+// app配置了录制，开始录制推流
+func (c *Conn) record() {
+	app, err := c.appConfig()
+	if err != nil || !app.Record {
 		return
 	}
-	// bool flag
-	amf, err = rtmp.ReadAMF(&msg.Data)
+	r, err := newRecorder(c.vhost.Record.Dir, c.publishKey)
 	if err != nil {
+		logError(err)
 		return
 	}
-	c.receiveAudio, ok = amf.(bool)
-	if !ok {
-		return fmt.Errorf("command message.'receiveAudio'.'bool' invalid data type <%s>", reflect.TypeOf(amf).Kind().String())
+	url := c.vhost.Hooks.OnRecordDone
+	req := c.hookRequest(HookOnRecordDone, c.publishKey)
+	r.done = func(file string) {
+		req.File = file
+		c.notify(url, req)
 	}
-	// if c.receiveAudio {
-	// 	// 其实acc不发送这个也行的
-	// }
-	return
+	c.publishStream.setRecorder(r)
 }
 
-func (c *Conn) handleCommandMessageCreateStream(msg *rtmp.Message) (err error) {
-	var amf interface{}
-	// transaction id
-	amf, err = rtmp.ReadAMF(&msg.Data)
-	if err != nil {
-		return err
+func (c *Conn) handleCommandMessageReceiveAV(cmd *rtmp.ReceiveAVCommand) (err error) {
+	if cmd.Audio {
+		// 其实acc不发送sequence header也行的
+		atomic.StoreInt32(&c.receiveAudio, boolInt32(cmd.Flag))
+		return
 	}
-	transactionID, ok := amf.(float64)
-	if !ok {
-		return fmt.Errorf("command message.'createStream'.'transaction id' invalid data type <%s>", reflect.TypeOf(amf).Kind().String())
+	atomic.StoreInt32(&c.receiveVideo, boolInt32(cmd.Flag))
+	if cmd.Flag && c.playStream != nil {
+		// h264要发送sps和pps
+		avc, acc := c.playStream.sequenceHeaders()
+		if acc != nil {
+			PutStreamData(acc)
+		}
+		if avc == nil {
+			return
+		}
+		c.cacheMessage(rtmp.VideoMessageChunkStreamID, avc.typeID, c.streamID, avc.data.Bytes())
+		PutStreamData(avc)
+		err = c.writeSyncMessages()
 	}
-	c.streamID++
-	c.syncMessageBuffer.Reset()
-	msg.Data.Reset()
-	rtmp.WriteAMFs(&msg.Data, "_result", transactionID, nil, c.streamID)
-	c.cacheCommandMessage(msg.Data.Bytes())
-	_, err = c.writer.Write(c.syncMessageBuffer.Bytes())
 	return
 }
 
-func (c *Conn) handleCommandMessagePlay(msg *rtmp.Message) (err error) {
-	var amf interface{}
-	// transaction id
-	amf, err = rtmp.ReadAMF(&msg.Data)
+func (c *Conn) handleCommandMessageCreateStream(cmd *rtmp.CreateStreamCommand) (err error) {
+	c.streamID++
+	err = c.cacheCommandMessage(rtmp.CommandMessageStreamID, &rtmp.ResultCommand{
+		CommandTransaction: cmd.CommandTransaction,
+		Information:        c.streamID,
+	})
 	if err != nil {
 		return
 	}
-	transactionID, ok := amf.(float64)
-	if !ok {
-		return fmt.Errorf("command message.'play'.'transaction id' invalid data type <%s>", reflect.TypeOf(amf).Kind().String())
-	}
-	// command object
-	amf, err = rtmp.ReadAMF(&msg.Data)
-	if err != nil {
-		return
+	err = c.writeSyncMessages()
+	return
+}
+
+func (c *Conn) handleCommandMessagePlay(cmd *rtmp.PlayCommand) (err error) {
+	var key *StreamKey
+	if c.connect == nil {
+		// 没有connect，没有vhost和app
+		err = errNotConnected
+	} else if atomic.LoadInt32(&c.playing) != 0 {
+		err = errConnPlaying
+	} else if err = c.handler.OnPlay(c, cmd); err == nil {
+		key, err = c.checkPlay(cmd.StreamName)
 	}
-	// stream name
-	amf, err = rtmp.ReadAMF(&msg.Data)
 	if err != nil {
+		err = c.cacheStatusError("NetStream.Play.Failed", err.Error())
+		if err != nil {
+			return
+		}
+		err = c.writeSyncMessages()
 		return
 	}
-	var name string
-	name, ok = amf.(string)
-	if !ok {
-		return fmt.Errorf("command message.'play'.'name' invalid data type <%s>", reflect.TypeOf(amf).Kind().String())
-	}
-	var stream *Stream
-	if name != "" {
-		stream = c.server.GetPublishStream(path.Join(c.connectUrl.Path, name))
-	} else {
-		stream = c.server.GetPublishStream(c.connectUrl.Path)
-	}
-	c.syncMessageBuffer.Reset()
-	msg.Data.Reset()
-	if stream == nil {
-		rtmp.WriteAMFs(&msg.Data, "onStatus", transactionID, nil, map[string]interface{}{
-			"level": "error",
-			"Code":  "NetStream.Play.StreamNotFound",
-		})
-		c.cacheCommandMessage(msg.Data.Bytes())
-		_, err = c.writer.Write(c.syncMessageBuffer.Bytes())
+	stream := c.server.GetPublishStream(key)
+	if stream == nil || c.server.isShutdown() {
+		err = c.cacheStatusError("NetStream.Play.StreamNotFound", "")
+		if err != nil {
+			return
+		}
+		err = c.writeSyncMessages()
 		return
 	}
 	// 响应"User Control Message Stream Begin"消息
-	msg.Data.Reset()
-	msg.WriteB16(rtmp.UserControlMessageStreamBegin)
-	msg.WriteB32(c.streamID)
-	c.cacheControlMessage(rtmp.UserControlMessage, msg.Data.Bytes())
+	c.cacheControlMessage(&rtmp.StreamBegin{StreamID: c.streamID})
 	// 响应"Command Message onStatus"消息
-	msg.Data.Reset()
-	rtmp.WriteAMFs(&msg.Data, "onStatus", transactionID, nil, map[string]interface{}{
-		"level": "status",
-		"Code":  "NetStream.Play.Start",
-	})
-	c.cacheCommandMessage(msg.Data.Bytes())
+	err = c.cacheCommandMessage(c.streamID, &rtmp.OnStatusCommand{Info: rtmp.StatusInfo{
+		Level: "status",
+		Code:  "NetStream.Play.Start",
+	}})
+	if err != nil {
+		return
+	}
 	// 响应"Command Message |RtmpSampleAccess"消息
-	msg.Data.Reset()
-	rtmp.WriteAMFs(&msg.Data, "|RtmpSampleAccess", transactionID, true, true)
-	c.cacheCommandMessage(msg.Data.Bytes())
+	msg := rtmp.GetMessage()
+	rtmp.WriteAMFs(&msg.Data, "|RtmpSampleAccess", cmd.TransactionID, true, true)
+	c.cacheMessage(rtmp.CommandMessageChunkStreamID, rtmp.CommandMessageAMF0, c.streamID, msg.Data.Bytes())
+	rtmp.PutMessage(msg)
 	// 响应"Command Message onMetaData"消息
-	c.cacheDataMessage(stream.metaData.Bytes())
-	_, err = c.writer.Write(c.syncMessageBuffer.Bytes())
+	c.cacheDataMessage(stream.MetaData())
+	err = c.writeSyncMessages()
 	if err != nil {
 		return
 	}
 	// play routine
-	go c.playLoop(stream)
+	if !c.server.addPlay() {
+		return
+	}
+	atomic.StoreInt32(&c.playing, 1)
+	c.playStream = stream
+	start := stream.AddPlayConn(c)
+	go c.playLoop(stream, c.subscriber, c.streamID, start)
 	return
 }
 
-func (c *Conn) handleCommandMessageConnect(msg *rtmp.Message) (err error) {
-	var amf interface{}
-	// transaction id
-	amf, err = rtmp.ReadAMF(&msg.Data)
-	if err != nil {
-		return err
+func (c *Conn) handleCommandMessageConnect(cmd *rtmp.ConnectCommand) (err error) {
+	c.connectKey, err = parseConnectKey(cmd)
+	if err == nil {
+		c.connectKey.Vhost, c.vhost, err = c.config.vhost(c.connectKey.Vhost)
 	}
-	transactionID, ok := amf.(float64)
-	if !ok {
-		return fmt.Errorf("command message.'connect'.'transaction id' invalid data type <%s>", reflect.TypeOf(amf).Kind().String())
+	if err == nil {
+		err = c.checkConnect()
 	}
-	// command object
-	amf, err = rtmp.ReadAMF(&msg.Data)
-	if err != nil {
-		return err
+	if err == nil {
+		err = c.checkCredentials(cmd)
 	}
-	var commandObject map[string]interface{}
-	commandObject, ok = amf.(map[string]interface{})
-	if !ok {
-		return fmt.Errorf("command message.'connect'.'command object' invalid data type <%s>", reflect.TypeOf(amf).Kind().String())
+	if err == nil {
+		err = c.handler.OnConnect(c, cmd)
 	}
-	v := commandObject["tcUrl"]
-	tcUrl, ok := v.(string)
-	if !ok {
-		return fmt.Errorf("command message.'connect'.'command object'.'tcUrl' invalid data type <%s>", reflect.TypeOf(v).Kind().String())
+	if err == nil {
+		c.connect = cmd
+		_, err = c.hook(c.vhost.Hooks.OnConnect, HookOnConnect, c.connectKey)
 	}
-	c.connectUrl, err = url.Parse(tcUrl)
 	if err != nil {
-		return fmt.Errorf("command message.'connect'.'command object'.'tcUrl' <%s>", err.Error())
+		c.connect = nil
+		return c.rejectConnect(cmd, err)
 	}
-	c.syncMessageBuffer.Reset()
+	c.objectEncoding = cmd.CommandObject.ObjectEncoding
 	// 响应"Window Acknowledgement Size"消息
-	msg.Data.Reset()
-	msg.WriteB32(c.server.WindowAcknowledgeSize)
-	c.cacheControlMessage(rtmp.ControlMessageWindowAcknowledgementSize, msg.Data.Bytes())
+	c.cacheControlMessage(&rtmp.WindowAckSize{Size: c.serverWindowAckSize})
 	// 响应"Control Message Set BandWidth"消息
-	msg.Data.Reset()
-	msg.WriteB32(c.server.BandWidth)
-	msg.Data.WriteByte(c.server.BandWidthLimit)
-	c.cacheControlMessage(rtmp.ControlMessageSetBandWidth, msg.Data.Bytes())
-	// 响应"Control Message Set Chunk Size"消息
-	msg.Data.Reset()
-	msg.WriteB32(c.server.ChunkSize)
-	c.cacheControlMessage(rtmp.ControlMessageSetChunkSize, msg.Data.Bytes())
-	c.writeChunkSize = c.server.ChunkSize
+	c.cacheControlMessage(&rtmp.SetPeerBandwidth{Size: c.serverBandWidth, LimitType: c.serverBandWidthLimit})
+	// 响应"Control Message Set Chunk Size"消息，scheduler发送后使用新的chunk size
+	chunkSize := c.vhost.ChunkSize
+	if chunkSize == 0 {
+		chunkSize = c.serverChunkSize
+	}
+	c.cacheControlMessage(&rtmp.SetChunkSize{ChunkSize: chunkSize})
 	// 响应"Command Message _result"消息
-	msg.Data.Reset()
-	rtmp.WriteAMFs(&msg.Data, "_result", transactionID, map[string]interface{}{
-		"fmsVer": FMSVer,
-	}, map[string]interface{}{
-		"level":          "status",
-		"code":           "NetConnection.Connect.Success",
-		"objectEncoding": 0,
+	err = c.cacheCommandMessage(rtmp.CommandMessageStreamID, &rtmp.ResultCommand{
+		CommandTransaction: cmd.CommandTransaction,
+		Properties: map[string]interface{}{
+			"fmsVer": FMSVer,
+		},
+		Information: map[string]interface{}{
+			"level":          "status",
+			"code":           "NetConnection.Connect.Success",
+			"objectEncoding": c.objectEncoding,
+		},
 	})
-	c.cacheCommandMessage(msg.Data.Bytes())
-	_, err = c.writer.Write(c.syncMessageBuffer.Bytes())
-	return
-}
-
-func (c *Conn) handleControlMessageSetBandWidth(msg *rtmp.Message) (err error) {
-	data := msg.Data.Bytes()
-	if len(data) != 5 {
-		return fmt.Errorf("control message 'set bandwidth' invalid length <%d>", len(data))
-	}
-	c.bandWidth = binary.BigEndian.Uint32(data)
-	c.bandWidthLimit = data[4]
-	return
-}
-
-func (c *Conn) handleControlMessageWindowAcknowledgementSize(msg *rtmp.Message) (err error) {
-	data := msg.Data.Bytes()
-	if len(data) != 4 {
-		return fmt.Errorf("control message 'window acknowledgement size' invalid length <%d>", len(data))
+	if err != nil {
+		return
 	}
-	c.windowAcknowledgeSize = binary.BigEndian.Uint32(data)
+	err = c.writeSyncMessages()
 	return
 }
 
-func (c *Conn) handleControlMessageAcknowledgement(msg *rtmp.Message) (err error) {
-	data := msg.Data.Bytes()
-	if len(data) != 4 {
-		return fmt.Errorf("control message 'acknowledgement' invalid length <%d>", len(data))
+// 拒绝或者重定向connect，发送_error后返回err，关闭连接
+func (c *Conn) rejectConnect(cmd *rtmp.ConnectCommand, err error) error {
+	info := rtmp.OrderedObject{
+		{Name: "level", Value: "error"},
+		{Name: "code", Value: "NetConnection.Connect.Rejected"},
+		{Name: "description", Value: err.Error()},
+	}
+	if redirect, ok := err.(*RedirectError); ok {
+		info = append(info, rtmp.AMFProperty{Name: "ex", Value: rtmp.OrderedObject{
+			{Name: "code", Value: float64(302)},
+			{Name: "redirect", Value: redirect.URL},
+		}})
+	}
+	e := c.cacheCommandMessage(rtmp.CommandMessageStreamID, &rtmp.ResultCommand{
+		CommandTransaction: cmd.CommandTransaction,
+		Error:              true,
+		Information:        info,
+	})
+	if e == nil {
+		c.writeSyncMessages()
 	}
-	// m.Ack = binary.BigEndian.Uint32(data)
-	return
+	return err
 }
 
-func (c *Conn) handleControlMessageAbort(msg *rtmp.Message) (err error) {
-	data := msg.Data.Bytes()
-	if len(data) != 4 {
-		return fmt.Errorf("control message 'abort' invalid length <%d>", len(data))
+func (c *Conn) handleControlMessage(msg *rtmp.Message) error {
+	m, err := rtmp.Parse(msg)
+	if err != nil {
+		return err
 	}
-	csid := binary.BigEndian.Uint32(data)
-	// 这个没发回收了
-	delete(c.readMessage, csid)
-	return
+	switch m := m.(type) {
+	case *rtmp.SetPeerBandwidth:
+		logDebug("control message 'set bandwidth'")
+		c.bandWidth = m.Size
+		c.bandWidthLimit = m.LimitType
+	case *rtmp.WindowAckSize:
+		logDebug("control message 'window acknowledgement size'")
+		c.windowAcknowledgeSize = m.Size
+	case *rtmp.Acknowledgement:
+		logDebug("control message 'acknowledgement'")
+	case *rtmp.Abort:
+		// reader已经丢弃了没读完的消息
+		logDebug("control message 'abort'")
+	case *rtmp.SetChunkSize:
+		// reader已经应用了新的chunk size
+		logDebug("control message 'set chunk size'")
+	}
+	return nil
 }
 
-func (c *Conn) handleControlMessageSetChunkSize(msg *rtmp.Message) (err error) {
-	data := msg.Data.Bytes()
-	if len(data) != 4 {
-		return fmt.Errorf("control message 'set chunk size' invalid length <%d>", len(data))
+func (c *Conn) handleUserControlMessage(msg *rtmp.Message) error {
+	m, err := rtmp.Parse(msg)
+	if err != nil {
+		// 不支持的事件，忽略
+		logDebug(err.Error())
+		return nil
 	}
-	c.readChunkSize = binary.BigEndian.Uint32(msg.Data.Bytes())
-	if c.readChunkSize > rtmp.MaxChunkSize {
-		c.readChunkSize = rtmp.MaxChunkSize
+	switch m := m.(type) {
+	case *rtmp.PingRequest:
+		logDebug("user control message 'ping request'")
+		c.cacheControlMessage(&rtmp.PingResponse{Timestamp: m.Timestamp})
+		return c.writeSyncMessages()
 	}
-	return
+	return nil
 }
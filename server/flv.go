@@ -0,0 +1,56 @@
+package server
+
+import (
+	"encoding/binary"
+	"io"
+)
+
+const (
+	flvCodecAVC       = 7
+	flvCodecHEVC      = 12
+	flvSoundFormatAAC = 10
+	// flv header的TypeFlags
+	flvFlagAudio = 4
+	flvFlagVideo = 1
+)
+
+var (
+	// 有音频和视频，后面是第一个PreviousTagSize
+	flvHeader = []byte{'F', 'L', 'V', 1, flvFlagAudio | flvFlagVideo, 0, 0, 0, 9, 0, 0, 0, 0}
+)
+
+// 写flv的header，flags是flvFlagAudio和flvFlagVideo
+func writeFLVHeader(w io.Writer, flags byte) error {
+	var b [13]byte
+	copy(b[:], flvHeader)
+	b[4] = flags
+	_, err := w.Write(b[:])
+	return err
+}
+
+// 写flv的tag，tag的类型和rtmp的消息类型一样，8音频，9视频，18数据
+func writeFLVTag(w io.Writer, typeID byte, timestamp uint32, data []byte) error {
+	var b [11]byte
+	b[0] = typeID
+	putUint24(b[1:], uint32(len(data)))
+	putUint24(b[4:], timestamp)
+	b[7] = byte(timestamp >> 24)
+	_, err := w.Write(b[:])
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(data)
+	if err != nil {
+		return err
+	}
+	// PreviousTagSize
+	binary.BigEndian.PutUint32(b[:], uint32(len(data)+11))
+	_, err = w.Write(b[:4])
+	return err
+}
+
+func putUint24(b []byte, n uint32) {
+	b[0] = byte(n >> 16)
+	b[1] = byte(n >> 8)
+	b[2] = byte(n)
+}
@@ -0,0 +1,76 @@
+package server
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"testing"
+
+	"github.com/qq51529210/rtmp"
+)
+
+// 读取一个flv的tag，检查PreviousTagSize
+func readFLVTag(r io.Reader) (typeID byte, timestamp uint32, data []byte, err error) {
+	var b [11]byte
+	_, err = io.ReadFull(r, b[:])
+	if err != nil {
+		return
+	}
+	typeID = b[0]
+	n := uint32(b[1])<<16 | uint32(b[2])<<8 | uint32(b[3])
+	timestamp = uint32(b[7])<<24 | uint32(b[4])<<16 | uint32(b[5])<<8 | uint32(b[6])
+	data = make([]byte, n)
+	_, err = io.ReadFull(r, data)
+	if err != nil {
+		return
+	}
+	_, err = io.ReadFull(r, b[:4])
+	if err != nil {
+		return
+	}
+	if size := binary.BigEndian.Uint32(b[:4]); size != n+11 {
+		err = fmt.Errorf("previous tag size <%d>", size)
+	}
+	return
+}
+
+func TestFLV(t *testing.T) {
+	var buf bytes.Buffer
+	err := writeFLVHeader(&buf, flvFlagAudio)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf.Bytes(), []byte{'F', 'L', 'V', 1, 4, 0, 0, 0, 9, 0, 0, 0, 0}) {
+		t.Fatal(buf.Bytes())
+	}
+	buf.Reset()
+	tags := []struct {
+		typeID    byte
+		timestamp uint32
+		data      []byte
+	}{
+		{rtmp.DataMessageAMF0, 0, []byte{2, 0, 1, 'a'}},
+		{rtmp.VideoMessage, 0x123456, []byte{0x17, 1}},
+		// 超过24位的时间戳
+		{rtmp.AudioMessage, 0x12345678, []byte{0xaf, 1}},
+	}
+	for _, tag := range tags {
+		err = writeFLVTag(&buf, tag.typeID, tag.timestamp, tag.data)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i, tag := range tags {
+		typeID, timestamp, data, err := readFLVTag(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if typeID != tag.typeID || timestamp != tag.timestamp || !bytes.Equal(data, tag.data) {
+			t.Fatal(i)
+		}
+	}
+	if buf.Len() != 0 {
+		t.FailNow()
+	}
+}
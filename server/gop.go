@@ -0,0 +1,164 @@
+package server
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/qq51529210/rtmp"
+)
+
+const (
+	DefaultGOPCacheGOPs     = 1
+	DefaultGOPCacheDuration = 10 * time.Second
+	DefaultGOPCacheBytes    = 8 * 1024 * 1024
+)
+
+// 缓存最近的gop，新的播放从关键帧开始，0使用默认值
+type GOPCacheConfig struct {
+	Disable     bool     `json:"disable"`     // 不缓存，延迟最低，但是播放要等到下一个关键帧
+	MaxGOPs     int      `json:"maxGOPs"`     // 缓存gop的数量
+	MaxDuration Duration `json:"maxDuration"` // 缓存的时长
+	MaxBytes    int      `json:"maxBytes"`    // 缓存的字节
+}
+
+func (c *GOPCacheConfig) validate(prefix string) error {
+	if c.MaxGOPs < 0 || c.MaxDuration < 0 || c.MaxBytes < 0 {
+		return fmt.Errorf("%s.'gopCache' negative", prefix)
+	}
+	return nil
+}
+
+// 是否视频的关键帧
+func isKeyFrame(data *StreamData) bool {
+	b := data.data.Bytes()
+	return data.typeID == rtmp.VideoMessage && len(b) > 0 && b[0]>>4 == 1
+}
+
+// gop缓存，第一个总是关键帧，缓存的数据引用一次，不是并发安全的
+type gopCache struct {
+	disable     bool
+	maxGOPs     int
+	maxDuration uint32 // 毫秒
+	maxBytes    int
+	data        []*StreamData
+	gops        int // 关键帧的数量
+	bytes       int
+}
+
+func newGOPCache(cfg *GOPCacheConfig) *gopCache {
+	c := new(gopCache)
+	c.disable = cfg.Disable
+	c.maxGOPs = cfg.MaxGOPs
+	if c.maxGOPs == 0 {
+		c.maxGOPs = DefaultGOPCacheGOPs
+	}
+	duration := time.Duration(cfg.MaxDuration)
+	if duration == 0 {
+		duration = DefaultGOPCacheDuration
+	}
+	c.maxDuration = uint32(duration / time.Millisecond)
+	c.maxBytes = cfg.MaxBytes
+	if c.maxBytes == 0 {
+		c.maxBytes = DefaultGOPCacheBytes
+	}
+	return c
+}
+
+// 添加数据，超过限制删除最旧的gop
+func (c *gopCache) add(data *StreamData) {
+	if c.disable {
+		return
+	}
+	key := isKeyFrame(data)
+	if key {
+		c.gops++
+	} else if len(c.data) < 1 {
+		// 等待关键帧
+		return
+	}
+	data.retain()
+	c.data = append(c.data, data)
+	c.bytes += data.data.Len()
+	if key && c.gops > c.maxGOPs {
+		c.removeGOP()
+	}
+	for len(c.data) > 0 && (c.bytes > c.maxBytes || c.duration() > c.maxDuration) {
+		c.removeGOP()
+	}
+}
+
+// 缓存的时长，交错的音频的时间戳可能比开始的关键帧小一点，负数当作0
+func (c *gopCache) duration() uint32 {
+	d := int32(c.data[len(c.data)-1].timestamp - c.data[0].timestamp)
+	if d < 0 {
+		return 0
+	}
+	return uint32(d)
+}
+
+// 删除最旧的gop，只有一个gop则全部删除
+func (c *gopCache) removeGOP() {
+	n := 1
+	for n < len(c.data) && !isKeyFrame(c.data[n]) {
+		n++
+	}
+	for _, data := range c.data[:n] {
+		c.bytes -= data.data.Len()
+		PutStreamData(data)
+	}
+	c.gops--
+	copy(c.data, c.data[n:])
+	for i := len(c.data) - n; i < len(c.data); i++ {
+		c.data[i] = nil
+	}
+	c.data = c.data[:len(c.data)-n]
+}
+
+// 返回缓存的拷贝，每个数据都增加了引用，使用完要PutStreamData
+func (c *gopCache) snapshot() []*StreamData {
+	if len(c.data) < 1 {
+		return nil
+	}
+	data := make([]*StreamData, len(c.data))
+	for i, d := range c.data {
+		d.retain()
+		data[i] = d
+	}
+	return data
+}
+
+// 释放所有的缓存
+func (c *gopCache) reset() {
+	for _, data := range c.data {
+		PutStreamData(data)
+	}
+	c.data = nil
+	c.gops = 0
+	c.bytes = 0
+}
+
+// 播放的时间戳从第一个数据开始是0
+type timestampBase struct {
+	base uint32
+	ok   bool
+}
+
+func (t *timestampBase) rebase(timestamp uint32) uint32 {
+	if !t.ok {
+		t.base = timestamp
+		t.ok = true
+	}
+	// gop中的音频可能比关键帧早一点
+	if int32(timestamp-t.base) < 0 {
+		return 0
+	}
+	return timestamp - t.base
+}
+
+// 开始播放时发送的数据，sequence header的时间戳是0
+func (t *timestampBase) start(data *StreamData) uint32 {
+	if isSequenceHeader(data) {
+		return 0
+	}
+	return t.rebase(data.timestamp)
+}
@@ -0,0 +1,148 @@
+package server
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/qq51529210/rtmp"
+)
+
+func testStreamData(typeID uint8, timestamp uint32, b ...byte) *StreamData {
+	msg := rtmp.GetMessage()
+	defer rtmp.PutMessage(msg)
+	msg.TypeID = typeID
+	msg.Timestamp = timestamp
+	msg.Data.Write(b)
+	return GetStreamData(msg)
+}
+
+func TestGOPCache(t *testing.T) {
+	c := newGOPCache(&GOPCacheConfig{MaxGOPs: 2, MaxBytes: 100, MaxDuration: Duration(time.Second)})
+	// 缓存增加了引用，这里的引用马上释放
+	add := func(data *StreamData) {
+		c.add(data)
+		PutStreamData(data)
+	}
+	// 等待关键帧
+	add(testStreamData(rtmp.VideoMessage, 0, 0x27, 1))
+	add(testStreamData(rtmp.AudioMessage, 0, 0xaf, 1))
+	if len(c.data) != 0 {
+		t.FailNow()
+	}
+	key1 := testStreamData(rtmp.VideoMessage, 100, 0x17, 1)
+	add(key1)
+	add(testStreamData(rtmp.AudioMessage, 110, 0xaf, 1))
+	add(testStreamData(rtmp.VideoMessage, 140, 0x27, 1))
+	add(testStreamData(rtmp.VideoMessage, 200, 0x17, 1))
+	if len(c.data) != 4 || c.gops != 2 || c.bytes != 8 {
+		t.FailNow()
+	}
+	// gop的数量
+	add(testStreamData(rtmp.VideoMessage, 300, 0x17, 1))
+	if len(c.data) != 2 || c.gops != 2 || c.data[0].timestamp != 200 || key1.data.Bytes() != nil {
+		t.FailNow()
+	}
+	snapshot := c.snapshot()
+	if len(snapshot) != 2 || snapshot[0] != c.data[0] {
+		t.FailNow()
+	}
+	for _, data := range snapshot {
+		PutStreamData(data)
+	}
+	// 时长
+	add(testStreamData(rtmp.VideoMessage, 1250, 0x27, 1))
+	if len(c.data) != 2 || c.data[0].timestamp != 300 {
+		t.FailNow()
+	}
+	// 字节，只有一个gop则全部删除
+	add(testStreamData(rtmp.VideoMessage, 1300, make([]byte, 100)...))
+	if len(c.data) != 0 || c.gops != 0 || c.bytes != 0 {
+		t.FailNow()
+	}
+	// 音频的时间戳比关键帧小
+	add(testStreamData(rtmp.VideoMessage, 1000, 0x17, 1))
+	add(testStreamData(rtmp.AudioMessage, 990, 0xaf, 1))
+	add(testStreamData(rtmp.VideoMessage, 1033, 0x27, 1))
+	if len(c.data) != 3 || c.gops != 1 || c.duration() != 33 {
+		t.FailNow()
+	}
+	// 关闭
+	c = newGOPCache(&GOPCacheConfig{Disable: true})
+	add(testStreamData(rtmp.VideoMessage, 0, 0x17, 1))
+	if len(c.data) != 0 {
+		t.FailNow()
+	}
+}
+
+func TestTimestampBase(t *testing.T) {
+	var ts timestampBase
+	for i, v := range [][2]uint32{{1000, 0}, {990, 0}, {1040, 40}, {999, 0}, {1080, 80}} {
+		if ts.rebase(v[0]) != v[1] {
+			t.Fatal(i)
+		}
+	}
+	ts = timestampBase{}
+	if ts.rebase(0xffffffff) != 0 || ts.rebase(39) != 40 {
+		t.FailNow()
+	}
+}
+
+func TestServerGOPCache(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := new(Server)
+	go s.Serve(context.Background(), ln)
+	defer s.Shutdown(context.Background())
+	url := "rtmp://" + ln.Addr().String() + "/live"
+	publisher := testDial(t, url)
+	defer publisher.Close()
+	err = publisher.Publish("test", "live")
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := &StreamKey{Vhost: DefaultVhost, App: "live", Name: "test"}
+	// 等待数据进入缓存
+	cached := func(n int) {
+		for i := 0; i < 100; i++ {
+			stream := s.GetPublishStream(key)
+			stream.lock.Lock()
+			ok := len(stream.gop.data) == n
+			stream.lock.Unlock()
+			if ok {
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		t.Fatal("not cached")
+	}
+	publisher.WriteVideo(1000, []byte{0x17, 0, 0, 0, 0})
+	publisher.WriteVideo(1000, []byte{0x17, 1, 0, 0, 0})
+	cached(1)
+	publisher.WriteVideo(1040, []byte{0x27, 1, 0, 0, 0})
+	cached(2)
+	player := testDial(t, url)
+	defer player.Close()
+	err = player.Play("test", -2, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// sequence header，关键帧，然后是之后的帧
+	var frames [][2]uint32
+	for len(frames) < 3 {
+		msg, err := player.ReadPacket()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if msg.TypeID == rtmp.VideoMessage {
+			frames = append(frames, [2]uint32{uint32(msg.Data.Bytes()[0]), msg.Timestamp})
+		}
+		rtmp.PutMessage(msg)
+	}
+	if frames[0] != [2]uint32{0x17, 0} || frames[1] != [2]uint32{0x17, 0} || frames[2] != [2]uint32{0x27, 40} {
+		t.Fatal(frames)
+	}
+}
@@ -0,0 +1,69 @@
+package server
+
+import (
+	"github.com/qq51529210/rtmp"
+)
+
+// 会话的回调，可以接受，拒绝，修改或者重定向会话。
+// 返回错误表示拒绝，错误的内容会发送给客户端。
+// 回调在连接的读协程中调用，不要阻塞太久。
+type Handler interface {
+	// 收到connect，可以修改cmd，返回RedirectError则重定向
+	OnConnect(c *Conn, cmd *rtmp.ConnectCommand) error
+	// 收到publish，可以修改cmd.PublishingName
+	OnPublish(c *Conn, cmd *rtmp.PublishCommand) error
+	// 收到play，可以修改cmd.StreamName
+	OnPlay(c *Conn, cmd *rtmp.PlayCommand) error
+	// 推流结束，key是发布的流
+	OnUnpublish(c *Conn, key *StreamKey)
+	// 连接关闭
+	OnStop(c *Conn)
+	// 服务端不处理的命令，比如releaseStream，FCPublish和自定义的调用，
+	// transaction id不是0时，返回值作为_result的information发送，错误则发送_error
+	OnCommand(c *Conn, cmd rtmp.Command) (interface{}, error)
+	// 收到数据消息，values是解码后的数据，比如@setDataFrame，onMetaData，metadata
+	OnData(c *Conn, values []interface{}) error
+}
+
+// 默认的回调，接受所有的会话，可以嵌入到其他的Handler
+type DefaultHandler struct{}
+
+func (DefaultHandler) OnConnect(c *Conn, cmd *rtmp.ConnectCommand) error {
+	return nil
+}
+
+func (DefaultHandler) OnPublish(c *Conn, cmd *rtmp.PublishCommand) error {
+	return nil
+}
+
+func (DefaultHandler) OnPlay(c *Conn, cmd *rtmp.PlayCommand) error {
+	return nil
+}
+
+func (DefaultHandler) OnUnpublish(c *Conn, key *StreamKey) {
+}
+
+func (DefaultHandler) OnStop(c *Conn) {
+}
+
+func (DefaultHandler) OnCommand(c *Conn, cmd rtmp.Command) (interface{}, error) {
+	return nil, nil
+}
+
+func (DefaultHandler) OnData(c *Conn, values []interface{}) error {
+	return nil
+}
+
+// OnConnect返回，重定向到URL
+type RedirectError struct {
+	URL string
+}
+
+func (e *RedirectError) Error() string {
+	return "redirect to " + e.URL
+}
+
+// 重定向到url
+func Redirect(url string) error {
+	return &RedirectError{URL: url}
+}
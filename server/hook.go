@@ -0,0 +1,186 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	DefaultHookTimeout = 5 * time.Second
+	HookOnConnect      = "on_connect"
+	HookOnPublish      = "on_publish"
+	HookOnUnpublish    = "on_unpublish"
+	HookOnPlay         = "on_play"
+	HookOnStop         = "on_stop"
+	HookOnRecordDone   = "on_record_done"
+)
+
+var (
+	hookClient = new(http.Client)
+)
+
+// http回调的地址，空则不回调，
+// onConnect，onPublish和onPlay的响应可以拒绝会话，其他的只是通知
+type HooksConfig struct {
+	OnConnect    string   `json:"onConnect"`
+	OnPublish    string   `json:"onPublish"`
+	OnUnpublish  string   `json:"onUnpublish"`
+	OnPlay       string   `json:"onPlay"`
+	OnStop       string   `json:"onStop"`
+	OnRecordDone string   `json:"onRecordDone"`
+	Timeout      Duration `json:"timeout"` // 一次请求的超时，0使用DefaultHookTimeout
+	Retry        int      `json:"retry"`   // 连接失败或者5xx的重试次数
+}
+
+// 回调POST的json
+type HookRequest struct {
+	Action   string            `json:"action"`   // on_connect，on_publish等
+	ClientID uint64            `json:"clientId"` // 连接的id
+	IP       string            `json:"ip"`
+	Vhost    string            `json:"vhost"`
+	App      string            `json:"app"`
+	Stream   string            `json:"stream,omitempty"`
+	Query    map[string]string `json:"query,omitempty"`
+	TcURL    string            `json:"tcUrl,omitempty"`
+	File     string            `json:"file,omitempty"` // on_record_done的文件
+}
+
+// 回调响应的json，非2xx或者code不是0表示拒绝，
+// 响应可以是空的，或者只有一个数字表示code
+type HookResponse struct {
+	Code   int    `json:"code"`
+	Reason string `json:"reason"` // 拒绝的原因
+	Stream string `json:"stream"` // 不是空则修改流的名称
+}
+
+func (c *HooksConfig) validate(prefix string) error {
+	for name, s := range map[string]string{
+		"onConnect":    c.OnConnect,
+		"onPublish":    c.OnPublish,
+		"onUnpublish":  c.OnUnpublish,
+		"onPlay":       c.OnPlay,
+		"onStop":       c.OnStop,
+		"onRecordDone": c.OnRecordDone,
+	} {
+		if s == "" {
+			continue
+		}
+		req, err := http.NewRequest(http.MethodPost, s, nil)
+		if err != nil {
+			return fmt.Errorf("%s.'hooks'.'%s' <%s> %s", prefix, name, s, err.Error())
+		}
+		if req.URL.Scheme != "http" && req.URL.Scheme != "https" {
+			return fmt.Errorf("%s.'hooks'.'%s' <%s> unsupported scheme", prefix, name, s)
+		}
+	}
+	if c.Timeout < 0 || c.Retry < 0 {
+		return fmt.Errorf("%s.'hooks' negative", prefix)
+	}
+	return nil
+}
+
+// 回调url，失败重试，返回错误表示拒绝
+func (c *HooksConfig) call(url string, req *HookRequest) (*HookResponse, error) {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+	timeout := time.Duration(c.Timeout)
+	if timeout == 0 {
+		timeout = DefaultHookTimeout
+	}
+	for i := 0; ; i++ {
+		res, retry, err := postHook(url, body, timeout)
+		if err == nil || !retry || i >= c.Retry {
+			return res, err
+		}
+		time.Sleep(time.Duration(i+1) * 100 * time.Millisecond)
+	}
+}
+
+// 返回响应，以及失败后是否可以重试
+func postHook(url string, body []byte, timeout time.Duration) (*HookResponse, bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	res, err := hookClient.Do(req)
+	if err != nil {
+		return nil, true, fmt.Errorf("hook <%s> %s", url, err.Error())
+	}
+	defer res.Body.Close()
+	b, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, true, fmt.Errorf("hook <%s> %s", url, err.Error())
+	}
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return nil, res.StatusCode >= 500, fmt.Errorf("hook <%s> status <%d>", url, res.StatusCode)
+	}
+	r := new(HookResponse)
+	b = bytes.TrimSpace(b)
+	if len(b) > 0 {
+		if code, err := strconv.Atoi(string(b)); err == nil {
+			r.Code = code
+		} else if err = json.Unmarshal(b, r); err != nil {
+			return nil, false, fmt.Errorf("hook <%s> response <%s>", url, err.Error())
+		}
+	}
+	if r.Code != 0 {
+		if r.Reason != "" {
+			return r, false, fmt.Errorf("hook <%s> code <%d> <%s>", url, r.Code, r.Reason)
+		}
+		return r, false, fmt.Errorf("hook <%s> code <%d>", url, r.Code)
+	}
+	return r, false, nil
+}
+
+// 连接的回调数据
+func (c *Conn) hookRequest(action string, key *StreamKey) *HookRequest {
+	req := &HookRequest{
+		Action:   action,
+		ClientID: c.id,
+		IP:       c.remoteIP(),
+		Vhost:    key.Vhost,
+		App:      key.App,
+		Stream:   key.Name,
+		Query:    make(map[string]string),
+	}
+	for k := range key.Query {
+		req.Query[k] = key.Query.Get(k)
+	}
+	if c.connect != nil {
+		req.TcURL = c.connect.CommandObject.TcURL
+	}
+	return req
+}
+
+// 回调url，返回错误表示拒绝，url是空则不回调
+func (c *Conn) hook(url, action string, key *StreamKey) (*HookResponse, error) {
+	if url == "" {
+		return &HookResponse{}, nil
+	}
+	return c.vhost.Hooks.call(url, c.hookRequest(action, key))
+}
+
+// 通知，不等待响应
+func (c *Conn) notify(url string, req *HookRequest) {
+	if url == "" {
+		return
+	}
+	hooks := c.vhost.Hooks
+	go func() {
+		_, err := hooks.call(url, req)
+		if err != nil {
+			logError(err)
+		}
+	}()
+}
@@ -0,0 +1,177 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/qq51529210/rtmp"
+)
+
+func TestHookCall(t *testing.T) {
+	var calls int32
+	hs := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&calls, 1)
+		switch r.URL.Path {
+		case "/empty":
+		case "/zero":
+			w.Write([]byte("0"))
+		case "/deny":
+			w.Write([]byte(`{"code":1,"reason":"no"}`))
+		case "/forbidden":
+			w.WriteHeader(http.StatusForbidden)
+		case "/retry":
+			// 第一次失败
+			if n%2 == 1 {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+			w.Write([]byte(`{"code":0,"stream":"b"}`))
+		case "/slow":
+			time.Sleep(200 * time.Millisecond)
+		}
+	}))
+	defer hs.Close()
+	hooks := &HooksConfig{Timeout: Duration(50 * time.Millisecond)}
+	req := &HookRequest{Action: HookOnPublish}
+	for _, p := range []string{"/empty", "/zero"} {
+		_, err := hooks.call(hs.URL+p, req)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, p := range []string{"/deny", "/forbidden", "/retry", "/slow"} {
+		_, err := hooks.call(hs.URL+p, req)
+		if err == nil {
+			t.Fatal(p)
+		}
+	}
+	// 重试
+	hooks.Retry = 1
+	atomic.StoreInt32(&calls, 0)
+	res, err := hooks.call(hs.URL+"/retry", req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Stream != "b" || atomic.LoadInt32(&calls) != 2 {
+		t.FailNow()
+	}
+	// 4xx不重试
+	atomic.StoreInt32(&calls, 0)
+	hooks.call(hs.URL+"/forbidden", req)
+	if atomic.LoadInt32(&calls) != 1 {
+		t.FailNow()
+	}
+}
+
+func TestServerHook(t *testing.T) {
+	requests := make(chan *HookRequest, 16)
+	hs := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		req := new(HookRequest)
+		err := json.NewDecoder(r.Body).Decode(req)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		requests <- req
+		switch {
+		case req.Action == HookOnConnect && req.App == "deny":
+			w.Write([]byte(`{"code":403}`))
+		case req.Action == HookOnPublish:
+			// 重命名
+			w.Write([]byte(`{"code":0,"stream":"test"}`))
+		case req.Action == HookOnPlay && req.Query["token"] != "a":
+			w.WriteHeader(http.StatusForbidden)
+		}
+	}))
+	defer hs.Close()
+	cfg := DefaultConfig()
+	cfg.Hooks = HooksConfig{
+		OnConnect:   hs.URL,
+		OnPublish:   hs.URL,
+		OnUnpublish: hs.URL,
+		OnPlay:      hs.URL,
+		OnStop:      hs.URL,
+	}
+	err := cfg.Validate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := new(Server)
+	s.SetConfig(cfg)
+	go s.Serve(context.Background(), ln)
+	defer s.Shutdown(context.Background())
+	url := "rtmp://" + ln.Addr().String()
+	expect := func(action string) *HookRequest {
+		select {
+		case req := <-requests:
+			if req.Action != action {
+				t.Fatal(req.Action)
+			}
+			return req
+		case <-time.After(time.Second):
+			t.Fatal(action)
+		}
+		return nil
+	}
+	// 拒绝connect
+	c, err := rtmp.Dial(url + "/deny")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Connect() == nil {
+		t.FailNow()
+	}
+	expect(HookOnConnect)
+	c.Close()
+	// 修改推流的名称
+	publisher := testDial(t, url+"/live")
+	req := expect(HookOnConnect)
+	if req.Vhost != DefaultVhost || req.App != "live" || req.IP != "127.0.0.1" || req.ClientID < 1 {
+		t.Fatal(req)
+	}
+	err = publisher.Publish("key?k=v", "live")
+	if err != nil {
+		t.Fatal(err)
+	}
+	req = expect(HookOnPublish)
+	if req.Stream != "key" || req.Query["k"] != "v" {
+		t.Fatal(req)
+	}
+	// 拒绝play
+	player := testDial(t, url+"/live")
+	defer player.Close()
+	expect(HookOnConnect)
+	if player.Play("test", -2, -1) == nil {
+		t.FailNow()
+	}
+	expect(HookOnPlay)
+	err = player.Play("test?token=a", -2, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect(HookOnPlay)
+	// 推流结束，通知是异步的
+	publisher.Close()
+	actions := make(map[string]string)
+	for i := 0; i < 2; i++ {
+		select {
+		case req = <-requests:
+			actions[req.Action] = req.Stream
+		case <-time.After(time.Second):
+			t.Fatal(actions)
+		}
+	}
+	if actions[HookOnUnpublish] != "test" || actions[HookOnStop] != "" || len(actions) != 2 {
+		t.Fatal(actions)
+	}
+}
@@ -0,0 +1,103 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/qq51529210/rtmp"
+)
+
+// http-flv播放，路径是/app/name.flv，和rtmp一样检查配置的app，访问规则和播放的token
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if !strings.HasSuffix(r.URL.Path, ".flv") {
+		http.NotFound(w, r)
+		return
+	}
+	key, err := parseHTTPKey(r.Host, strings.TrimSuffix(r.URL.Path, ".flv"), r.URL.Query())
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	var vhost *VhostConfig
+	key.Vhost, vhost, err = s.Config().vhost(key.Vhost)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	app, err := vhost.app(key.App)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	ip := r.RemoteAddr
+	if host, _, err := net.SplitHostPort(ip); err == nil {
+		ip = host
+	}
+	if err = vhost.access(app).check(TokenPlay, ip); err != nil {
+		s.rejectAccess(err)
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	if app.DisablePlay || vhost.auth(app).check(TokenPlay, key, ip) != nil {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	stream := s.GetPublishStream(key)
+	if stream == nil || s.isShutdown() {
+		http.NotFound(w, r)
+		return
+	}
+	sub, start := stream.subscribe(r.RemoteAddr, nil)
+	defer stream.unsubscribe(sub)
+	defer func() {
+		for _, data := range start {
+			PutStreamData(data)
+		}
+	}()
+	w.Header().Set("Content-Type", "video/x-flv")
+	err = writeFLVHeader(w, stream.flvFlags())
+	if err != nil {
+		return
+	}
+	// 先发送onMetaData和sequence header
+	metaData := stream.MetaData()
+	if len(metaData) > 0 {
+		err = writeFLVTag(w, rtmp.DataMessageAMF0, 0, metaData)
+		if err != nil {
+			return
+		}
+	}
+	// sequence header的时间戳是0，缓存的gop的时间戳从0开始
+	var ts timestampBase
+	for _, data := range start {
+		err = writeFLVTag(w, data.typeID, ts.start(data), data.data.Bytes())
+		if err != nil {
+			return
+		}
+	}
+	flusher, _ := w.(http.Flusher)
+	for {
+		if flusher != nil {
+			flusher.Flush()
+		}
+		// 推流结束，太慢或者客户端断开
+		data := sub.next(r.Context().Done())
+		if data == nil {
+			if sub.isSlow() {
+				logError(fmt.Errorf("player <%s> too slow", r.RemoteAddr))
+			}
+			return
+		}
+		err = writeFLVTag(w, data.typeID, ts.rebase(data.timestamp), data.data.Bytes())
+		PutStreamData(data)
+		if err != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,110 @@
+package server
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/qq51529210/rtmp"
+)
+
+func TestServerHTTPFLV(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := new(Server)
+	go s.Serve(context.Background(), ln)
+	defer s.Shutdown(context.Background())
+	hs := httptest.NewServer(s)
+	defer hs.Close()
+	for _, c := range []struct {
+		method, path string
+		code         int
+	}{
+		{http.MethodPost, "/live/test.flv", http.StatusMethodNotAllowed},
+		{http.MethodGet, "/live/test", http.StatusNotFound},
+		{http.MethodGet, "/live/test.flv", http.StatusNotFound},
+	} {
+		req, err := http.NewRequest(c.method, hs.URL+c.path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if res.StatusCode != c.code {
+			t.Fatal(c.path, res.Status)
+		}
+	}
+	publisher := testDial(t, "rtmp://"+ln.Addr().String()+"/live")
+	defer publisher.Close()
+	err = publisher.Publish("test", "live")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = publisher.WriteMetadata(map[string]interface{}{"videocodecid": 7})
+	if err != nil {
+		t.Fatal(err)
+	}
+	publisher.WriteVideo(1000, []byte{0x17, 0, 0, 0, 0})
+	publisher.WriteVideo(1000, []byte{0x17, 1, 0, 0, 0})
+	key := &StreamKey{Vhost: DefaultVhost, App: "live", Name: "test"}
+	for i := 0; i < 100; i++ {
+		if stream := s.GetPublishStream(key); stream != nil {
+			stream.lock.RLock()
+			ok := len(stream.gop.data) == 1
+			stream.lock.RUnlock()
+			if ok {
+				break
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	res, err := http.Get(hs.URL + "/live/test.flv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK || res.Header.Get("Content-Type") != "video/x-flv" {
+		t.Fatal(res.Status)
+	}
+	header := make([]byte, len(flvHeader))
+	_, err = io.ReadFull(res.Body, header)
+	if err != nil || header[4] != flvFlagVideo {
+		t.Fatal(err, header)
+	}
+	publisher.WriteVideo(1040, []byte{0x27, 1, 0, 0, 0})
+	// onMetaData，sequence header，缓存的gop，然后是之后的帧，时间戳从0开始
+	for i, tag := range []struct {
+		typeID    byte
+		timestamp uint32
+		b         byte
+	}{
+		{rtmp.DataMessageAMF0, 0, 2},
+		{rtmp.VideoMessage, 0, 0x17},
+		{rtmp.VideoMessage, 0, 0x17},
+		{rtmp.VideoMessage, 40, 0x27},
+	} {
+		typeID, timestamp, data, err := readFLVTag(res.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if typeID != tag.typeID || timestamp != tag.timestamp || len(data) < 1 || data[0] != tag.b {
+			t.Fatal(i, typeID, timestamp)
+		}
+	}
+	// 推流结束，响应也结束
+	publisher.Close()
+	data, err := ioutil.ReadAll(res.Body)
+	if err != nil || len(data) != 0 {
+		t.Fatal(err)
+	}
+}
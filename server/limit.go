@@ -0,0 +1,292 @@
+package server
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// 拒绝的原因，Server.Rejected的key
+	RejectMaxConns        = "max_conns"
+	RejectMaxConnsPerIP   = "max_conns_per_ip"
+	RejectConnectRate     = "connect_rate"
+	RejectMaxStreamsPerIP = "max_streams_per_ip"
+	RejectAccessDenied    = "access_denied"
+	// 多久清理一次不再使用的令牌桶
+	limiterSweepInterval = time.Minute
+)
+
+// 连接和推流的限制，0不限制，连接的限制在握手之前检查
+type LimitConfig struct {
+	MaxConns        int     `json:"maxConns"`        // 最大的连接数
+	MaxConnsPerIP   int     `json:"maxConnsPerIP"`   // 每个ip的最大连接数
+	ConnectRate     float64 `json:"connectRate"`     // 每个ip每秒可以建立的连接数
+	ConnectBurst    int     `json:"connectBurst"`    // 每个ip可以突发的连接数，0使用connectRate向上取整
+	MaxStreamsPerIP int     `json:"maxStreamsPerIP"` // 每个ip推流的最大数量
+}
+
+func (c *LimitConfig) validate() error {
+	if c.MaxConns < 0 || c.MaxConnsPerIP < 0 || c.ConnectBurst < 0 || c.MaxStreamsPerIP < 0 {
+		return fmt.Errorf("config.'limit' negative")
+	}
+	if c.ConnectRate < 0 || math.IsNaN(c.ConnectRate) || math.IsInf(c.ConnectRate, 0) {
+		return fmt.Errorf("config.'limit'.'connectRate' <%v> invalid", c.ConnectRate)
+	}
+	return nil
+}
+
+func (c *LimitConfig) burst() float64 {
+	if c.ConnectBurst > 0 {
+		return float64(c.ConnectBurst)
+	}
+	return math.Ceil(c.ConnectRate)
+}
+
+// ip的访问规则，可以是ip或者cidr，先检查deny，allow不是空则ip必须在allow中
+type AccessRule struct {
+	Allow []string `json:"allow"`
+	Deny  []string `json:"deny"`
+}
+
+// 推流和播放的访问规则
+type AccessConfig struct {
+	Publish AccessRule `json:"publish"`
+	Play    AccessRule `json:"play"`
+}
+
+func (c *AccessConfig) validate(prefix string) error {
+	for name, rules := range map[string][]string{
+		"publish'.'allow": c.Publish.Allow,
+		"publish'.'deny":  c.Publish.Deny,
+		"play'.'allow":    c.Play.Allow,
+		"play'.'deny":     c.Play.Deny,
+	} {
+		for _, s := range rules {
+			if parseIPNet(s) == nil {
+				return fmt.Errorf("%s.'access'.'%s' <%s> invalid", prefix, name, s)
+			}
+		}
+	}
+	return nil
+}
+
+// 检查ip是否可以推流或者播放，action是TokenPublish或者TokenPlay
+func (c *AccessConfig) check(action, ip string) error {
+	rule := &c.Play
+	if action == TokenPublish {
+		rule = &c.Publish
+	}
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		if len(rule.Allow) > 0 || len(rule.Deny) > 0 {
+			return fmt.Errorf("%s ip <%s> invalid", action, ip)
+		}
+		return nil
+	}
+	if matchIPNets(rule.Deny, addr) {
+		return fmt.Errorf("%s ip <%s> denied", action, ip)
+	}
+	if len(rule.Allow) > 0 && !matchIPNets(rule.Allow, addr) {
+		return fmt.Errorf("%s ip <%s> not allowed", action, ip)
+	}
+	return nil
+}
+
+// s是ip或者cidr，错误返回nil
+func parseIPNet(s string) *net.IPNet {
+	if strings.IndexByte(s, '/') >= 0 {
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil
+		}
+		return n
+	}
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return nil
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}
+}
+
+func matchIPNets(rules []string, ip net.IP) bool {
+	for _, s := range rules {
+		if n := parseIPNet(s); n != nil && n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// 令牌桶
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// 按照时间补充令牌
+func (b *tokenBucket) fill(now time.Time, rate, burst float64) {
+	b.tokens += now.Sub(b.last).Seconds() * rate
+	if b.tokens > burst {
+		b.tokens = burst
+	}
+	b.last = now
+}
+
+// 连接数，连接速率和每个ip推流数的限制，以及拒绝的计数
+type limiter struct {
+	lock      sync.Mutex
+	conns     int
+	ipConns   map[string]int
+	ipStreams map[string]int
+	buckets   map[string]*tokenBucket
+	sweep     time.Time
+	rejected  map[string]uint64
+}
+
+func (l *limiter) init() {
+	if l.ipConns == nil {
+		l.ipConns = make(map[string]int)
+		l.ipStreams = make(map[string]int)
+		l.buckets = make(map[string]*tokenBucket)
+		l.rejected = make(map[string]uint64)
+	}
+}
+
+// 新的连接，返回拒绝的原因，空表示接受，接受的连接关闭时要调用releaseConn
+func (l *limiter) acquireConn(cfg *LimitConfig, ip string, now time.Time) string {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.init()
+	if cfg != nil {
+		if cfg.MaxConns > 0 && l.conns >= cfg.MaxConns {
+			return l.reject(RejectMaxConns)
+		}
+		if cfg.MaxConnsPerIP > 0 && l.ipConns[ip] >= cfg.MaxConnsPerIP {
+			return l.reject(RejectMaxConnsPerIP)
+		}
+		if cfg.ConnectRate > 0 && !l.take(cfg, ip, now) {
+			return l.reject(RejectConnectRate)
+		}
+	}
+	l.conns++
+	l.ipConns[ip]++
+	return ""
+}
+
+func (l *limiter) releaseConn(ip string) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.conns--
+	if l.ipConns[ip]--; l.ipConns[ip] < 1 {
+		delete(l.ipConns, ip)
+	}
+}
+
+// 从ip的令牌桶中取一个令牌
+func (l *limiter) take(cfg *LimitConfig, ip string, now time.Time) bool {
+	rate, burst := cfg.ConnectRate, cfg.burst()
+	// 删除已经满了的桶，它们和新建的一样
+	if now.Sub(l.sweep) > limiterSweepInterval {
+		for k, b := range l.buckets {
+			if b.fill(now, rate, burst); b.tokens >= burst {
+				delete(l.buckets, k)
+			}
+		}
+		l.sweep = now
+	}
+	b, ok := l.buckets[ip]
+	if !ok {
+		b = &tokenBucket{tokens: burst, last: now}
+		l.buckets[ip] = b
+	}
+	b.fill(now, rate, burst)
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// ip推流，超过限制返回false
+func (l *limiter) acquireStream(cfg *LimitConfig, ip string) bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.init()
+	if cfg != nil && cfg.MaxStreamsPerIP > 0 && l.ipStreams[ip] >= cfg.MaxStreamsPerIP {
+		l.reject(RejectMaxStreamsPerIP)
+		return false
+	}
+	l.ipStreams[ip]++
+	return true
+}
+
+func (l *limiter) releaseStream(ip string) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.ipStreams[ip]--; l.ipStreams[ip] < 1 {
+		delete(l.ipStreams, ip)
+	}
+}
+
+// 计数，返回reason
+func (l *limiter) reject(reason string) string {
+	l.init()
+	l.rejected[reason]++
+	return reason
+}
+
+// 拒绝的次数，key是Reject*
+func (s *Server) Rejected() map[string]uint64 {
+	s.limiter.lock.Lock()
+	defer s.limiter.lock.Unlock()
+	m := make(map[string]uint64, len(s.limiter.rejected))
+	for k, v := range s.limiter.rejected {
+		m[k] = v
+	}
+	return m
+}
+
+// 连接的限制，nil不限制
+func (s *Server) limitConfig() *LimitConfig {
+	cfg := s.Config()
+	if cfg == nil {
+		return nil
+	}
+	return &cfg.Limit
+}
+
+// 检查连接的限制，接受返回true，拒绝则记录日志并关闭conn
+func (s *Server) admit(conn net.Conn) bool {
+	ip := addrIP(conn.RemoteAddr())
+	reason := s.limiter.acquireConn(s.limitConfig(), ip, time.Now())
+	if reason == "" {
+		return true
+	}
+	logError(fmt.Errorf("reject <%s> %s", conn.RemoteAddr().String(), reason))
+	conn.Close()
+	return false
+}
+
+// 访问规则拒绝推流或者播放，计数并记录日志
+func (s *Server) rejectAccess(err error) {
+	s.limiter.lock.Lock()
+	s.limiter.reject(RejectAccessDenied)
+	s.limiter.lock.Unlock()
+	logError(err)
+}
+
+// 地址的ip
+func addrIP(addr net.Addr) string {
+	s := addr.String()
+	if host, _, err := net.SplitHostPort(s); err == nil {
+		return host
+	}
+	return s
+}
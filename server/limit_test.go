@@ -0,0 +1,120 @@
+package server
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/qq51529210/rtmp"
+)
+
+func TestAccessConfig(t *testing.T) {
+	c := &AccessConfig{
+		Publish: AccessRule{Allow: []string{"10.0.0.0/8", "192.168.1.1"}, Deny: []string{"10.1.0.0/16"}},
+		Play:    AccessRule{Deny: []string{"::1"}},
+	}
+	if c.validate("config") != nil {
+		t.FailNow()
+	}
+	for ip, ok := range map[string]bool{
+		"10.0.0.1":    true,
+		"192.168.1.1": true,
+		"192.168.1.2": false,
+		"10.1.0.1":    false,
+		"::1":         false,
+	} {
+		if (c.check(TokenPublish, ip) == nil) != ok {
+			t.Fatal(ip)
+		}
+	}
+	if c.check(TokenPlay, "::1") == nil || c.check(TokenPlay, "10.1.0.1") != nil {
+		t.FailNow()
+	}
+	c.Play.Allow = []string{"10.0.0.0/33"}
+	if c.validate("config") == nil {
+		t.FailNow()
+	}
+}
+
+func TestLimiter(t *testing.T) {
+	var l limiter
+	now := time.Now()
+	cfg := &LimitConfig{ConnectRate: 1, ConnectBurst: 2, MaxConnsPerIP: 3}
+	// 突发2个，然后每秒1个
+	for i, reason := range []string{"", "", RejectConnectRate} {
+		if l.acquireConn(cfg, "1.1.1.1", now) != reason {
+			t.Fatal(i)
+		}
+	}
+	if l.acquireConn(cfg, "2.2.2.2", now) != "" {
+		t.FailNow()
+	}
+	now = now.Add(time.Second)
+	if l.acquireConn(cfg, "1.1.1.1", now) != "" {
+		t.FailNow()
+	}
+	now = now.Add(time.Minute)
+	if l.acquireConn(cfg, "1.1.1.1", now) != RejectMaxConnsPerIP {
+		t.FailNow()
+	}
+	l.releaseConn("1.1.1.1")
+	if l.acquireConn(cfg, "1.1.1.1", now) != "" {
+		t.FailNow()
+	}
+	cfg.MaxConns = 4
+	if l.acquireConn(cfg, "3.3.3.3", now) != RejectMaxConns {
+		t.FailNow()
+	}
+	if l.rejected[RejectConnectRate] != 1 || l.rejected[RejectMaxConnsPerIP] != 1 || l.rejected[RejectMaxConns] != 1 {
+		t.FailNow()
+	}
+}
+
+func TestServerLimit(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.Limit = LimitConfig{MaxConnsPerIP: 2, MaxStreamsPerIP: 1}
+	cfg.Access.Play.Allow = []string{"10.0.0.0/8"}
+	err := cfg.Validate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := new(Server)
+	s.SetConfig(cfg)
+	go s.Serve(context.Background(), ln)
+	defer s.Shutdown(context.Background())
+	url := "rtmp://" + ln.Addr().String() + "/live"
+	c1 := testDial(t, url)
+	defer c1.Close()
+	c2 := testDial(t, url)
+	defer c2.Close()
+	// 连接数
+	c3, err := rtmp.Dial(url)
+	if err == nil {
+		err = c3.Connect()
+		c3.Close()
+	}
+	if err == nil {
+		t.FailNow()
+	}
+	// 推流数
+	err = c1.Publish("a", "live")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c2.Publish("b", "live") == nil {
+		t.FailNow()
+	}
+	// 访问规则
+	if c2.Play("a", -2, -1) == nil {
+		t.FailNow()
+	}
+	rejected := s.Rejected()
+	if rejected[RejectMaxConnsPerIP] != 1 || rejected[RejectMaxStreamsPerIP] != 1 || rejected[RejectAccessDenied] != 1 {
+		t.Fatal(rejected)
+	}
+}
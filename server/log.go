@@ -0,0 +1,39 @@
+package server
+
+import (
+	"sync/atomic"
+
+	"github.com/qq51529210/log"
+)
+
+const (
+	LogDebug = iota
+	LogError
+	LogOff
+)
+
+var (
+	logLevel  int32 = LogDebug
+	logLevels       = map[string]int32{
+		"debug": LogDebug,
+		"error": LogError,
+		"off":   LogOff,
+	}
+)
+
+// 设置日志的级别，LogDebug，LogError或者LogOff
+func SetLogLevel(level int) {
+	atomic.StoreInt32(&logLevel, int32(level))
+}
+
+func logDebug(s string) {
+	if atomic.LoadInt32(&logLevel) <= LogDebug {
+		log.Debug(s)
+	}
+}
+
+func logError(err error) {
+	if atomic.LoadInt32(&logLevel) <= LogError {
+		log.Error(err)
+	}
+}
@@ -0,0 +1,56 @@
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// 把推流保存成flv文件，在Stream的锁中调用
+type recorder struct {
+	file   *os.File
+	writer *bufio.Writer
+	err    error
+	done   func(file string) // 关闭文件后调用，可能是nil
+}
+
+// 创建dir/app/name-unix时间.flv，name可以包含目录
+func newRecorder(dir string, key *StreamKey) (*recorder, error) {
+	name := filepath.Join(dir, filepath.FromSlash(key.String()))
+	err := os.MkdirAll(filepath.Dir(name), 0755)
+	if err != nil {
+		return nil, err
+	}
+	file, err := os.Create(fmt.Sprintf("%s-%d.flv", name, time.Now().Unix()))
+	if err != nil {
+		return nil, err
+	}
+	r := &recorder{file: file, writer: bufio.NewWriter(file)}
+	// 开始录制的时候还不知道有哪些轨道
+	r.err = writeFLVHeader(r.writer, flvFlagAudio|flvFlagVideo)
+	return r, nil
+}
+
+// 出错后不再写入
+func (r *recorder) write(typeID byte, timestamp uint32, data []byte) {
+	if r.err != nil {
+		return
+	}
+	r.err = writeFLVTag(r.writer, typeID, timestamp, data)
+	if r.err != nil {
+		logError(r.err)
+	}
+}
+
+func (r *recorder) close() {
+	err := r.writer.Flush()
+	if err != nil && r.err == nil {
+		logError(err)
+	}
+	r.file.Close()
+	if r.done != nil {
+		r.done(r.file.Name())
+	}
+}
@@ -0,0 +1,97 @@
+package server
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/qq51529210/rtmp"
+)
+
+func TestRecorder(t *testing.T) {
+	dir, err := ioutil.TempDir("", "record")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	// 流名称可以包含目录
+	r, err := newRecorder(dir, &StreamKey{App: "live", Name: "a/test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var file string
+	r.done = func(name string) { file = name }
+	r.write(rtmp.VideoMessage, 0, []byte{0x17, 0})
+	r.write(rtmp.AudioMessage, 20, []byte{0xaf, 1})
+	r.close()
+	if filepath.Dir(file) != filepath.Join(dir, "live", "a") ||
+		!strings.HasPrefix(filepath.Base(file), "test-") || filepath.Ext(file) != ".flv" {
+		t.Fatal(file)
+	}
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(data, flvHeader) {
+		t.FailNow()
+	}
+	buf := bytes.NewBuffer(data[len(flvHeader):])
+	for _, tag := range [][2]uint32{{rtmp.VideoMessage, 0}, {rtmp.AudioMessage, 20}} {
+		typeID, timestamp, _, err := readFLVTag(buf)
+		if err != nil || uint32(typeID) != tag[0] || timestamp != tag[1] {
+			t.Fatal(err, tag)
+		}
+	}
+	if buf.Len() != 0 {
+		t.FailNow()
+	}
+}
+
+func TestStreamRecorder(t *testing.T) {
+	dir, err := ioutil.TempDir("", "record")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	s := newStream(new(Conn))
+	// 推流的数据和开始录制，onMetaData同时进行
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := uint32(0); i < 100; i++ {
+			msg := rtmp.GetMessage()
+			msg.TypeID = rtmp.AudioMessage
+			msg.Timestamp = i * 20
+			msg.Data.Write([]byte{0xaf, 1})
+			s.AddAudio(msg)
+			rtmp.PutMessage(msg)
+		}
+	}()
+	r, err := newRecorder(dir, &StreamKey{App: "live", Name: "test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	recorded := make(chan string, 1)
+	r.done = func(name string) { recorded <- name }
+	s.setRecorder(r)
+	s.setMetaData(map[string]interface{}{"audiocodecid": 10}, true, false)
+	<-done
+	s.close()
+	data, err := ioutil.ReadFile(<-recorded)
+	if err != nil || !bytes.HasPrefix(data, flvHeader) || len(data) <= len(flvHeader) {
+		t.Fatal(err)
+	}
+	// 结束之后不再录制
+	r, err = newRecorder(dir, &StreamKey{App: "live", Name: "test2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.done = func(name string) { recorded <- name }
+	s.setRecorder(r)
+	if s.recorder != nil || len(recorded) != 1 {
+		t.FailNow()
+	}
+}
@@ -1,103 +1,384 @@
-package main
+package server
 
 import (
 	"bufio"
+	"context"
+	"errors"
+	"fmt"
 	"net"
 	"sync"
+	"sync/atomic"
+	"time"
 
-	"github.com/qq51529210/log"
 	"github.com/qq51529210/rtmp"
 )
 
+var (
+	// Shutdown之后，Serve和Listen返回的错误
+	ErrServerClosed        = errors.New("rtmp server closed")
+	errStreamExists        = errors.New("other stream is publishing")
+	errTooManyStreams      = errors.New("too many streams")
+	errTooManyStreamsPerIP = errors.New("too many streams from ip")
+	errNotConnected        = errors.New("connect first")
+	errConnPlaying         = errors.New("connection is playing")
+)
+
+// 字段是0的时候使用默认值，Serve之后使用SetConfig修改
 type Server struct {
+	connID                uint64 // 连接的id，atomic，放在最前面保证64位对齐
 	Address               string
-	listener              net.Listener
-	running               bool
-	Timestamp             uint32
 	WindowAcknowledgeSize uint32
 	BandWidth             uint32
 	BandWidthLimit        byte
 	ChunkSize             uint32
 	Version               uint32
+	HandshakeTimeout      time.Duration   // 握手的超时
+	ReadTimeout           time.Duration   // 读取一个消息的超时，0不超时
+	Handler               Handler         // 会话的回调，nil则使用DefaultHandler
+	Credentials           CredentialStore // 不是nil则所有的connect都需要adobe或者llnw验证
+	config                *Config         // 访问控制，录制和验证，nil则不使用
 	publishStreamLock     sync.RWMutex
-	publishStream         map[string]*Stream
+	publishStream         map[string]map[string]*Stream // vhost的流
+	initOnce              sync.Once
+	lock                  sync.Mutex
+	shutdown              bool
+	listeners             map[net.Listener]struct{}
+	conns                 map[*Conn]struct{}
+	connWG                sync.WaitGroup // 连接的协程
+	playWG                sync.WaitGroup // 播放的协程
+	challenges            authChallenges // adobe和llnw验证发出的challenge
+	limiter               limiter        // 连接和推流的限制
+}
+
+func (s *Server) init() {
+	s.initOnce.Do(func() {
+		s.publishStream = make(map[string]map[string]*Stream)
+		s.listeners = make(map[net.Listener]struct{})
+		s.conns = make(map[*Conn]struct{})
+	})
 }
 
+// 监听Address，然后Serve
 func (s *Server) Listen() (err error) {
-	s.listener, err = net.Listen("tcp", s.Address)
+	listener, err := net.Listen("tcp", s.Address)
 	if err != nil {
 		return
 	}
-	s.Timestamp = 1000 * 2
-	s.WindowAcknowledgeSize = 1024 * 5000
-	s.BandWidth = 1024 * 500
-	s.BandWidthLimit = 2
-	s.ChunkSize = 4 * 1024
-	s.publishStream = make(map[string]*Stream)
-	s.running = true
-	for s.running {
-		conn, err := s.listener.Accept()
+	return s.Serve(context.Background(), listener)
+}
+
+// 接受listener的连接，直到ctx取消或者Shutdown，返回时会关闭listener。
+// Shutdown之后返回ErrServerClosed，ctx取消返回ctx.Err()，
+// 已经接受的连接不受ctx影响，使用Shutdown关闭。
+func (s *Server) Serve(ctx context.Context, listener net.Listener) error {
+	s.init()
+	s.lock.Lock()
+	if s.shutdown {
+		s.lock.Unlock()
+		listener.Close()
+		return ErrServerClosed
+	}
+	s.listeners[listener] = struct{}{}
+	s.lock.Unlock()
+	defer func() {
+		s.lock.Lock()
+		delete(s.listeners, listener)
+		s.lock.Unlock()
+		listener.Close()
+	}()
+	// ctx取消后关闭listener，Accept返回错误
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			listener.Close()
+		case <-done:
+		}
+	}()
+	var delay time.Duration
+	for {
+		conn, err := listener.Accept()
 		if err != nil {
-			log.Error(err)
-			continue
+			if s.isShutdown() {
+				return ErrServerClosed
+			}
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				// 比如文件描述符不够，等一会再试
+				if delay == 0 {
+					delay = 5 * time.Millisecond
+				} else if delay *= 2; delay > time.Second {
+					delay = time.Second
+				}
+				logError(err)
+				time.Sleep(delay)
+				continue
+			}
+			return err
+		}
+		delay = 0
+		// 在这里检查限制，拒绝的连接不创建协程
+		if s.admit(conn) {
+			go s.serveConn(conn)
 		}
-		go s.ServeConn(conn)
 	}
-	return
 }
 
+// 使用cfg的值，可以在运行时调用，比如重新加载配置文件，
+// 新的值只对之后的连接和会话生效，不影响正在推流和播放的连接。
+// cfg应该是Validate过的，之后不要再修改
+func (s *Server) SetConfig(cfg *Config) {
+	s.lock.Lock()
+	s.Version = cfg.Version
+	s.ChunkSize = cfg.ChunkSize
+	s.WindowAcknowledgeSize = cfg.WindowAckSize
+	s.BandWidth = cfg.PeerBandwidth
+	s.BandWidthLimit = cfg.PeerBandwidthLimit
+	s.HandshakeTimeout = time.Duration(cfg.Timeout.Handshake)
+	s.ReadTimeout = time.Duration(cfg.Timeout.Read)
+	s.config = cfg
+	s.lock.Unlock()
+	SetLogLevel(int(logLevels[cfg.Log.Level]))
+}
+
+// 当前的配置，没有调用SetConfig返回nil
+func (s *Server) Config() *Config {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.config
+}
+
+// 连接使用的值，是0的使用默认值
+func (s *Server) connSettings(c *Conn) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	c.config = s.config
+	c.version = s.Version
+	c.handshakeTimeout = s.HandshakeTimeout
+	c.readTimeout = s.ReadTimeout
+	c.serverWindowAckSize = s.WindowAcknowledgeSize
+	c.serverBandWidth = s.BandWidth
+	c.serverBandWidthLimit = s.BandWidthLimit
+	c.serverChunkSize = s.ChunkSize
+	if c.handshakeTimeout == 0 {
+		c.handshakeTimeout = DefaultHandshakeTimeout
+	}
+	if c.serverWindowAckSize == 0 {
+		c.serverWindowAckSize = DefaultWindowAckSize
+	}
+	if c.serverBandWidth == 0 {
+		c.serverBandWidth = DefaultPeerBandwidth
+		c.serverBandWidthLimit = DefaultPeerBandwidthLimit
+	}
+	if c.serverChunkSize == 0 {
+		c.serverChunkSize = DefaultChunkSize
+	}
+}
+
+func (s *Server) isShutdown() bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.shutdown
+}
+
+// 开始一个播放协程，服务正在关闭则返回false。
+// 在s.lock中Add，避免和Shutdown中的Wait并发
+func (s *Server) addPlay() bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.shutdown {
+		return false
+	}
+	s.playWG.Add(1)
+	return true
+}
+
+// 优雅的关闭：停止接受新的连接，关闭推流的连接，通知播放的连接
+// NetStream.Play.UnpublishNotify和StreamEOF，发送完缓存的消息后关闭所有的连接。
+// ctx取消时直接关闭剩下的连接，返回ctx.Err()。
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.init()
+	s.lock.Lock()
+	s.shutdown = true
+	for listener := range s.listeners {
+		listener.Close()
+	}
+	s.lock.Unlock()
+	// 关闭推流的连接，连接的协程删除流之后，播放的协程会通知客户端
+	s.publishStreamLock.RLock()
+	publishers := make([]*Conn, 0, len(s.publishStream))
+	for _, streams := range s.publishStream {
+		for _, stream := range streams {
+			publishers = append(publishers, stream.publisher)
+		}
+	}
+	s.publishStreamLock.RUnlock()
+	// 客户端不读取的话会阻塞，不能等待
+	for _, c := range publishers {
+		go c.shutdown(ctx)
+	}
+	err := waitGroup(ctx, &s.playWG)
+	if err == nil {
+		// 发送完缓存的消息后关闭
+		for _, c := range s.connections() {
+			go c.shutdown(ctx)
+		}
+		err = waitGroup(ctx, &s.connWG)
+		if err == nil {
+			return nil
+		}
+	}
+	for _, c := range s.connections() {
+		c.conn.Close()
+	}
+	return err
+}
+
+func (s *Server) connections() []*Conn {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	conns := make([]*Conn, 0, len(s.conns))
+	for c := range s.conns {
+		conns = append(conns, c)
+	}
+	return conns
+}
+
+// 等待wg，或者ctx取消
+func waitGroup(ctx context.Context, wg *sync.WaitGroup) error {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// 处理一个连接，返回时连接已经关闭，超过了连接的限制直接关闭
 func (s *Server) ServeConn(conn net.Conn) {
-	log.Debug(conn.RemoteAddr().String())
+	if s.admit(conn) {
+		s.serveConn(conn)
+	}
+}
+
+// 处理admit接受的连接
+func (s *Server) serveConn(conn net.Conn) {
+	s.init()
+	ip := addrIP(conn.RemoteAddr())
+	defer s.limiter.releaseConn(ip)
+	logDebug(conn.RemoteAddr().String())
 	c := new(Conn)
+	c.id = atomic.AddUint64(&s.connID, 1)
+	c.closed = make(chan struct{})
 	c.server = s
-	c.readChunkSize = rtmp.ChunkSize
-	c.writeChunkSize = rtmp.ChunkSize
-	c.receiveAudio = true
-	c.receiveVideo = true
-	c.reader = bufio.NewReader(conn)
-	c.writer = conn
+	c.conn = conn
+	c.handler = s.Handler
+	if c.handler == nil {
+		c.handler = DefaultHandler{}
+	}
+	c.receiveAudio = 1
+	c.receiveVideo = 1
+	c.reader = rtmp.NewChunkReader(bufio.NewReader(conn))
+	c.writer = rtmp.NewChunkScheduler(conn)
+	c.transactions = rtmp.NewTransactionManager(c.sendCommand)
+	s.connSettings(c)
+	s.lock.Lock()
+	if s.shutdown {
+		s.lock.Unlock()
+		conn.Close()
+		return
+	}
+	s.conns[c] = struct{}{}
+	s.connWG.Add(1)
+	s.lock.Unlock()
 	defer func() {
-		if c.publishStream != nil {
-			s.DeleteStream(c.connectUrl.Path)
+		close(c.closed)
+		c.unpublish()
+		c.handler.OnStop(c)
+		if c.connect != nil {
+			c.notify(c.vhost.Hooks.OnStop, c.hookRequest(HookOnStop, c.connectKey))
 		}
+		// 发送完缓存的消息，比如拒绝connect的_error，客户端不读取的话最多等待一秒
+		conn.SetWriteDeadline(time.Now().Add(time.Second))
+		c.writer.Close()
 		conn.Close()
+		c.transactions.Close(nil)
+		s.lock.Lock()
+		delete(s.conns, c)
+		s.lock.Unlock()
+		s.connWG.Done()
 	}()
-	_, err := rtmp.HandshakeAccept(conn, s.Version)
+	conn.SetDeadline(time.Now().Add(c.handshakeTimeout))
+	_, err := rtmp.HandshakeAccept(conn, c.version)
 	if err != nil {
-		log.Error(err)
+		logError(err)
+		return
 	}
+	conn.SetDeadline(time.Time{})
 	err = c.readLoop()
-	if err != nil {
-		log.Error(err)
+	if err != nil && !s.isShutdown() {
+		logError(err)
 		return
 	}
 }
 
-func (s *Server) GetPublishStream(name string) *Stream {
+// 正在推的流，没有返回nil，key.Vhost是配置的vhost名称
+func (s *Server) GetPublishStream(key *StreamKey) *Stream {
 	s.publishStreamLock.RLock()
-	stream := s.publishStream[name]
+	stream := s.publishStream[key.Vhost][key.String()]
 	s.publishStreamLock.RUnlock()
 	return stream
 }
 
-func (s *Server) AddPublishStream(name string, timestamp uint32) (*Stream, bool) {
+// 添加推流，已经有相同的流，超过了vhost的maxStreams，ip的maxStreamsPerIP或者服务正在关闭则返回错误
+func (s *Server) AddPublishStream(key *StreamKey, publisher *Conn) (*Stream, error) {
+	if s.isShutdown() {
+		return nil, ErrServerClosed
+	}
 	s.publishStreamLock.Lock()
-	stream, ok := s.publishStream[name]
+	defer s.publishStreamLock.Unlock()
+	streams, ok := s.publishStream[key.Vhost]
 	if !ok {
-		stream = newStream()
-		s.publishStream[name] = stream
+		streams = make(map[string]*Stream)
+		s.publishStream[key.Vhost] = streams
 	}
-	s.publishStreamLock.Unlock()
-	return stream, !ok
+	name := key.String()
+	if _, ok = streams[name]; ok {
+		return nil, errStreamExists
+	}
+	if publisher.vhost != nil && publisher.vhost.MaxStreams > 0 && len(streams) >= publisher.vhost.MaxStreams {
+		return nil, errTooManyStreams
+	}
+	if ip := publisher.remoteIP(); !s.limiter.acquireStream(s.limitConfig(), ip) {
+		logError(fmt.Errorf("reject <%s> %s", ip, RejectMaxStreamsPerIP))
+		return nil, errTooManyStreamsPerIP
+	}
+	stream := newStream(publisher)
+	streams[name] = stream
+	return stream, nil
 }
 
-func (s *Server) DeleteStream(name string) {
+// 删除推流，通知所有播放的连接
+func (s *Server) DeleteStream(key *StreamKey) {
 	s.publishStreamLock.Lock()
-	stream, ok := s.publishStream[name]
+	streams := s.publishStream[key.Vhost]
+	name := key.String()
+	stream, ok := streams[name]
 	if ok {
-		delete(s.publishStream, name)
-		stream.valid = false
-		close(stream.dataConn)
+		delete(streams, name)
+		if len(streams) < 1 {
+			delete(s.publishStream, key.Vhost)
+		}
+		s.limiter.releaseStream(stream.publisher.remoteIP())
+		stream.close()
 	}
 	s.publishStreamLock.Unlock()
 }
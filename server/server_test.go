@@ -0,0 +1,429 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/qq51529210/rtmp"
+)
+
+type testHandler struct {
+	DefaultHandler
+	data chan []interface{}
+}
+
+func (h *testHandler) OnConnect(c *Conn, cmd *rtmp.ConnectCommand) error {
+	if cmd.CommandObject.App == "deny" {
+		return errors.New("denied")
+	}
+	return nil
+}
+
+func (h *testHandler) OnPublish(c *Conn, cmd *rtmp.PublishCommand) error {
+	// 重命名
+	if cmd.PublishingName == "key" {
+		cmd.PublishingName = "test"
+	}
+	return nil
+}
+
+func (h *testHandler) OnData(c *Conn, values []interface{}) error {
+	h.data <- values
+	return nil
+}
+
+func testDial(t *testing.T, url string) *rtmp.Client {
+	c, err := rtmp.Dial(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = c.Connect()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = c.CreateStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestServer(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := &testHandler{data: make(chan []interface{}, 1)}
+	s := new(Server)
+	s.WindowAcknowledgeSize = 1024 * 5000
+	s.BandWidth = 1024 * 500
+	s.BandWidthLimit = 2
+	s.ChunkSize = 4 * 1024
+	s.Handler = h
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- s.Serve(context.Background(), ln)
+	}()
+	url := "rtmp://" + ln.Addr().String()
+	// 拒绝
+	c, err := rtmp.Dial(url + "/deny")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Connect() == nil {
+		t.FailNow()
+	}
+	c.Close()
+	// 推流
+	publisher := testDial(t, url+"/live")
+	defer publisher.Close()
+	err = publisher.Publish("key", "live")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = publisher.WriteMetadata(map[string]interface{}{"videocodecid": 7, "audiocodecid": 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-h.data
+	publisher.WriteVideo(0, []byte{0x17, 0, 0, 0, 0})
+	publisher.WriteAudio(0, []byte{0xaf, 0, 0x12, 0x10})
+	// 播放重命名后的流
+	player := testDial(t, url+"/live")
+	defer player.Close()
+	unpublish := make(chan struct{})
+	player.Handle(rtmp.CommandOnStatus, func(streamID uint32, cmd rtmp.Command) (interface{}, error) {
+		if cmd.(*rtmp.OnStatusCommand).Info.Code == "NetStream.Play.UnpublishNotify" {
+			close(unpublish)
+		}
+		return nil, nil
+	})
+	err = player.Play("test", -2, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	video := make(chan struct{})
+	go func() {
+		defer close(video)
+		for {
+			msg, err := player.ReadPacket()
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			typeID := msg.TypeID
+			rtmp.PutMessage(msg)
+			if typeID == rtmp.VideoMessage {
+				return
+			}
+		}
+	}()
+	for ts := uint32(40); ; ts += 40 {
+		publisher.WriteVideo(ts, []byte{0x27, 1, 0, 0, 0})
+		select {
+		case <-video:
+		case <-time.After(10 * time.Millisecond):
+			continue
+		}
+		break
+	}
+	// 关闭
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	err = s.Shutdown(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-unpublish:
+	case <-time.After(time.Second):
+		t.Fatal("no unpublish notify")
+	}
+	if err = <-serveErr; err != ErrServerClosed {
+		t.Fatal(err)
+	}
+	if s.GetPublishStream(&StreamKey{Vhost: DefaultVhost, App: "live", Name: "test"}) != nil || len(s.connections()) != 0 {
+		t.FailNow()
+	}
+}
+
+func TestServerConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rtmp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cfg := DefaultConfig()
+	cfg.Apps = map[string]*AppConfig{
+		"live": {Record: true},
+		"vod":  {DisablePublish: true},
+	}
+	cfg.Record.Dir = dir
+	cfg.Auth.PublishToken = "p"
+	cfg.Auth.PlayToken = "q"
+	cfg.Log.Level = "off"
+	err = cfg.Validate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer SetLogLevel(LogDebug)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := new(Server)
+	s.SetConfig(cfg)
+	go s.Serve(context.Background(), ln)
+	defer s.Shutdown(context.Background())
+	url := "rtmp://" + ln.Addr().String()
+	// 没有配置的app
+	c, err := rtmp.Dial(url + "/other")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Connect() == nil {
+		t.FailNow()
+	}
+	c.Close()
+	// 不允许推流
+	c = testDial(t, url+"/vod")
+	if c.Publish("test?token=p", "live") == nil {
+		t.FailNow()
+	}
+	c.Close()
+	// token
+	publisher := testDial(t, url+"/live")
+	defer publisher.Close()
+	if publisher.Publish("test?token=x", "live") == nil {
+		t.FailNow()
+	}
+	err = publisher.Publish("test?token=p", "live")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = publisher.WriteMetadata(map[string]interface{}{"videocodecid": 7, "audiocodecid": 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	publisher.WriteVideo(0, []byte{0x17, 0, 0, 0, 0})
+	player := testDial(t, url+"/live?token=q")
+	defer player.Close()
+	err = player.Play("test", -2, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// http-flv
+	hs := httptest.NewServer(s)
+	defer hs.Close()
+	res, err := http.Get(hs.URL + "/live/test.flv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusForbidden {
+		t.Fatal(res.Status)
+	}
+	res, err = http.Get(hs.URL + "/live/test.flv?token=q")
+	if err != nil {
+		t.Fatal(err)
+	}
+	header := make([]byte, len(flvHeader))
+	_, err = io.ReadFull(res.Body, header)
+	res.Body.Close()
+	if err != nil || !bytes.Equal(header, flvHeader) {
+		t.Fatal(err)
+	}
+	// 录制
+	publisher.Close()
+	var files []string
+	for i := 0; i < 100 && len(files) < 1; i++ {
+		time.Sleep(10 * time.Millisecond)
+		files, _ = filepath.Glob(filepath.Join(dir, "live", "test-*.flv"))
+	}
+	if len(files) != 1 {
+		t.Fatal(files)
+	}
+}
+
+func TestServerVhost(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.Vhosts = map[string]*VhostConfig{
+		"a": {},
+		"b": {MaxStreams: 1, Auth: AuthConfig{PublishToken: "b"}},
+	}
+	err := cfg.Validate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := new(Server)
+	s.SetConfig(cfg)
+	go s.Serve(context.Background(), ln)
+	defer s.Shutdown(context.Background())
+	url := "rtmp://" + ln.Addr().String() + "/live?vhost="
+	// 没有配置的vhost
+	c, err := rtmp.Dial(url + "c")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Connect() == nil {
+		t.FailNow()
+	}
+	c.Close()
+	// 相同的名称
+	a := testDial(t, url+"a")
+	defer a.Close()
+	err = a.Publish("test", "live")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := testDial(t, url+"b&token=b")
+	defer b.Close()
+	err = b.Publish("test", "live")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// maxStreams
+	b2 := testDial(t, url+"b&token=b")
+	defer b2.Close()
+	if b2.Publish("other", "live") == nil {
+		t.FailNow()
+	}
+	if s.GetPublishStream(&StreamKey{Vhost: "a", App: "live", Name: "test"}) == nil ||
+		s.GetPublishStream(&StreamKey{Vhost: "b", App: "live", Name: "test"}) == nil ||
+		s.GetPublishStream(&StreamKey{Vhost: "b", App: "live", Name: "other"}) != nil {
+		t.FailNow()
+	}
+}
+
+func TestServerNotConnected(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := new(Server)
+	go s.Serve(context.Background(), ln)
+	defer s.Shutdown(context.Background())
+	url := "rtmp://" + ln.Addr().String() + "/live"
+	// 没有connect的publish和play
+	c, err := rtmp.Dial(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if c.Publish("test", "live") == nil || c.Play("test", -2, -1) == nil {
+		t.FailNow()
+	}
+	// 服务还在
+	publisher := testDial(t, url)
+	defer publisher.Close()
+	err = publisher.Publish("test", "live")
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// 客户端不读取数据，write一直阻塞，直到write deadline或者关闭
+type testStalledConn struct {
+	net.Conn
+	lock     sync.Mutex
+	stalled  bool
+	deadline time.Time
+	once     sync.Once
+	closed   chan struct{}
+}
+
+func (c *testStalledConn) stall() {
+	c.lock.Lock()
+	c.stalled = true
+	c.lock.Unlock()
+}
+
+func (c *testStalledConn) Write(b []byte) (int, error) {
+	c.lock.Lock()
+	stalled, deadline := c.stalled, c.deadline
+	c.lock.Unlock()
+	if !stalled {
+		return c.Conn.Write(b)
+	}
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		timer := time.NewTimer(time.Until(deadline))
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case <-timeout:
+		return 0, os.ErrDeadlineExceeded
+	case <-c.closed:
+		return 0, io.ErrClosedPipe
+	}
+}
+
+func (c *testStalledConn) SetDeadline(t time.Time) error {
+	c.SetWriteDeadline(t)
+	return c.Conn.SetDeadline(t)
+}
+
+func (c *testStalledConn) SetWriteDeadline(t time.Time) error {
+	c.lock.Lock()
+	c.deadline = t
+	c.lock.Unlock()
+	return c.Conn.SetWriteDeadline(t)
+}
+
+func (c *testStalledConn) Close() error {
+	c.once.Do(func() { close(c.closed) })
+	return c.Conn.Close()
+}
+
+func TestServerShutdownStalled(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	s := new(Server)
+	accepted := make(chan *testStalledConn, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		c := &testStalledConn{Conn: conn, closed: make(chan struct{})}
+		accepted <- c
+		s.ServeConn(c)
+	}()
+	client := testDial(t, "rtmp://"+ln.Addr().String()+"/live")
+	defer client.Close()
+	// 之后服务端的响应发送不出去
+	(<-accepted).stall()
+	go client.CreateStream()
+	time.Sleep(50 * time.Millisecond)
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	done := make(chan error, 1)
+	go func() { done <- s.Shutdown(ctx) }()
+	select {
+	case err = <-done:
+		if err != nil && err != context.DeadlineExceeded {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("shutdown blocked")
+	}
+}
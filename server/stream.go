@@ -1,133 +1,352 @@
-package main
+package server
 
 import (
 	"bytes"
 	"container/list"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/qq51529210/rtmp"
 )
 
-var (
-	StreamDataPool sync.Pool
+const (
+	// 多久检查一次太慢的播放
+	slowCheckInterval = time.Second
 )
 
-func init() {
-	StreamDataPool.New = func() interface{} {
-		return new(StreamData)
+// 取走msg的数据，不拷贝，引用计数是1
+func GetStreamData(msg *rtmp.Message) *StreamData {
+	return &StreamData{
+		typeID:    msg.TypeID,
+		timestamp: msg.Timestamp,
+		data:      rtmp.NewSharedData(msg),
 	}
 }
 
+// 减少引用，最后一次回收数据
 func PutStreamData(data *StreamData) {
-	data.referrence--
-	if data.referrence <= 0 {
-		StreamDataPool.Put(data)
-	}
+	data.data.Release()
 }
 
-func GetStreamData(msg *rtmp.Message) *StreamData {
-	data := StreamDataPool.Get().(*StreamData)
-	data.typeID = msg.TypeID
-	data.timestamp = msg.Timestamp
-	data.data.Reset()
-	data.data.Write(msg.Data.Bytes())
-	return data
+// 一个音/视频消息，创建之后不能修改，所有的播放共享
+type StreamData struct {
+	typeID    byte             // 音/视频
+	timestamp uint32           // 时间戳
+	data      *rtmp.SharedData // 数据，使用引用计数
 }
 
-// 表示一块音/视频数据
-type StreamData struct {
-	typeID     byte         // 音/视频
-	timestamp  uint32       // 时间戳
-	data       bytes.Buffer // 数据
-	referrence int          // 引用的次数
+// 增加引用
+func (d *StreamData) retain() *StreamData {
+	d.data.Retain()
+	return d
 }
 
-// 表示一块连续的音/视频数据块缓存
+// 一个推流，最近的数据保存在环形缓存中，每个播放使用自己的位置读取
 type Stream struct {
-	lock     sync.Mutex
-	valid    bool
-	dataConn chan *StreamData
-	playConn list.List
-	metaData bytes.Buffer
-	avc      *StreamData // 第一个avc，包含sps pps
-	acc      *StreamData
+	lock      sync.RWMutex
+	valid     bool
+	publisher *Conn     // 推流的连接
+	recorder  *recorder // 录制，可能是nil，使用lock
+	ring      []*StreamData
+	seq       uint64        // 下一个数据的序号，在ring中的位置是seq%len(ring)
+	notify    chan struct{} // 有新的数据或者推流结束时关闭
+	timestamp uint32        // 最新的时间戳
+	hasAudio  bool          // 收到过音频
+	hasVideo  bool          // 收到过视频
+	metaAudio bool          // onMetaData中有音频
+	metaVideo bool          // onMetaData中有视频
+	checked   time.Time     // 上次检查太慢的播放
+	playConn  list.List     // 播放的*subscriber
+	metaData  bytes.Buffer
+	avc       *StreamData // 最新的视频sequence header，包含sps pps
+	acc       *StreamData // 最新的音频sequence header
+	gop       *gopCache   // 最近的gop，新的播放先发送它
+	playQueue PlayQueueConfig
 }
 
-func newStream() *Stream {
+func newStream(publisher *Conn) *Stream {
 	stream := new(Stream)
 	stream.valid = true
-	stream.dataConn = make(chan *StreamData, 1)
-	go stream.Broadcast()
+	stream.publisher = publisher
+	var cfg GOPCacheConfig
+	if publisher.vhost != nil {
+		if app, err := publisher.appConfig(); err == nil {
+			cfg = app.GOPCache
+			stream.playQueue = app.PlayQueue
+		}
+	}
+	stream.gop = newGOPCache(&cfg)
+	size := stream.playQueue.Size
+	if size == 0 {
+		size = DefaultPlayQueueSize
+	}
+	stream.ring = make([]*StreamData, size)
+	stream.notify = make(chan struct{})
 	return stream
 }
 
 func (s *Stream) AddVideo(msg *rtmp.Message) {
+	s.addData(msg)
+}
+
+func (s *Stream) AddAudio(msg *rtmp.Message) {
+	s.addData(msg)
+}
+
+// 放入环形缓存，覆盖最旧的数据，唤醒所有等待的播放，
+// 不会因为播放而阻塞
+func (s *Stream) addData(msg *rtmp.Message) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if !s.valid {
+		return
+	}
+	s.record(msg)
 	data := GetStreamData(msg)
-	if s.avc == nil {
-		s.avc = data
+	if data.typeID == rtmp.VideoMessage {
+		s.hasVideo = true
 	} else {
-		select {
-		case s.dataConn <- data:
-		default:
+		s.hasAudio = true
+	}
+	if isSequenceHeader(data) {
+		if !s.setSequenceHeader(data) {
+			// 重复发送的相同的sequence header，播放已经有了
 			PutStreamData(data)
+			return
 		}
+	} else {
+		s.gop.add(data)
+		s.timestamp = data.timestamp
+	}
+	i := s.seq % uint64(len(s.ring))
+	if s.ring[i] != nil {
+		PutStreamData(s.ring[i])
+	}
+	s.ring[i] = data
+	s.seq++
+	close(s.notify)
+	s.notify = make(chan struct{})
+	if now := time.Now(); now.Sub(s.checked) >= slowCheckInterval {
+		s.checked = now
+		s.checkSlow()
 	}
 }
 
-func (s *Stream) AddAudio(msg *rtmp.Message) {
-	data := GetStreamData(msg)
-	if s.acc == nil {
-		s.acc = data
-	} else {
-		select {
-		case s.dataConn <- data:
-		default:
-			PutStreamData(data)
+// 断开一直没有读取的播放，比如网络阻塞了
+func (s *Stream) checkSlow() {
+	for ele := s.playConn.Front(); ele != nil; ele = ele.Next() {
+		sub := ele.Value.(*subscriber)
+		if int32(s.timestamp-atomic.LoadUint32(&sub.sent)) > int32(sub.maxLag) {
+			sub.disconnect()
+		}
+	}
+}
+
+// 是否avc/hevc或者aac的sequence header，
+// 视频是AVCPacketType是0，音频是AACPacketType是0
+func isSequenceHeader(data *StreamData) bool {
+	b := data.data.Bytes()
+	if len(b) < 2 {
+		return false
+	}
+	switch data.typeID {
+	case rtmp.VideoMessage:
+		codec := b[0] & 0x0f
+		return (codec == flvCodecAVC || codec == flvCodecHEVC) && b[1] == 0
+	case rtmp.AudioMessage:
+		return b[0]>>4 == flvSoundFormatAAC && b[1] == 0
+	default:
+		return false
+	}
+}
+
+// 保存新的sequence header，替换旧的，和旧的相同则返回false。
+// 视频的sequence header变了，缓存的gop不能再发送给新的播放
+func (s *Stream) setSequenceHeader(data *StreamData) bool {
+	old := &s.acc
+	if data.typeID == rtmp.VideoMessage {
+		old = &s.avc
+	}
+	if *old != nil {
+		if bytes.Equal((*old).data.Bytes(), data.data.Bytes()) {
+			return false
 		}
+		PutStreamData(*old)
+	}
+	*old = data.retain()
+	if data.typeID == rtmp.VideoMessage {
+		s.gop.reset()
+	}
+	return true
+}
+
+// 保存onMetaData，audio和video是其中有没有音视频
+func (s *Stream) setMetaData(metaData interface{}, audio, video bool) {
+	s.lock.Lock()
+	s.metaAudio, s.metaVideo = audio, video
+	s.metaData.Reset()
+	rtmp.WriteAMF(&s.metaData, "onMetaData")
+	rtmp.WriteAMF(&s.metaData, metaData)
+	if s.recorder != nil {
+		s.recorder.write(rtmp.DataMessageAMF0, 0, s.metaData.Bytes())
 	}
+	s.lock.Unlock()
 }
 
-func (s *Stream) AddPlayConn(c *Conn) {
+// 开始录制，推流结束时关闭r
+func (s *Stream) setRecorder(r *recorder) {
 	s.lock.Lock()
 	defer s.lock.Unlock()
-	for ele := s.playConn.Front(); ele != nil; ele = ele.Next() {
-		conn := ele.Value.(*Conn)
-		if conn == c {
-			return
+	if !s.valid {
+		r.close()
+		return
+	}
+	s.recorder = r
+}
+
+// 调用者持有锁
+func (s *Stream) record(msg *rtmp.Message) {
+	if s.recorder != nil {
+		s.recorder.write(msg.TypeID, msg.Timestamp, msg.Data.Bytes())
+	}
+}
+
+// 推流有哪些轨道，onMetaData中有的或者已经收到过数据的
+func (s *Stream) Tracks() (audio, video bool) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.metaAudio || s.hasAudio, s.metaVideo || s.hasVideo
+}
+
+// flv header的TypeFlags，还不知道有哪些轨道则音视频都有
+func (s *Stream) flvFlags() byte {
+	audio, video := s.Tracks()
+	var flags byte
+	if audio {
+		flags |= flvFlagAudio
+	}
+	if video {
+		flags |= flvFlagVideo
+	}
+	if flags == 0 {
+		flags = flvFlagAudio | flvFlagVideo
+	}
+	return flags
+}
+
+// 返回onMetaData的拷贝
+func (s *Stream) MetaData() []byte {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return append([]byte(nil), s.metaData.Bytes()...)
+}
+
+// 返回avc和acc的sequence header，可能是nil，使用完要PutStreamData
+func (s *Stream) sequenceHeaders() (avc, acc *StreamData) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.sequenceHeadersLocked()
+}
+
+func (s *Stream) sequenceHeadersLocked() (avc, acc *StreamData) {
+	for _, data := range []*StreamData{s.avc, s.acc} {
+		if data != nil {
+			data.retain()
 		}
 	}
-	s.playConn.PushBack(c)
+	return s.avc, s.acc
+}
+
+// 推流结束，播放发送完缓存中的数据后结束
+func (s *Stream) close() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.valid = false
+	close(s.notify)
+	s.gop.reset()
+	for _, data := range []*StreamData{s.avc, s.acc} {
+		if data != nil {
+			PutStreamData(data)
+		}
+	}
+	s.avc, s.acc = nil, nil
+	if s.playConn.Len() < 1 {
+		s.releaseRing()
+	}
+	if s.recorder != nil {
+		s.recorder.close()
+		s.recorder = nil
+	}
+}
+
+// 释放环形缓存，推流结束并且没有播放的时候
+func (s *Stream) releaseRing() {
+	for i, data := range s.ring {
+		if data != nil {
+			PutStreamData(data)
+			s.ring[i] = nil
+		}
+	}
+}
+
+// 添加播放的连接，返回sequence header和缓存的gop，发送后要PutStreamData
+func (s *Stream) AddPlayConn(c *Conn) []*StreamData {
+	var start []*StreamData
+	c.subscriber, start = s.subscribe(c.RemoteAddr().String(), func() { c.Close() })
+	return start
 }
 
 func (s *Stream) RemovePlayConn(c *Conn) {
+	s.unsubscribe(c.subscriber)
+}
+
+// 添加播放，返回当前的sequence header和缓存的gop，之后的数据从环形缓存读取
+// kick在播放太慢的时候调用，可以是nil
+func (s *Stream) subscribe(addr string, kick func()) (*subscriber, []*StreamData) {
+	sub := newSubscriber(s, addr, kick)
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	sub.cursor = s.seq
+	sub.sent = s.timestamp
+	if !s.valid {
+		// 已经结束了
+		return sub, nil
+	}
+	s.playConn.PushBack(sub)
+	var data []*StreamData
+	sub.avc, sub.acc = s.sequenceHeadersLocked()
+	for _, d := range []*StreamData{sub.avc, sub.acc} {
+		if d != nil {
+			data = append(data, d)
+		}
+	}
+	return sub, append(data, s.gop.snapshot()...)
+}
+
+// 删除播放，最后一个播放删除后释放结束的推流的缓存
+func (s *Stream) unsubscribe(sub *subscriber) {
+	sub.release()
 	s.lock.Lock()
 	defer s.lock.Unlock()
 	for ele := s.playConn.Front(); ele != nil; ele = ele.Next() {
-		conn := ele.Value.(*Conn)
-		if conn == c {
+		if ele.Value.(*subscriber) == sub {
 			s.playConn.Remove(ele)
-			close(conn.playChan)
-			return
+			break
 		}
 	}
+	if !s.valid && s.playConn.Len() < 1 {
+		s.releaseRing()
+	}
 }
 
-func (s *Stream) Broadcast() {
-	for s.valid {
-		data, ok := <-s.dataConn
-		if !ok {
-			return
-		}
-		s.lock.Lock()
-		data.referrence += s.playConn.Len()
-		for ele := s.playConn.Front(); ele != nil; ele = ele.Next() {
-			conn := ele.Value.(*Conn)
-			select {
-			case conn.playChan <- data:
-			default:
-				data.referrence--
-			}
-		}
-		s.lock.Unlock()
+// 所有播放的统计
+func (s *Stream) PlayStats() []PlayStats {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	stats := make([]PlayStats, 0, s.playConn.Len())
+	for ele := s.playConn.Front(); ele != nil; ele = ele.Next() {
+		stats = append(stats, ele.Value.(*subscriber).statsLocked())
 	}
+	return stats
 }
@@ -0,0 +1,268 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/qq51529210/rtmp"
+)
+
+func TestStreamSequenceHeader(t *testing.T) {
+	s := newStream(new(Conn))
+	defer s.close()
+	add := func(timestamp uint32, b ...byte) {
+		msg := rtmp.GetMessage()
+		msg.TypeID = rtmp.VideoMessage
+		msg.Timestamp = timestamp
+		msg.Data.Write(b)
+		s.AddVideo(msg)
+		rtmp.PutMessage(msg)
+	}
+	read := func(sub *subscriber) *StreamData {
+		timeout := make(chan struct{})
+		timer := time.AfterFunc(time.Second, func() { close(timeout) })
+		defer timer.Stop()
+		data := sub.next(timeout)
+		if data == nil {
+			t.Fatal("no data")
+		}
+		return data
+	}
+	// 开始推流之前的播放也能收到sequence header
+	sub1, start := s.subscribe("1", nil)
+	if len(start) != 0 {
+		t.FailNow()
+	}
+	header1 := []byte{0x17, 0, 0, 0, 0, 1}
+	add(0, header1...)
+	add(0, 0x17, 1, 0, 0, 0)
+	if !bytes.Equal(read(sub1).data.Bytes(), header1) || !isKeyFrame(read(sub1)) {
+		t.FailNow()
+	}
+	// 修改了分辨率
+	header2 := []byte{0x17, 0, 0, 0, 0, 2}
+	add(40, 0x27, 1, 0, 0, 0)
+	add(80, header2...)
+	add(80, 0x17, 1, 0, 0, 0)
+	read(sub1)
+	if !bytes.Equal(read(sub1).data.Bytes(), header2) || !isKeyFrame(read(sub1)) {
+		t.FailNow()
+	}
+	// 新的播放收到新的sequence header和之后的gop
+	_, start = s.subscribe("2", nil)
+	if len(start) != 2 || !bytes.Equal(start[0].data.Bytes(), header2) || start[1].timestamp != 80 {
+		t.FailNow()
+	}
+	// 重复的sequence header不替换也不转发，音频的不清空gop
+	seq := s.seq
+	add(120, header2...)
+	for i := 0; i < 2; i++ {
+		msg := rtmp.GetMessage()
+		msg.TypeID = rtmp.AudioMessage
+		msg.Timestamp = uint32(i)
+		msg.Data.Write([]byte{0xaf, 0, 0x12, 0x10})
+		s.AddAudio(msg)
+		rtmp.PutMessage(msg)
+	}
+	if s.seq != seq+1 || len(s.gop.data) != 1 || s.acc == nil || s.acc.timestamp != 0 {
+		t.FailNow()
+	}
+	if data := read(sub1); data.typeID != rtmp.AudioMessage {
+		t.FailNow()
+	}
+	// 非h264的视频没有sequence header
+	if isSequenceHeader(testStreamData(rtmp.VideoMessage, 0, 0x12, 0)) ||
+		!isSequenceHeader(testStreamData(rtmp.AudioMessage, 0, 0xaf, 0)) ||
+		isSequenceHeader(testStreamData(rtmp.AudioMessage, 0, 0x2f, 0)) {
+		t.FailNow()
+	}
+}
+
+func TestStreamTracks(t *testing.T) {
+	for i, c := range []struct {
+		metaData     map[string]interface{}
+		audio, video bool
+	}{
+		{map[string]interface{}{"videocodecid": 7, "audiocodecid": 10}, true, true},
+		{map[string]interface{}{"audiocodecid": "mp4a"}, true, false},
+		{map[string]interface{}{"videocodecid": 12}, false, true},
+		{map[string]interface{}{"videocodecid": 7, "audiocodecid": 10, "hasAudio": false}, false, true},
+		// 数字或者字符串的hasAudio和hasVideo，不能解析的忽略
+		{map[string]interface{}{"videocodecid": 7, "audiocodecid": 10, "hasAudio": 0, "hasVideo": 1}, false, true},
+		{map[string]interface{}{"hasAudio": "true", "hasVideo": "false", "videocodecid": 7}, true, false},
+		{map[string]interface{}{"audiocodecid": 10, "hasAudio": "x", "hasVideo": []interface{}{}}, true, false},
+	} {
+		amf, err := rtmp.MarshalAMF(c.metaData)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var codec metaDataCodec
+		err = rtmp.UnmarshalAMF(amf, &codec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if audio, video := codec.tracks(); audio != c.audio || video != c.video {
+			t.Fatal(i)
+		}
+	}
+	s := newStream(new(Conn))
+	defer s.close()
+	// 还不知道
+	if audio, video := s.Tracks(); audio || video || s.flvFlags() != flvFlagAudio|flvFlagVideo {
+		t.FailNow()
+	}
+	s.setMetaData(nil, true, false)
+	if audio, video := s.Tracks(); !audio || video || s.flvFlags() != flvFlagAudio {
+		t.FailNow()
+	}
+	// 收到的数据
+	msg := rtmp.GetMessage()
+	msg.TypeID = rtmp.VideoMessage
+	msg.Data.Write([]byte{0x17, 0, 0, 0, 0})
+	s.AddVideo(msg)
+	rtmp.PutMessage(msg)
+	if audio, video := s.Tracks(); !audio || !video {
+		t.FailNow()
+	}
+}
+
+func TestServerAudioOnly(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := new(Server)
+	go s.Serve(context.Background(), ln)
+	defer s.Shutdown(context.Background())
+	url := "rtmp://" + ln.Addr().String() + "/live"
+	publisher := testDial(t, url)
+	defer publisher.Close()
+	err = publisher.Publish("test", "live")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = publisher.WriteMetadata(map[string]interface{}{"audiocodecid": 10, "hasVideo": 0})
+	if err != nil {
+		t.Fatal(err)
+	}
+	publisher.WriteAudio(0, []byte{0xaf, 0, 0x12, 0x10})
+	key := &StreamKey{Vhost: DefaultVhost, App: "live", Name: "test"}
+	for i := 0; i < 100; i++ {
+		if stream := s.GetPublishStream(key); stream != nil && stream.flvFlags() == flvFlagAudio {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	player := testDial(t, url)
+	defer player.Close()
+	err = player.Play("test", -2, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Play.Start之后才开始播放，等待播放开始，否则之后的音频可能会错过
+	stream := s.GetPublishStream(key)
+	for i := 0; i < 100 && len(stream.PlayStats()) < 1; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	publisher.WriteAudio(20, []byte{0xaf, 1, 0})
+	// 只有音频的sequence header，然后是音频
+	var audio []byte
+	for len(audio) < 2 {
+		msg, err := player.ReadPacket()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if msg.TypeID == rtmp.VideoMessage {
+			t.Fatal("video")
+		}
+		if msg.TypeID == rtmp.AudioMessage {
+			audio = append(audio, msg.Data.Bytes()[1])
+		}
+		rtmp.PutMessage(msg)
+	}
+	if string(audio) != "\x00\x01" {
+		t.Fatal(audio)
+	}
+	// http-flv的header只有音频
+	hs := httptest.NewServer(s)
+	defer hs.Close()
+	res, err := http.Get(hs.URL + "/live/test.flv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	header := make([]byte, len(flvHeader))
+	_, err = io.ReadFull(res.Body, header)
+	if err != nil || header[4] != flvFlagAudio {
+		t.Fatal(err, header)
+	}
+}
+
+func TestServerReceiveAV(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := new(Server)
+	go s.Serve(context.Background(), ln)
+	defer s.Shutdown(context.Background())
+	url := "rtmp://" + ln.Addr().String() + "/live"
+	publisher := testDial(t, url)
+	defer publisher.Close()
+	err = publisher.Publish("test", "live")
+	if err != nil {
+		t.Fatal(err)
+	}
+	player := testDial(t, url)
+	defer player.Close()
+	err = player.Play("test", -2, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	receiveVideo := func(flag bool) {
+		err := player.Transactions().Send(player.StreamID(), &rtmp.ReceiveAVCommand{Flag: flag})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	// 播放的时候切换receiveVideo
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := uint32(0); i < 50; i++ {
+			publisher.WriteVideo(i*10, []byte{0x27, 1, 0, 0, 0})
+			publisher.WriteAudio(i*10, []byte{0xaf, 1, 0})
+			time.Sleep(time.Millisecond)
+		}
+	}()
+	for i := 0; i < 50; i++ {
+		receiveVideo(i%2 == 1)
+		time.Sleep(time.Millisecond)
+	}
+	<-done
+	// 不接收视频
+	receiveVideo(false)
+	time.Sleep(100 * time.Millisecond)
+	publisher.WriteVideo(2000, []byte{0x17, 1, 0, 0, 0})
+	publisher.WriteAudio(2000, []byte{0xaf, 1, 0})
+	for {
+		msg, err := player.ReadPacket()
+		if err != nil {
+			t.Fatal(err)
+		}
+		typeID, timestamp := msg.TypeID, msg.Timestamp
+		rtmp.PutMessage(msg)
+		if typeID == rtmp.VideoMessage && timestamp >= 2000 {
+			t.Fatal("video")
+		}
+		if typeID == rtmp.AudioMessage && timestamp >= 2000 {
+			break
+		}
+	}
+}
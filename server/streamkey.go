@@ -0,0 +1,98 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"path"
+	"strings"
+
+	"github.com/qq51529210/rtmp"
+)
+
+// 流的标识，rtmp://vhost/app/name?query，
+// 推流和播放使用相同的规则，注册，验证，录制和http-flv都使用它
+type StreamKey struct {
+	Vhost string     // tcUrl的host或者query参数vhost，connect之后是配置的vhost名称
+	App   string     // connect的app，去掉了query
+	Name  string     // publish或者play的名称，去掉了query
+	Query url.Values // tcUrl，app和名称的query参数，后面的覆盖前面的
+}
+
+// 在vhost的注册表中的名称，app/name
+func (k *StreamKey) String() string {
+	return k.App + "/" + k.Name
+}
+
+// 连接的vhost，app和query，app的query优先于tcUrl的
+func parseConnectKey(cmd *rtmp.ConnectCommand) (*StreamKey, error) {
+	u, err := url.Parse(cmd.CommandObject.TcURL)
+	if err != nil {
+		return nil, fmt.Errorf("command message.'connect'.'command object'.'tcUrl' <%s>", err.Error())
+	}
+	key := &StreamKey{Vhost: u.Hostname(), Query: u.Query()}
+	app, query := splitQuery(cmd.CommandObject.App)
+	mergeQuery(key.Query, query)
+	key.App = cleanName(app)
+	if key.App == "" {
+		// 有的客户端app是空的，使用tcUrl的路径
+		key.App = cleanName(u.Path)
+	}
+	if key.App == "" {
+		return nil, fmt.Errorf("command message.'connect'.'command object'.'app' empty")
+	}
+	if vhost := key.Query.Get("vhost"); vhost != "" {
+		key.Vhost = vhost
+	}
+	return key, nil
+}
+
+// 连接的key加上流名称，name是publish或者play的名称
+func (k *StreamKey) withName(name string) (*StreamKey, error) {
+	name, query := splitQuery(name)
+	key := &StreamKey{Vhost: k.Vhost, App: k.App, Name: cleanName(name), Query: url.Values{}}
+	if key.Name == "" {
+		return nil, fmt.Errorf("stream name empty")
+	}
+	mergeQuery(key.Query, k.Query)
+	mergeQuery(key.Query, query)
+	return key, nil
+}
+
+// http-flv的key，路径是/app/name，第一段是app
+func parseHTTPKey(host, p string, query url.Values) (*StreamKey, error) {
+	p = cleanName(p)
+	i := strings.IndexByte(p, '/')
+	if i < 0 {
+		return nil, fmt.Errorf("url path <%s> invalid", p)
+	}
+	key := &StreamKey{Vhost: host, App: p[:i], Name: p[i+1:], Query: query}
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		key.Vhost = h
+	}
+	if vhost := query.Get("vhost"); vhost != "" {
+		key.Vhost = vhost
+	}
+	return key, nil
+}
+
+// 去掉query
+func splitQuery(s string) (string, url.Values) {
+	i := strings.IndexByte(s, '?')
+	if i < 0 {
+		return s, url.Values{}
+	}
+	query, _ := url.ParseQuery(s[i+1:])
+	return s[:i], query
+}
+
+func mergeQuery(dst, src url.Values) {
+	for k, v := range src {
+		dst[k] = v
+	}
+}
+
+// 去掉两边的/和..，比如"/live/"是"live"
+func cleanName(s string) string {
+	return strings.Trim(path.Clean("/"+s), "/")
+}
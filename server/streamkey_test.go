@@ -0,0 +1,56 @@
+package server
+
+import (
+	"net/url"
+	"testing"
+
+	"github.com/qq51529210/rtmp"
+)
+
+func TestStreamKey(t *testing.T) {
+	connect := func(app, tcURL string) *StreamKey {
+		cmd := new(rtmp.ConnectCommand)
+		cmd.CommandObject.App = app
+		cmd.CommandObject.TcURL = tcURL
+		key, err := parseConnectKey(cmd)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return key
+	}
+	// obs
+	key, err := connect("live", "rtmp://example.com:1935/live").withName("key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key.Vhost != "example.com" || key.String() != "live/key" {
+		t.Fatal(key)
+	}
+	// query，名称的优先
+	key, err = connect("live?token=a&vhost=v", "rtmp://example.com/live?token=a&vhost=v").withName("/key?token=b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key.Vhost != "v" || key.String() != "live/key" || key.Query.Get("token") != "b" {
+		t.Fatal(key)
+	}
+	// 没有app
+	key = connect("", "rtmp://example.com/live/")
+	if key.App != "live" {
+		t.Fatal(key)
+	}
+	if _, err = key.withName("?token=a"); err == nil {
+		t.FailNow()
+	}
+	// http-flv
+	key, err = parseHTTPKey("example.com:8080", "/live/../live/key", url.Values{"token": {"a"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key.Vhost != "example.com" || key.String() != "live/key" || key.Query.Get("token") != "a" {
+		t.Fatal(key)
+	}
+	if _, err = parseHTTPKey("example.com", "/key", nil); err == nil {
+		t.FailNow()
+	}
+}
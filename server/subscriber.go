@@ -0,0 +1,271 @@
+package server
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/qq51529210/rtmp"
+)
+
+const (
+	DefaultPlayQueueSize   = 1024
+	DefaultPlayQueueMaxLag = 30 * time.Second
+)
+
+// 播放的缓存，0使用默认值
+type PlayQueueConfig struct {
+	Size   int      `json:"size"`   // 推流的环形缓存的数据数量，播放落后一半先丢弃非参考帧，落后超过它跳到最新的关键帧
+	MaxLag Duration `json:"maxLag"` // 发送的数据比最新的数据落后超过它则断开播放
+}
+
+func (c *PlayQueueConfig) validate(prefix string) error {
+	if c.Size < 0 || c.MaxLag < 0 {
+		return fmt.Errorf("%s.'playQueue' negative", prefix)
+	}
+	return nil
+}
+
+// 播放的统计
+type PlayStats struct {
+	Addr    string        // 播放的地址
+	Queued  int           // 还没有读取的数据
+	Dropped uint64        // 丢弃的数据
+	Skipped uint64        // 跳到下一个关键帧的次数
+	Lag     time.Duration // 最新的数据和发送的数据的时间戳的差
+}
+
+// 一个播放在推流的环形缓存中的位置，播放的协程读取数据，
+// 落后超过环形缓存的大小，跳到最新的关键帧
+type subscriber struct {
+	cursor  uint64 // 下一个读取的序号，原子操作，放在前面保证64位对齐
+	dropped uint64
+	skipped uint64
+	sent    uint32 // 最新读取的时间戳
+	slow    int32  // 太慢被断开
+	stream  *Stream
+	addr    string
+	maxLag  uint32 // 毫秒
+	kick    func() // 太慢的时候断开播放，可能是nil
+	// 下面的只有播放的协程使用
+	waitKey bool          // 丢弃数据，直到下一个关键帧
+	avc     *StreamData   // 最新读取的sequence header，只用来比较
+	acc     *StreamData   // 同上
+	pending []*StreamData // 跳过的sequence header，先发送
+}
+
+func newSubscriber(stream *Stream, addr string, kick func()) *subscriber {
+	s := new(subscriber)
+	s.stream = stream
+	s.addr = addr
+	s.kick = kick
+	lag := time.Duration(stream.playQueue.MaxLag)
+	if lag == 0 {
+		lag = DefaultPlayQueueMaxLag
+	}
+	s.maxLag = uint32(lag / time.Millisecond)
+	return s
+}
+
+// 是否可以丢弃的视频帧，flv的disposable inter frame，
+// 或者avc的nalu的nal_ref_idc都是0，nalu的长度假设是4字节
+func isDisposable(data *StreamData) bool {
+	b := data.data.Bytes()
+	if data.typeID != rtmp.VideoMessage || len(b) < 1 {
+		return false
+	}
+	if b[0]>>4 == 3 {
+		return true
+	}
+	if b[0]&0x0f != flvCodecAVC || len(b) < 5 || b[1] != 1 {
+		return false
+	}
+	b = b[5:]
+	vcl := false
+	for len(b) > 0 {
+		if len(b) < 5 {
+			return false
+		}
+		n := int(b[0])<<24 | int(b[1])<<16 | int(b[2])<<8 | int(b[3])
+		if n < 1 || n > len(b)-4 {
+			return false
+		}
+		nalu := b[4]
+		// 1到5是slice
+		if t := nalu & 0x1f; t >= 1 && t <= 5 {
+			if nalu&0x60 != 0 {
+				return false
+			}
+			vcl = true
+		}
+		b = b[4+n:]
+	}
+	return vcl
+}
+
+// 等待下一个数据，使用完要PutStreamData，
+// 返回nil表示推流结束，太慢被断开，或者done
+func (s *subscriber) next(done <-chan struct{}) *StreamData {
+	for {
+		data, wait := s.read()
+		if data != nil {
+			return data
+		}
+		if wait == nil {
+			return nil
+		}
+		select {
+		case <-wait:
+		case <-done:
+			return nil
+		}
+	}
+}
+
+// 读取下一个数据，没有数据返回等待的chan，两个都是nil表示结束
+func (s *subscriber) read() (*StreamData, <-chan struct{}) {
+	if s.isSlow() {
+		return nil, nil
+	}
+	if data := s.popPending(); data != nil {
+		return data, nil
+	}
+	st := s.stream
+	st.lock.RLock()
+	defer st.lock.RUnlock()
+	size := uint64(len(st.ring))
+	for {
+		cursor := s.cursor
+		if cursor == st.seq {
+			if !st.valid {
+				return nil, nil
+			}
+			return nil, st.notify
+		}
+		if st.seq-cursor > size {
+			// 被覆盖了
+			s.skip()
+			if data := s.popPending(); data != nil {
+				return data, nil
+			}
+			continue
+		}
+		data := st.ring[cursor%size]
+		atomic.StoreUint64(&s.cursor, cursor+1)
+		if isSequenceHeader(data) {
+			if data.typeID == rtmp.VideoMessage {
+				s.avc = data
+			} else {
+				s.acc = data
+			}
+			return data.retain(), nil
+		}
+		if s.waitKey {
+			if !isKeyFrame(data) {
+				atomic.AddUint64(&s.dropped, 1)
+				continue
+			}
+			s.waitKey = false
+		}
+		// 落后一半，先丢弃非参考帧
+		if st.seq-cursor > size/2 && isDisposable(data) {
+			atomic.AddUint64(&s.dropped, 1)
+			continue
+		}
+		if int32(st.timestamp-data.timestamp) > int32(s.maxLag) {
+			atomic.StoreInt32(&s.slow, 1)
+			return nil, nil
+		}
+		atomic.StoreUint32(&s.sent, data.timestamp)
+		return data.retain(), nil
+	}
+}
+
+// 跳到环形缓存中最新的关键帧，没有则等待下一个关键帧，音频也从那里开始，
+// 只有音频的推流跳到最新的数据。跳过了新的sequence header的话，先发送它们。
+// 调用者持有stream的读锁
+func (s *subscriber) skip() {
+	st := s.stream
+	size := uint64(len(st.ring))
+	cursor := st.seq
+	s.waitKey = st.hasVideo
+	if st.hasVideo {
+		for i := st.seq; i > st.seq-size; i-- {
+			data := st.ring[(i-1)%size]
+			if data.typeID == rtmp.VideoMessage && isKeyFrame(data) && !isSequenceHeader(data) {
+				cursor = i - 1
+				s.waitKey = false
+				break
+			}
+		}
+	}
+	atomic.AddUint64(&s.skipped, 1)
+	atomic.AddUint64(&s.dropped, cursor-s.cursor)
+	atomic.StoreUint64(&s.cursor, cursor)
+	if st.avc != nil && st.avc != s.avc {
+		s.avc = st.avc
+		s.pending = append(s.pending, st.avc.retain())
+	}
+	if st.acc != nil && st.acc != s.acc {
+		s.acc = st.acc
+		s.pending = append(s.pending, st.acc.retain())
+	}
+}
+
+func (s *subscriber) popPending() *StreamData {
+	if len(s.pending) < 1 {
+		return nil
+	}
+	data := s.pending[0]
+	s.pending[0] = nil
+	s.pending = s.pending[1:]
+	return data
+}
+
+// 是否太慢被断开
+func (s *subscriber) isSlow() bool {
+	return atomic.LoadInt32(&s.slow) != 0
+}
+
+// 太慢，断开播放，调用者持有stream的锁
+func (s *subscriber) disconnect() {
+	if !atomic.CompareAndSwapInt32(&s.slow, 0, 1) {
+		return
+	}
+	if s.kick != nil {
+		s.kick()
+	}
+}
+
+// 不再播放，释放跳过的sequence header
+func (s *subscriber) release() {
+	for data := s.popPending(); data != nil; data = s.popPending() {
+		PutStreamData(data)
+	}
+}
+
+func (s *subscriber) stats() PlayStats {
+	s.stream.lock.RLock()
+	defer s.stream.lock.RUnlock()
+	return s.statsLocked()
+}
+
+// 调用者持有stream的锁
+func (s *subscriber) statsLocked() PlayStats {
+	st := s.stream
+	queued := int64(st.seq - atomic.LoadUint64(&s.cursor))
+	if n := int64(len(st.ring)); queued > n {
+		queued = n
+	}
+	lag := int32(st.timestamp - atomic.LoadUint32(&s.sent))
+	if lag < 0 {
+		lag = 0
+	}
+	return PlayStats{
+		Addr:    s.addr,
+		Queued:  int(queued),
+		Dropped: atomic.LoadUint64(&s.dropped),
+		Skipped: atomic.LoadUint64(&s.skipped),
+		Lag:     time.Duration(lag) * time.Millisecond,
+	}
+}
@@ -0,0 +1,187 @@
+package server
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/qq51529210/rtmp"
+)
+
+func TestIsDisposable(t *testing.T) {
+	for i, c := range []struct {
+		b  []byte
+		ok bool
+	}{
+		{[]byte{0x32, 0}, true},
+		// nal_ref_idc是0的slice
+		{[]byte{0x27, 1, 0, 0, 0, 0, 0, 0, 2, 0x01, 0xff}, true},
+		{[]byte{0x27, 1, 0, 0, 0, 0, 0, 0, 2, 0x09, 0xf0, 0, 0, 0, 2, 0x01, 0xff}, true},
+		// 参考帧
+		{[]byte{0x27, 1, 0, 0, 0, 0, 0, 0, 2, 0x41, 0xff}, false},
+		{[]byte{0x27, 1, 0, 0, 0, 0, 0, 0, 2, 0x01, 0xff, 0, 0, 0, 2, 0x21, 0xff}, false},
+		// 长度不对
+		{[]byte{0x27, 1, 0, 0, 0, 0, 0, 0, 9, 0x01, 0xff}, false},
+		{[]byte{0x17, 1, 0, 0, 0, 0, 0, 0, 2, 0x65, 0xff}, false},
+	} {
+		if isDisposable(testStreamData(rtmp.VideoMessage, 0, c.b...)) != c.ok {
+			t.Fatal(i)
+		}
+	}
+}
+
+func TestSubscriber(t *testing.T) {
+	newTestStream := func(size int) *Stream {
+		s := newStream(new(Conn))
+		s.ring = make([]*StreamData, size)
+		s.playQueue.MaxLag = Duration(time.Second)
+		return s
+	}
+	s := newTestStream(4)
+	add := func(typeID uint8, timestamp uint32, b ...byte) {
+		msg := rtmp.GetMessage()
+		msg.TypeID = typeID
+		msg.Timestamp = timestamp
+		msg.Data.Write(b)
+		s.addData(msg)
+		rtmp.PutMessage(msg)
+	}
+	sub, _ := s.subscribe("test", nil)
+	read := func(timestamp uint32, b byte) {
+		data, _ := sub.read()
+		if data == nil || data.timestamp != timestamp || data.data.Bytes()[0] != b {
+			t.Fatal(timestamp, data)
+		}
+		PutStreamData(data)
+	}
+	add(rtmp.VideoMessage, 0, 0x17, 1)
+	add(rtmp.VideoMessage, 40, 0x27, 1)
+	read(0, 0x17)
+	read(40, 0x27)
+	// 被覆盖了，跳到最新的关键帧
+	add(rtmp.VideoMessage, 80, 0x17, 1)
+	add(rtmp.VideoMessage, 120, 0x27, 1)
+	add(rtmp.VideoMessage, 160, 0x27, 1)
+	add(rtmp.VideoMessage, 200, 0x17, 1)
+	add(rtmp.VideoMessage, 240, 0x27, 1)
+	read(200, 0x17)
+	read(240, 0x27)
+	if sub.skipped != 1 || sub.dropped != 3 {
+		t.FailNow()
+	}
+	// 落后一半，丢弃非参考帧
+	add(rtmp.VideoMessage, 280, 0x32, 1)
+	add(rtmp.VideoMessage, 320, 0x27, 1)
+	add(rtmp.VideoMessage, 360, 0x27, 1)
+	read(320, 0x27)
+	read(360, 0x27)
+	if sub.dropped != 4 {
+		t.FailNow()
+	}
+	// 没有关键帧，音频也等待下一个关键帧
+	for i := uint32(0); i < 5; i++ {
+		add(rtmp.VideoMessage, 400+i*40, 0x27, 1)
+	}
+	add(rtmp.AudioMessage, 600, 0xaf, 1)
+	add(rtmp.VideoMessage, 600, 0x17, 1)
+	read(600, 0x17)
+	if sub.skipped != 2 || sub.dropped != 10 {
+		t.FailNow()
+	}
+	// 跳过了新的sequence header，先发送它
+	add(rtmp.VideoMessage, 640, 0x17, 0, 0, 0, 0, 2)
+	add(rtmp.VideoMessage, 640, 0x17, 1)
+	add(rtmp.VideoMessage, 680, 0x27, 1)
+	add(rtmp.VideoMessage, 720, 0x27, 1)
+	add(rtmp.VideoMessage, 760, 0x27, 1)
+	read(640, 0x17)
+	if sub.avc == nil || sub.avc != s.avc {
+		t.FailNow()
+	}
+	read(640, 0x17)
+	stats := sub.stats()
+	if stats.Addr != "test" || stats.Queued != 3 || stats.Dropped != 11 || stats.Skipped != 3 || stats.Lag != 120*time.Millisecond {
+		t.Fatal(stats)
+	}
+	// 太慢
+	add(rtmp.AudioMessage, 2000, 0xaf, 1)
+	if data, wait := sub.read(); data != nil || wait != nil || !sub.isSlow() {
+		t.FailNow()
+	}
+	s.unsubscribe(sub)
+	s.close()
+	if s.ring[0] != nil {
+		t.FailNow()
+	}
+	// 推流一直没有被读取的播放会被断开
+	s = newTestStream(4)
+	kicked := false
+	sub, _ = s.subscribe("test", func() { kicked = true })
+	add(rtmp.AudioMessage, 0, 0xaf, 1)
+	s.checked = time.Time{}
+	add(rtmp.AudioMessage, 2000, 0xaf, 1)
+	if !kicked || !sub.isSlow() {
+		t.FailNow()
+	}
+	s.close()
+	// 推流结束，读完剩下的数据
+	s = newTestStream(4)
+	sub, _ = s.subscribe("test", nil)
+	add(rtmp.AudioMessage, 0, 0xaf, 1)
+	s.close()
+	read(0, 0xaf)
+	if sub.next(nil) != nil || sub.isSlow() || s.ring[0] == nil {
+		t.FailNow()
+	}
+	s.unsubscribe(sub)
+	if s.ring[0] != nil {
+		t.FailNow()
+	}
+	// 只有音频，跳到最新的数据
+	s = newTestStream(2)
+	defer s.close()
+	sub, _ = s.subscribe("test", nil)
+	for i := uint32(0); i < 3; i++ {
+		add(rtmp.AudioMessage, i*20, 0xaf, 1)
+	}
+	if data, wait := sub.read(); data != nil || wait == nil || sub.skipped != 1 || sub.dropped != 3 || sub.waitKey {
+		t.FailNow()
+	}
+}
+
+func TestServerPlayLoop(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := new(Server)
+	go s.Serve(context.Background(), ln)
+	defer s.Shutdown(context.Background())
+	url := "rtmp://" + ln.Addr().String() + "/live"
+	publisher := testDial(t, url)
+	defer publisher.Close()
+	err = publisher.Publish("test", "live")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stream := s.GetPublishStream(&StreamKey{Vhost: DefaultVhost, App: "live", Name: "test"})
+	player := testDial(t, url)
+	defer player.Close()
+	err = player.Play("test", -2, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 同一个连接不能同时播放两次
+	if player.Play("test", -2, -1) == nil || len(stream.PlayStats()) != 1 {
+		t.FailNow()
+	}
+	// 推流没有数据，播放断开也要结束
+	player.Close()
+	for i := 0; i < 100 && len(stream.PlayStats()) > 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if len(stream.PlayStats()) != 0 {
+		t.FailNow()
+	}
+}
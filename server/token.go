@@ -0,0 +1,110 @@
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+const (
+	TokenPublish = "publish"
+	TokenPlay    = "play"
+)
+
+// 验证失败，推流返回NetStream.Publish.BadName
+type authError struct {
+	reason string
+}
+
+func (e *authError) Error() string {
+	return e.reason
+}
+
+// 签名的token的query参数，可以加在流名称或者tcUrl后面，
+// action是TokenPublish或者TokenPlay，ip不是空则只有这个ip可以使用
+func SignToken(secret, action, app, name string, expire time.Time, ip string) url.Values {
+	query := url.Values{}
+	e := strconv.FormatInt(expire.Unix(), 10)
+	query.Set("expire", e)
+	if ip != "" {
+		query.Set("ip", ip)
+	}
+	query.Set("sign", tokenSign(secret, action, app+"/"+name, e, ip))
+	return query
+}
+
+// hex(hmac-sha256(secret, action\napp/name\nexpire\nip))
+func tokenSign(secret, action, stream, expire, ip string) string {
+	h := hmac.New(sha256.New, []byte(secret))
+	h.Write([]byte(action + "\n" + stream + "\n" + expire + "\n" + ip))
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// 检查过期时间和ip，connect的时候还不知道流的名称，只能检查这些
+func checkTokenExpire(query url.Values, ip string, now time.Time) error {
+	expire, err := strconv.ParseInt(query.Get("expire"), 10, 64)
+	if err != nil {
+		return &authError{reason: "token expire invalid"}
+	}
+	if now.Unix() > expire {
+		return &authError{reason: "token expired"}
+	}
+	if tokenIP := query.Get("ip"); tokenIP != "" && tokenIP != ip {
+		return &authError{reason: "token ip mismatch"}
+	}
+	return nil
+}
+
+// 验证签名的token，使用keys中的任意一个，这样可以轮换key
+func checkSignedToken(keys []string, action string, key *StreamKey, ip string, now time.Time) error {
+	sign := key.Query.Get("sign")
+	if sign == "" {
+		return &authError{reason: "token required"}
+	}
+	err := checkTokenExpire(key.Query, ip, now)
+	if err != nil {
+		return err
+	}
+	stream := key.String()
+	for _, secret := range keys {
+		s := tokenSign(secret, action, stream, key.Query.Get("expire"), key.Query.Get("ip"))
+		if hmac.Equal([]byte(s), []byte(sign)) {
+			return nil
+		}
+	}
+	return &authError{reason: "token sign invalid"}
+}
+
+// 验证，simple是简单的token，keys不是空则还要验证签名的token
+func (c *AuthConfig) check(action string, key *StreamKey, ip string) error {
+	simple := c.PublishToken
+	if action == TokenPlay {
+		simple = c.PlayToken
+		if c.AllowUnsignedPlay {
+			return checkToken(key, simple)
+		}
+	}
+	err := checkToken(key, simple)
+	if err != nil {
+		return err
+	}
+	if len(c.Keys) < 1 {
+		return nil
+	}
+	return checkSignedToken(c.Keys, action, key, ip, time.Now())
+}
+
+// 验证key的token参数，want是空则不验证
+func checkToken(key *StreamKey, want string) error {
+	if want == "" {
+		return nil
+	}
+	if subtle.ConstantTimeCompare([]byte(key.Query.Get("token")), []byte(want)) != 1 {
+		return &authError{reason: "invalid token"}
+	}
+	return nil
+}
@@ -0,0 +1,116 @@
+package server
+
+import (
+	"context"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/qq51529210/rtmp"
+)
+
+func TestSignedToken(t *testing.T) {
+	now := time.Now()
+	expire := now.Add(time.Minute)
+	key := &StreamKey{App: "live", Name: "test"}
+	check := func(action, ip string, keys ...string) error {
+		return checkSignedToken(keys, action, key, ip, now)
+	}
+	key.Query = SignToken("old", TokenPublish, "live", "test", expire, "")
+	// 轮换
+	if check(TokenPublish, "1.1.1.1", "new", "old") != nil {
+		t.FailNow()
+	}
+	if check(TokenPublish, "1.1.1.1", "new") == nil {
+		t.FailNow()
+	}
+	// action
+	if check(TokenPlay, "1.1.1.1", "old") == nil {
+		t.FailNow()
+	}
+	// 流
+	key.Name = "other"
+	if check(TokenPublish, "1.1.1.1", "old") == nil {
+		t.FailNow()
+	}
+	key.Name = "test"
+	// 过期
+	key.Query = SignToken("old", TokenPublish, "live", "test", now.Add(-time.Second), "")
+	if check(TokenPublish, "1.1.1.1", "old") == nil {
+		t.FailNow()
+	}
+	// ip
+	key.Query = SignToken("old", TokenPlay, "live", "test", expire, "1.1.1.1")
+	if check(TokenPlay, "1.1.1.1", "old") != nil {
+		t.FailNow()
+	}
+	if check(TokenPlay, "2.2.2.2", "old") == nil {
+		t.FailNow()
+	}
+	key.Query.Set("ip", "2.2.2.2")
+	if check(TokenPlay, "2.2.2.2", "old") == nil {
+		t.FailNow()
+	}
+	// 没有token
+	key.Query = nil
+	if check(TokenPlay, "1.1.1.1", "old") == nil {
+		t.FailNow()
+	}
+}
+
+func TestServerSignedToken(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.Apps = map[string]*AppConfig{
+		"live": {Auth: &AuthConfig{Keys: []string{"k1", "k2"}, AllowUnsignedPlay: true}},
+	}
+	err := cfg.Validate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := new(Server)
+	s.SetConfig(cfg)
+	go s.Serve(context.Background(), ln)
+	defer s.Shutdown(context.Background())
+	url := "rtmp://" + ln.Addr().String() + "/live"
+	expire := time.Now().Add(time.Minute)
+	// tcUrl的token过期
+	query := SignToken("k1", TokenPublish, "live", "test", time.Now().Add(-time.Minute), "")
+	c, err := rtmp.Dial(url + "?" + query.Encode())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Connect() == nil {
+		t.FailNow()
+	}
+	c.Close()
+	// 签名错误
+	publisher := testDial(t, url)
+	defer publisher.Close()
+	query = SignToken("k3", TokenPublish, "live", "test", expire, "")
+	err = publisher.Publish("test?"+query.Encode(), "live")
+	if err == nil || !strings.Contains(err.Error(), "NetStream.Publish.BadName") {
+		t.Fatal(err)
+	}
+	// play的token不能推流
+	query = SignToken("k2", TokenPlay, "live", "test", expire, "")
+	if publisher.Publish("test?"+query.Encode(), "live") == nil {
+		t.FailNow()
+	}
+	query = SignToken("k2", TokenPublish, "live", "test", expire, "127.0.0.1")
+	err = publisher.Publish("test?"+query.Encode(), "live")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 播放不验证签名
+	player := testDial(t, url)
+	defer player.Close()
+	err = player.Play("test", -2, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
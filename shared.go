@@ -0,0 +1,102 @@
+package rtmp
+
+import (
+	"bytes"
+	"sync"
+	"sync/atomic"
+)
+
+// 多个连接共享的消息数据，创建之后不能修改。
+// 使用引用计数，最后一次Release后数据回到Message的缓存。
+// 第一个chunk之后的chunk按chunk stream和chunk size只生成一次，
+// 所有使用相同chunk size的连接共享。
+type SharedData struct {
+	refs   int32
+	data   []byte
+	lock   sync.Mutex
+	chunks []sharedChunks
+}
+
+// 一种chunk stream和chunk size的chunk
+type sharedChunks struct {
+	csid      uint32
+	chunkSize uint32
+	data      []byte
+}
+
+// 取走msg的数据，不拷贝，引用计数是1
+func NewSharedData(msg *Message) *SharedData {
+	d := &SharedData{refs: 1, data: msg.Data.Bytes()}
+	msg.Data = bytes.Buffer{}
+	return d
+}
+
+func (d *SharedData) Bytes() []byte {
+	return d.data
+}
+
+func (d *SharedData) Len() int {
+	return len(d.data)
+}
+
+// 增加引用
+func (d *SharedData) Retain() *SharedData {
+	atomic.AddInt32(&d.refs, 1)
+	return d
+}
+
+// 减少引用，最后一次回收数据，之后不能再使用d
+func (d *SharedData) Release() {
+	n := atomic.AddInt32(&d.refs, -1)
+	if n > 0 {
+		return
+	}
+	if n < 0 {
+		panic("rtmp: SharedData released too many times")
+	}
+	msg := new(Message)
+	msg.Data = *bytes.NewBuffer(d.data[:0])
+	d.data = nil
+	d.chunks = nil
+	PutMessage(msg)
+}
+
+// 第一个chunk之后的所有chunk，每个chunk是fmt3的header和数据，
+// 没有extended timestamp，第一次调用时生成
+func (d *SharedData) continuation(csid, chunkSize uint32) []byte {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	for _, c := range d.chunks {
+		if c.csid == csid && c.chunkSize == chunkSize {
+			return c.data
+		}
+	}
+	var header ChunkHeader
+	header.FMT = ChunkFmt3
+	header.CSID = csid
+	var buf bytes.Buffer
+	for data := d.data[chunkLen(chunkSize, len(d.data)):]; len(data) > 0; {
+		header.Write(&buf)
+		n := chunkLen(chunkSize, len(data))
+		buf.Write(data[:n])
+		data = data[n:]
+	}
+	d.chunks = append(d.chunks, sharedChunks{csid: csid, chunkSize: chunkSize, data: buf.Bytes()})
+	return buf.Bytes()
+}
+
+// n个字节的数据，一个chunk的大小
+func chunkLen(chunkSize uint32, n int) int {
+	if uint32(n) > chunkSize {
+		return int(chunkSize)
+	}
+	return n
+}
+
+// 消息的数据，Shared不是nil则是它的数据
+func (m *Message) payload() []byte {
+	if m.Shared != nil {
+		return m.Shared.data
+	}
+	return m.Data.Bytes()
+}
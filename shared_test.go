@@ -0,0 +1,106 @@
+package rtmp
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestSharedData(t *testing.T) {
+	msg := GetMessage()
+	data := make([]byte, 300)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	msg.Data.Write(data)
+	shared := NewSharedData(msg)
+	PutMessage(msg)
+	if !bytes.Equal(shared.Bytes(), data) {
+		t.FailNow()
+	}
+	// 和普通消息发送的数据一样
+	for _, c := range []struct {
+		csid      uint32
+		chunkSize uint32
+		timestamp uint32
+	}{
+		{0, 128, 40},
+		{0, 100, 40},
+		{0, 4096, 40},
+		{100, 128, 40},
+		{400, 128, 40},
+		{0, 128, MaxMessageTimestamp + 1},
+	} {
+		var b1, b2 bytes.Buffer
+		for i, b := range []*bytes.Buffer{&b1, &b2} {
+			s := NewChunkScheduler(b)
+			s.SetChunkSize(c.chunkSize)
+			msg := testSchedulerMessage(c.csid, VideoMessage, 1, nil)
+			msg.Timestamp = c.timestamp
+			if i == 0 {
+				msg.Data.Write(data)
+			} else {
+				msg.Shared = shared.Retain()
+			}
+			err := s.Send(msg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = s.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		if !bytes.Equal(b1.Bytes(), b2.Bytes()) {
+			t.Fatal(c)
+		}
+	}
+	// 每种chunk stream和chunk size只生成一次，一个chunk和extended timestamp不使用
+	if len(shared.chunks) != 4 || shared.refs != 1 {
+		t.FailNow()
+	}
+	shared.Release()
+	if shared.data != nil {
+		t.FailNow()
+	}
+}
+
+func TestSharedDataSetChunkSize(t *testing.T) {
+	w := &testGateWriter{started: make(chan struct{}), gate: make(chan struct{})}
+	s := NewChunkScheduler(w)
+	video := make([]byte, chunkSchedulerBatchSize*3)
+	for i := range video {
+		video[i] = byte(i)
+	}
+	msg := testSchedulerMessage(0, VideoMessage, 1, video)
+	shared := NewSharedData(msg)
+	msg.Shared = shared
+	err := s.Send(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 视频发送到一半的时候修改chunk size
+	<-w.started
+	err = s.SetChunkSize(1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	close(w.gate)
+	err = s.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := NewChunkReader(&w.b)
+	for _, typeID := range []uint8{ControlMessageSetChunkSize, VideoMessage} {
+		msg, err := r.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if msg.TypeID != typeID || (typeID == VideoMessage && !bytes.Equal(msg.Data.Bytes(), video)) {
+			t.Fatal(msg.TypeID)
+		}
+		PutMessage(msg)
+	}
+	if w.b.Len() != 0 {
+		t.FailNow()
+	}
+}
@@ -0,0 +1,280 @@
+package rtmp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultTransactionTimeout = 10 * time.Second
+)
+
+var (
+	errTransactionClosed = errors.New("transaction manager closed")
+)
+
+// 处理对方主动的调用，比如onBWDone或者自定义的远程调用。
+// transaction id不是0时，返回值作为_result的information发送，错误则发送_error
+type CommandHandler func(streamID uint32, cmd Command) (interface{}, error)
+
+// 一个等待响应的调用
+type Future struct {
+	id     float64
+	done   chan struct{}
+	result *ResultCommand
+	err    error
+}
+
+// transaction id
+func (f *Future) ID() float64 {
+	return f.id
+}
+
+// 收到响应或者失败后关闭
+func (f *Future) Done() <-chan struct{} {
+	return f.done
+}
+
+// 等待_result，收到_error返回错误
+func (f *Future) Wait(ctx context.Context) (*ResultCommand, error) {
+	select {
+	case <-f.done:
+		return f.result, f.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// 等待消息流的onStatus
+type StatusWatcher struct {
+	m        *TransactionManager
+	streamID uint32
+	status   chan *OnStatusCommand
+	done     chan struct{}
+}
+
+// 等待code，level是error则返回错误
+func (w *StatusWatcher) Wait(ctx context.Context, code string) (*OnStatusCommand, error) {
+	for {
+		select {
+		case s := <-w.status:
+			if s.Info.Level == "error" {
+				return s, fmt.Errorf("command message '%s' error <%s> <%s>", CommandOnStatus, s.Info.Code, s.Info.Description)
+			}
+			if s.Info.Code == code {
+				return s, nil
+			}
+		case <-w.done:
+			return nil, w.m.error()
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// 不再等待
+func (w *StatusWatcher) Close() {
+	w.m.lock.Lock()
+	delete(w.m.watchers, w)
+	w.m.lock.Unlock()
+}
+
+// 分配transaction id，记录等待响应的调用，
+// 将_result，_error和onStatus交给等待的调用，其他的调用交给注册的处理函数
+type TransactionManager struct {
+	lock     sync.Mutex
+	send     func(streamID uint32, cmd Command) error
+	id       float64
+	pending  map[float64]*Future
+	watchers map[*StatusWatcher]struct{}
+	handlers map[string]CommandHandler
+	err      error
+	closed   chan struct{}
+	Timeout  time.Duration // Call的超时，0表示只使用context
+}
+
+// send用于发送命令
+func NewTransactionManager(send func(streamID uint32, cmd Command) error) *TransactionManager {
+	return &TransactionManager{
+		send:     send,
+		pending:  make(map[float64]*Future),
+		watchers: make(map[*StatusWatcher]struct{}),
+		handlers: make(map[string]CommandHandler),
+		closed:   make(chan struct{}),
+		Timeout:  DefaultTransactionTimeout,
+	}
+}
+
+func (m *TransactionManager) error() error {
+	m.lock.Lock()
+	err := m.err
+	m.lock.Unlock()
+	return err
+}
+
+// 注册name命令的处理函数，h是nil则删除
+func (m *TransactionManager) Handle(name string, h CommandHandler) {
+	m.lock.Lock()
+	if h == nil {
+		delete(m.handlers, name)
+	} else {
+		m.handlers[name] = h
+	}
+	m.lock.Unlock()
+}
+
+// 分配transaction id，发送cmd，返回等待响应的Future
+func (m *TransactionManager) Go(streamID uint32, cmd Command) (*Future, error) {
+	f := &Future{done: make(chan struct{})}
+	m.lock.Lock()
+	if m.err != nil {
+		m.lock.Unlock()
+		return nil, m.err
+	}
+	m.id++
+	f.id = m.id
+	m.pending[f.id] = f
+	m.lock.Unlock()
+	cmd.SetTransaction(f.id)
+	err := m.send(streamID, cmd)
+	if err != nil {
+		m.cancel(f.id)
+		return nil, err
+	}
+	return f, nil
+}
+
+// 发送cmd并等待响应，超时或者ctx取消后不再等待
+func (m *TransactionManager) Call(ctx context.Context, streamID uint32, cmd Command) (*ResultCommand, error) {
+	if m.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, m.Timeout)
+		defer cancel()
+	}
+	f, err := m.Go(streamID, cmd)
+	if err != nil {
+		return nil, err
+	}
+	res, err := f.Wait(ctx)
+	if err != nil {
+		// 超时或者取消
+		m.cancel(f.id)
+		return res, fmt.Errorf("command message '%s' %s", cmd.CommandName(), err.Error())
+	}
+	return res, nil
+}
+
+// 不再等待id的响应
+func (m *TransactionManager) cancel(id float64) {
+	m.lock.Lock()
+	delete(m.pending, id)
+	m.lock.Unlock()
+}
+
+// 发送命令，不需要响应，transaction id是0
+func (m *TransactionManager) Send(streamID uint32, cmd Command) error {
+	cmd.SetTransaction(0)
+	return m.send(streamID, cmd)
+}
+
+// 开始等待streamID的onStatus，在发送命令之前调用，使用完后调用Close
+func (m *TransactionManager) WatchStatus(streamID uint32) *StatusWatcher {
+	w := &StatusWatcher{
+		m:        m,
+		streamID: streamID,
+		status:   make(chan *OnStatusCommand, 8),
+		done:     m.closed,
+	}
+	m.lock.Lock()
+	m.watchers[w] = struct{}{}
+	m.lock.Unlock()
+	return w
+}
+
+// 处理收到的命令，返回false表示没有处理，
+// 比如服务端收到的connect，play等请求
+func (m *TransactionManager) Dispatch(streamID uint32, cmd Command) (bool, error) {
+	switch cmd := cmd.(type) {
+	case *ResultCommand:
+		m.lock.Lock()
+		f, ok := m.pending[cmd.TransactionID]
+		delete(m.pending, cmd.TransactionID)
+		m.lock.Unlock()
+		if ok {
+			f.result = cmd
+			if cmd.Error {
+				f.err = resultError(cmd)
+			}
+			close(f.done)
+		}
+		return true, nil
+	case *OnStatusCommand:
+		m.lock.Lock()
+		for w := range m.watchers {
+			if w.streamID != streamID {
+				continue
+			}
+			select {
+			case w.status <- cmd:
+			default:
+				// 缓存满了就丢弃
+			}
+		}
+		m.lock.Unlock()
+	}
+	m.lock.Lock()
+	h, ok := m.handlers[cmd.CommandName()]
+	m.lock.Unlock()
+	if !ok {
+		_, status := cmd.(*OnStatusCommand)
+		return status, nil
+	}
+	info, err := h(streamID, cmd)
+	id := cmd.Transaction()
+	if id == 0 {
+		return true, nil
+	}
+	res := &ResultCommand{Information: info}
+	if err != nil {
+		res.Error = true
+		res.Information = &StatusInfo{
+			Level:       "error",
+			Code:        "NetConnection.Call.Failed",
+			Description: err.Error(),
+		}
+	}
+	res.SetTransaction(id)
+	return true, m.send(streamID, res)
+}
+
+// 唤醒所有等待的调用，之后的调用返回err
+func (m *TransactionManager) Close(err error) {
+	if err == nil {
+		err = errTransactionClosed
+	}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.err != nil {
+		return
+	}
+	m.err = err
+	for id, f := range m.pending {
+		f.err = err
+		close(f.done)
+		delete(m.pending, id)
+	}
+	close(m.closed)
+}
+
+// _error转换成error
+func resultError(res *ResultCommand) error {
+	var info StatusInfo
+	UnmarshalAMF(res.Information, &info)
+	if info.Description != "" {
+		return fmt.Errorf("error <%s> <%s>", info.Code, info.Description)
+	}
+	return fmt.Errorf("error <%s>", info.Code)
+}
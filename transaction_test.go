@@ -0,0 +1,104 @@
+package rtmp
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// 两个TransactionManager，命令经过编码和解码交给对方
+func testTransactionManagers(t *testing.T) (*TransactionManager, *TransactionManager) {
+	var a, b *TransactionManager
+	link := func(peer **TransactionManager) func(uint32, Command) error {
+		return func(streamID uint32, cmd Command) error {
+			msg := GetMessage()
+			err := EncodeCommand(msg, cmd, 0)
+			if err != nil {
+				return err
+			}
+			cmd, err = DecodeCommand(msg)
+			PutMessage(msg)
+			if err != nil {
+				return err
+			}
+			go func() {
+				_, err := (*peer).Dispatch(streamID, cmd)
+				if err != nil {
+					t.Error(err)
+				}
+			}()
+			return nil
+		}
+	}
+	a = NewTransactionManager(link(&b))
+	b = NewTransactionManager(link(&a))
+	return a, b
+}
+
+func TestTransactionManager(t *testing.T) {
+	a, b := testTransactionManagers(t)
+	b.Handle("add", func(streamID uint32, cmd Command) (interface{}, error) {
+		var n1, n2 float64
+		err := unmarshalCommandValues(cmd.(*CallCommand).Arguments, &n1, &n2)
+		return n1 + n2, err
+	})
+	b.Handle("fail", func(streamID uint32, cmd Command) (interface{}, error) {
+		return nil, errors.New("failed")
+	})
+	res, err := a.Call(context.Background(), 0, &CallCommand{Name: "add", Arguments: []interface{}{1, 2}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Information != float64(3) || res.Transaction() != 1 {
+		t.Fatalf("%#v", res)
+	}
+	// _error
+	_, err = a.Call(context.Background(), 0, &CallCommand{Name: "fail"})
+	if err == nil {
+		t.FailNow()
+	}
+	// 没有处理函数，超时
+	a.Timeout = 10 * time.Millisecond
+	_, err = a.Call(context.Background(), 0, &CallCommand{Name: "unknown"})
+	if err == nil {
+		t.FailNow()
+	}
+	// 取消
+	a.Timeout = 0
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = a.Call(ctx, 0, &CallCommand{Name: "unknown"})
+	if err == nil {
+		t.FailNow()
+	}
+	// onStatus
+	w := a.WatchStatus(1)
+	b.Send(2, &OnStatusCommand{Info: StatusInfo{Level: "status", Code: "NetStream.Play.Start"}})
+	b.Send(1, &OnStatusCommand{Info: StatusInfo{Level: "status", Code: "NetStream.Play.Reset"}})
+	b.Send(1, &OnStatusCommand{Info: StatusInfo{Level: "status", Code: "NetStream.Play.Start"}})
+	ctx, cancel = context.WithTimeout(context.Background(), time.Second)
+	s, err := w.Wait(ctx, "NetStream.Play.Start")
+	cancel()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Info.Code != "NetStream.Play.Start" {
+		t.FailNow()
+	}
+	w.Close()
+	// 关闭后唤醒等待的调用
+	f, err := a.Go(0, &CallCommand{Name: "unknown"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.Close(nil)
+	_, err = f.Wait(context.Background())
+	if err != errTransactionClosed {
+		t.Fatal(err)
+	}
+	_, err = a.Go(0, &CallCommand{Name: "unknown"})
+	if err != errTransactionClosed {
+		t.Fatal(err)
+	}
+}